@@ -0,0 +1,815 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"golang.org/x/crypto/nacl/box"
+)
+
+var errNoIdentity = fmt.Errorf("Identity is empty!")
+var errMessageTooBig = fmt.Errorf("messages must be under %d characters...", chat.MaxMessageSize)
+var errIdentityTooBig = fmt.Errorf("username must be under %d bytes...", chat.MaxIdentitySize)
+var errKeyTooBig = fmt.Errorf("keys must be %d bytes...", chat.KeySize)
+var errBadHandshakeSignature = fmt.Errorf("handshake signature verification failed...")
+var errBadHandshakeSession = fmt.Errorf("handshake session could not be opened...")
+var errUnofferedSuite = fmt.Errorf("server chose a cipher suite we did not offer...")
+var errUnofferedVersion = fmt.Errorf("server chose a protocol version or capabilities we did not offer...")
+var errNoPeers = fmt.Errorf("the server did not agree to introduce peers...")
+var errHandshakeIncomplete = fmt.Errorf("handshake is incomplete, retrying...")
+var errReliableMessageTooBig = fmt.Errorf("reliable messages must be under %d characters...", chat.MaxReliableMessageSize)
+var errRecipientTooBig = fmt.Errorf("recipient must be between 1 and %d bytes...", chat.MaxIdentitySize)
+
+// Pings are sent this often unless Client.Keepalive is set, comfortably
+// inside the servers default idle timeout.
+const DefaultKeepalive = 30 * time.Second
+
+// Replayed messages are displayed with the local time the server received
+// them in this layout.
+const HistoryFormat = "Jan 2 15:04"
+
+// The handshake reply carries the servers box key, followed by the
+// servers identity key, the chosen version, capabilities and suite and a
+// signature over both box keys and what was offered and chosen, and
+// finally the sealed connection id and reset token.
+const HandshakeReplySize = chat.HandshakeReplySize
+
+// The session fields are guarded by the mutex, since they are replaced
+// by the receiving goroutine while messages are being sent.
+//
+// Session keys are rotated after RekeyMessages or RekeyInterval, which
+// default to the chat package values when left empty, and Suites are the
+// cipher suites offered in order of preference, defaulting to all of them.
+//
+// Each session has its own reliable channel, and anything still awaiting
+// acknowledgement when the session is replaced is sent again on the new one,
+// after joining the room we were last in.
+//
+// Messages for the user are passed to OnMessage with their type, or
+// printed when it is not set, and datagrams from anywhere but the server
+// are ignored unless they are from a peer.
+//
+// With an identity Key every handshake is signed, so the server binds our
+// identity to it on first use and nobody without it can claim it later.
+//
+// Other clients may be talked to directly once the server introduces us
+// to them as peers.
+//
+// Keepalives carry a timestamp the server returns, so every one measures
+// the round trip to the server.
+//
+// Messages from before we arrived in a room are replayed by the server,
+// and displayed with the time it received them in HistoryFormat.
+//
+// Every handshake states the protocol version we speak and asks for the
+// Capabilities, which default to all of them, and every message is
+// checked against its chat.Spec before it is acted on.
+type Client struct {
+	RekeyMessages uint64
+	RekeyInterval time.Duration
+	Suites        []chat.Suite
+	Capabilities  chat.Capability
+	Keepalive     time.Duration
+	OnMessage     func(kind byte, message []byte)
+	Key           ed25519.PrivateKey
+
+	identity string
+	address  string
+	hosts    *KnownHosts
+	c        net.PacketConn
+	server   net.Addr
+	quit     chan struct{}
+	closing  sync.Once
+
+	mu        sync.Mutex
+	session   bool
+	pub       [32]byte
+	priv      [32]byte
+	keys      *chat.KeyRing
+	reliable  *chat.Reliable
+	room      string
+	id        uint32
+	token     [chat.ResetTokenSize]byte
+	cookie    []byte
+	window    chat.ReplayWindow
+	fragments chat.Reassembler
+	offers    map[string]offer
+	peers     map[string]*peer
+	latency   chat.Latency
+	version   byte
+	agreed    chat.Capability
+}
+
+// Reads from the connection, checking the frame, and using the type
+// to decide where to send the content, while pinging the server at the
+// keepalive interval, until the client is closed or the context is
+// cancelled, which closes it.
+//
+// Each datagram is processed before the buffer is reused.
+//
+// Errors will be logged.
+func (c *Client) Run(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, c.Close)
+	defer stop()
+	go c.keepalive()
+
+	b := make([]byte, chat.BufferSize)
+	for {
+		l, addr, err := c.c.ReadFrom(b)
+		if errors.Is(err, net.ErrClosed) {
+			return ctx.Err()
+		} else if err != nil {
+			log.Printf("failed to read from connection: %s\n", err)
+			continue
+		} else if addr.String() != c.server.String() {
+			c.PeerProcess(addr, b[:l])
+			continue
+		}
+		c.MessageProcess(b[:l])
+	}
+}
+
+// Cleartext frames are only trusted until a session exists, after that
+// only sealed frames and authenticated resets are acted upon.
+//
+// A cleartext disconnect means the server refused our handshake, such as
+// when our identity is in use, so we wait for the next message to retry.
+func (c *Client) MessageProcess(message []byte) {
+	if chat.Clear(message) {
+		kind, body := message[len(chat.Signature)], message[len(chat.Signature)+1:]
+		if err := chat.CheckToClient(kind, body, false); err != nil {
+			log.Printf("unexpected cleartext %s message: %s\n", chat.MessageName(kind), err)
+			return
+		}
+		switch kind {
+		case chat.MessageDisconnected:
+			if c.Established() {
+				log.Printf("ignoring unauthenticated disconnect: %s\n", string(body))
+				return
+			}
+			log.Printf("handshake refused: %s\n", string(body))
+		case chat.MessageHandshake:
+			c.HandshakeReceive(body)
+		case chat.MessageReset:
+			c.ResetReceive(body)
+		case chat.MessageRetry:
+			c.RetryReceive(body)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	id, ok := chat.ConnectionID(message)
+	if !c.session || !ok || id != c.id {
+		c.mu.Unlock()
+		log.Printf("frame does not match our session, discarding...\n")
+		return
+	}
+	keys, reliable := c.keys, c.reliable
+	c.mu.Unlock()
+
+	seq, kind, body, err := keys.Open(message)
+	if err != nil {
+		log.Printf("failed to open frame: %s\n", err)
+		return
+	} else if !c.window.Check(seq) {
+		log.Printf("dropped replayed message %d: %#v\n", seq, c.window.Stats())
+		return
+	} else if err := chat.CheckToClient(kind, body, true); err != nil {
+		log.Printf("malformed %s message: %s\n", chat.MessageName(kind), err)
+		return
+	}
+
+	if kind == chat.MessageFragment {
+		var ok bool
+		if kind, body, ok, err = c.fragments.Add(body); err != nil {
+			log.Printf("invalid fragment: %s\n", err)
+			return
+		} else if !ok {
+			return
+		} else if err := chat.CheckToClient(kind, body, true); err != nil {
+			log.Printf("malformed %s message: %s\n", chat.MessageName(kind), err)
+			return
+		}
+	}
+
+	switch kind {
+	case chat.MessageDisconnected:
+		log.Printf("disconnected by server: %s\n", string(body))
+		c.HandshakeSend()
+	case chat.MessageChat, chat.MessageDirect, chat.MessageNotice, chat.MessageHistory, chat.MessagePeer, chat.MessageRelay:
+		c.receive(kind, body)
+	case chat.MessageReliable:
+		ready, err := reliable.Receive(body)
+		if err != nil {
+			log.Printf("invalid reliable message: %s\n", err)
+		}
+		for _, d := range ready {
+			c.receive(d.Kind, d.Body)
+		}
+	case chat.MessageAck:
+		reliable.Ack(body)
+	case chat.MessagePong:
+		c.PongReceive(body)
+	case chat.MessageRekey:
+		if err := keys.Follow(body); err != nil {
+			log.Printf("invalid rekey: %s\n", err)
+		}
+	default:
+		log.Printf("unexpected %s message\n", chat.MessageName(kind))
+	}
+}
+
+// Tell the server we are leaving if we have a session, then stop the
+// keepalive and close the connection.
+//
+// Only the first call does anything.
+func (c *Client) Close() {
+	if c.c != nil {
+		c.closing.Do(c.close)
+	}
+}
+
+func (c *Client) close() {
+	close(c.quit)
+	if c.Established() {
+		for _, p := range c.peerList() {
+			c.peerSend(p, chat.MessageDisconnected, []byte("goodbye..."))
+		}
+		c.sendFrame(chat.MessageDisconnected, []byte("goodbye..."))
+	}
+	c.mu.Lock()
+	if c.reliable != nil {
+		c.reliable.Close()
+	}
+	c.mu.Unlock()
+	c.c.Close()
+}
+
+// Establishes the UDP connection to a specified remote server
+// using a defined buffer size.
+//
+// Establishes identity, and sets up asynchronous listener.
+//
+// The known hosts are used to verify the server identity key
+// received with every handshake reply, under the address as given.
+//
+// Sends handshake request to establish the connection.
+func (c *Client) Init(identity, address string, hosts *KnownHosts) error {
+	serverAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	localAddr, err := net.ResolveUDPAddr("udp", ":0")
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		return err
+	}
+	conn.SetReadBuffer(chat.BufferSize)
+	conn.SetWriteBuffer(chat.BufferSize)
+
+	return c.start(identity, address, conn, serverAddr, hosts)
+}
+
+// Talks to the server over an existing connection, which the client takes
+// ownership of and closes along with itself.
+//
+// The known hosts are used to verify the server identity key under the
+// address of the server.
+func (c *Client) InitPacketConn(identity string, conn net.PacketConn, server net.Addr, hosts *KnownHosts) error {
+	return c.start(identity, server.String(), conn, server, hosts)
+}
+
+func (c *Client) start(identity, address string, conn net.PacketConn, server net.Addr, hosts *KnownHosts) error {
+	c.identity = identity
+	c.address = address
+	c.hosts = hosts
+	c.quit = make(chan struct{})
+	c.offers = make(map[string]offer)
+	c.peers = make(map[string]*peer)
+	if c.Keepalive <= 0 {
+		c.Keepalive = DefaultKeepalive
+	}
+	if c.RekeyMessages == 0 {
+		c.RekeyMessages = chat.DefaultRekeyMessages
+	}
+	if c.RekeyInterval == 0 {
+		c.RekeyInterval = chat.DefaultRekeyInterval
+	}
+	if len(c.Suites) == 0 {
+		c.Suites = chat.Suites
+	}
+	if c.Capabilities == 0 {
+		c.Capabilities = chat.Capabilities
+	}
+	if c.identity == "" {
+		conn.Close()
+		return errNoIdentity
+	} else if len([]byte(c.identity)) > chat.MaxIdentitySize {
+		conn.Close()
+		return errIdentityTooBig
+	} else if err := chat.ValidIdentity(c.identity); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.c, c.server = conn, server
+	return c.HandshakeSend()
+}
+
+// Reports whether a handshake has completed.
+func (c *Client) Established() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// Used when establishing a connection, or dealing with
+// disconnection.
+//
+// Any existing session is abandoned.
+func (c *Client) HandshakeSend() error {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	// @note: the server signs its reply with a long-lived identity key, and
+	// with a Key so do we, but without one our handshake is not signed, so
+	// a proxy could still replace our public key or set your identity to
+	// mrpoopybutthole; it just could not read or forge anything we receive
+	// from the real server.
+
+	// keep keys to precompute and verify when we get the return handshake
+	c.mu.Lock()
+	c.session = false
+	copy(c.priv[:], priv[:])
+	copy(c.pub[:], pub[:])
+	c.mu.Unlock()
+
+	return c.handshake()
+}
+
+// Sends a handshake with the public key, our suites and identity, along
+// with the last cookie the server gave us, which saves a round trip if it
+// is still valid, signed when we have an identity key.
+func (c *Client) handshake() error {
+	c.mu.Lock()
+	h := c.hello()
+	h.Cookie, h.Identity = c.cookie, c.identity
+	c.mu.Unlock()
+	if c.Key != nil {
+		h.Sign(c.Key)
+	}
+	data := chat.ClearFrame(chat.MessageHello, h.Body())
+
+	_, err := c.c.WriteTo(data, c.server)
+	return err
+}
+
+// What we offer in every handshake, which the server signs in its reply;
+// the caller must hold the lock.
+func (c *Client) hello() *chat.Handshake {
+	return &chat.Handshake{Version: chat.ProtocolVersion, Capabilities: c.Capabilities, Key: c.pub, Suites: c.Suites}
+}
+
+// The server wants proof that we can receive from it before doing any
+// work for our handshake, so we send it again with the cookie.
+//
+// Retries are only answered while a handshake is in progress.
+func (c *Client) RetryReceive(cookie []byte) {
+	c.mu.Lock()
+	waiting := !c.session
+	if waiting && len(cookie) == chat.CookieSize {
+		// @note: a fresh copy, since a handshake being sent may still hold
+		// the old one
+		c.cookie = append([]byte(nil), cookie...)
+	}
+	c.mu.Unlock()
+
+	if !waiting || len(cookie) != chat.CookieSize {
+		log.Printf("ignoring unexpected retry...\n")
+		return
+	}
+	c.handshake()
+}
+
+// Complete the handshake by verifying the server identity and the
+// signature over both box keys and the suites, then precomputing the
+// received key and opening the connection id and reset token sealed
+// with it.
+//
+// The chosen suite must be one we offered, and the version one we speak
+// with capabilities we asked for, which the signature proves were not
+// changed along the way.
+//
+// A reply that fails verification is dropped, leaving the handshake
+// incomplete so nothing we send can be read by the impostor.
+func (c *Client) HandshakeReceive(body []byte) {
+	reply, err := chat.ReplySplit(body)
+	if err != nil {
+		log.Printf("handshake failed due to reply size (%d): %s", len(body), err)
+		return
+	}
+	pub, identity, suite, sealed := reply.Key, reply.Identity, reply.Suite, reply.Sealed
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session {
+		log.Printf("ignoring handshake reply for an established session...\n")
+		return
+	} else if err := c.hosts.Verify(c.address, identity); err != nil {
+		log.Printf("handshake rejected for %s (%s): %s\n", c.address, chat.Fingerprint(identity), err)
+		return
+	} else if _, err := chat.ChooseSuite([]chat.Suite{suite}, c.Suites); err != nil {
+		log.Printf("handshake rejected for %s: %s\n", suite, errUnofferedSuite)
+		return
+	} else if reply.Version < chat.MinProtocolVersion || reply.Version > chat.ProtocolVersion || !c.Capabilities.Has(reply.Capabilities) {
+		log.Printf("handshake rejected for version %d with %s: %s\n", reply.Version, reply.Capabilities, errUnofferedVersion)
+		return
+	} else if !ed25519.Verify(identity, chat.HandshakeTranscript(&pub, c.hello(), reply.Version, reply.Capabilities, suite), reply.Signature) {
+		log.Printf("handshake rejected: %s\n", errBadHandshakeSignature)
+		return
+	}
+
+	var shared [32]byte
+	box.Precompute(&shared, &pub, &c.priv)
+
+	var nonce [chat.NaClNonceSize]byte
+	copy(nonce[:], sealed)
+	session, ok := box.OpenAfterPrecomputation(nil, sealed[chat.NaClNonceSize:], &nonce, &shared)
+	if !ok {
+		log.Printf("handshake rejected: %s\n", errBadHandshakeSession)
+		return
+	}
+
+	c.keys = chat.NewKeyRing(suite, shared, chat.DirectionToServer, chat.DirectionToClient)
+	c.version, c.agreed = reply.Version, reply.Capabilities
+	c.id = binary.BigEndian.Uint32(session)
+	copy(c.token[:], session[chat.ConnectionIDSize:])
+	c.session = true
+
+	// the server numbers a new session from the beginning
+	c.window.Reset()
+	c.fragments.Reset()
+	c.latency.Reset()
+	log.Printf("Handshake completed with %s using %s, version %d with %s!\n", chat.Fingerprint(identity), suite, reply.Version, reply.Capabilities)
+
+	// ping at once, which confirms the session so the server replays the
+	// history of our room, rather than waiting for the first keepalive
+	go c.Ping()
+
+	// rejoin our room and carry unacknowledged messages over to the new
+	// session, outside the lock since sending needs it
+	previous := c.reliable
+	c.reliable = chat.NewReliable(c.sendFrame)
+	c.reliable.OnFail = func(d chat.Delivery) {
+		log.Printf("gave up on reliable message: %s\n", string(d.Body))
+	}
+	var pending []chat.Delivery
+	if c.room != "" {
+		pending = append(pending, chat.Delivery{Kind: chat.MessageJoin, Body: []byte(c.room)})
+	}
+	if previous != nil {
+		previous.Close()
+		for _, d := range previous.Pending() {
+			if d.Kind != chat.MessageJoin && d.Kind != chat.MessageLeave {
+				pending = append(pending, d)
+			}
+		}
+	}
+	if len(pending) > 0 {
+		go c.resend(c.reliable, pending)
+	}
+}
+
+func (c *Client) resend(reliable *chat.Reliable, pending []chat.Delivery) {
+	for _, d := range pending {
+		if err := reliable.Send(d.Kind, d.Body); err != nil {
+			log.Printf("failed to resend reliable message: %s\n", err)
+		}
+	}
+}
+
+// A reset is accepted only when it carries the token we were given with
+// our session, in which case the server has forgotten us and we start over.
+func (c *Client) ResetReceive(body []byte) {
+	c.mu.Lock()
+	valid := c.session && len(body) == chat.ConnectionIDSize+chat.ResetTokenSize &&
+		binary.BigEndian.Uint32(body) == c.id && hmac.Equal(body[chat.ConnectionIDSize:], c.token[:])
+	c.mu.Unlock()
+
+	if !valid {
+		log.Printf("ignoring unauthenticated reset...\n")
+		return
+	}
+	log.Printf("session reset by server, reconnecting...\n")
+	c.HandshakeSend()
+}
+
+// Hands introductions and relayed frames to our peers, and everything
+// else to the user.
+func (c *Client) receive(kind byte, body []byte) {
+	switch kind {
+	case chat.MessagePeer:
+		c.PeerReceive(body)
+	case chat.MessageRelay:
+		c.RelayReceive(body)
+	case chat.MessageHistory:
+		if at, sender, message, err := chat.HistorySplit(body); err != nil {
+			log.Printf("invalid history: %s\n", err)
+		} else {
+			c.display(kind, []byte(fmt.Sprintf("[%s] %s: %s", at.Local().Format(HistoryFormat), sender, message)))
+		}
+	default:
+		c.display(kind, body)
+	}
+}
+
+func (c *Client) MessageReceive(message []byte) {
+	fmt.Println(string(message))
+}
+
+// Prints messages from the room, private messages, messages from peers
+// and server notices, unless they are handed to OnMessage instead.
+func (c *Client) display(kind byte, message []byte) {
+	if c.OnMessage != nil {
+		c.OnMessage(kind, message)
+		return
+	}
+	switch kind {
+	case chat.MessageChat, chat.MessageHistory:
+		c.MessageReceive(message)
+	case chat.MessageDirect:
+		c.MessageReceive(append([]byte("(private) "), message...))
+	case chat.MessagePeer:
+		c.MessageReceive(append([]byte("(peer) "), message...))
+	case chat.MessageNotice:
+		c.MessageReceive(append([]byte("* "), message...))
+	}
+}
+
+func (c *Client) MessageSend(message string) error {
+	// @note: since UDP is "connectionless", unless we receive an explicit
+	// command for disconnection we won't try to establish a new handshake,
+	// but the client is written to be resilient so when the server no longer
+	// knows our session it will send a reset to trigger the reconnection,
+	// at the cost of lost inbound messages sent by the client.
+
+	messageBytes := []byte(message)
+	if len(messageBytes) > chat.MaxMessageSize {
+		return errMessageTooBig
+	}
+
+	if !c.Established() {
+		if err := c.HandshakeSend(); err != nil {
+			return err
+		}
+		return errHandshakeIncomplete
+	}
+
+	return c.sendFrame(chat.MessageChat, messageBytes)
+}
+
+// Sends the message over the reliable channel, so it is retransmitted
+// until the server acknowledges it and relayed to the other clients in
+// the order it was sent.
+func (c *Client) MessageSendReliable(message string) error {
+	messageBytes := []byte(message)
+	if len(messageBytes) > chat.MaxReliableMessageSize {
+		return errReliableMessageTooBig
+	}
+
+	c.mu.Lock()
+	reliable, ok := c.reliable, c.session
+	c.mu.Unlock()
+	if !ok {
+		if err := c.HandshakeSend(); err != nil {
+			return err
+		}
+		return errHandshakeIncomplete
+	}
+
+	return reliable.Send(chat.MessageChat, messageBytes)
+}
+
+// Sends a private message to the client with the given identity, which
+// the server relays only to them.
+func (c *Client) DirectSend(to, message string, reliable bool) error {
+	if len(to) == 0 || len(to) > chat.MaxIdentitySize {
+		return errRecipientTooBig
+	} else if len(message) > chat.MaxMessageSize {
+		return errMessageTooBig
+	} else if reliable && len(message) > chat.MaxReliableMessageSize {
+		return errReliableMessageTooBig
+	}
+	return c.control(chat.MessageDirect, chat.DirectBody(to, []byte(message)), reliable)
+}
+
+// Asks the server who is connected, which arrives as a notice.
+func (c *Client) Who() error {
+	return c.control(chat.MessageWho, nil, true)
+}
+
+// Changes our identity, which is part of the handshake, so a new one is
+// sent and the server replaces our session once it completes.
+func (c *Client) Nick(identity string) error {
+	if identity == "" {
+		return errNoIdentity
+	} else if len(identity) > chat.MaxIdentitySize {
+		return errIdentityTooBig
+	} else if err := chat.ValidIdentity(identity); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.identity = identity
+	c.mu.Unlock()
+	return c.HandshakeSend()
+}
+
+// Asks the server for the fingerprint of the key bound to the identity,
+// which arrives as a notice to compare with the one its owner sees.
+func (c *Client) Whois(identity string) error {
+	if len(identity) == 0 || len(identity) > chat.MaxIdentitySize {
+		return errRecipientTooBig
+	}
+	return c.control(chat.MessageWhois, []byte(identity), true)
+}
+
+// The fingerprint of our identity key, or nothing without one.
+func (c *Client) Fingerprint() string {
+	if c.Key == nil {
+		return ""
+	}
+	return chat.Fingerprint(c.Key.Public().(ed25519.PublicKey))
+}
+
+// Moves to the room, which is remembered so we return to it after
+// handshaking again, or join it once a handshake in progress completes.
+func (c *Client) Join(room string) error {
+	if err := chat.ValidRoom(room); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.room = room
+	ok := c.session
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return c.control(chat.MessageJoin, []byte(room), true)
+}
+
+// Returns to the default room.
+func (c *Client) Leave() error {
+	c.mu.Lock()
+	c.room = ""
+	ok := c.session
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return c.control(chat.MessageLeave, nil, true)
+}
+
+// Sends a message that is not a chat line, starting a handshake instead
+// if there is no session.
+func (c *Client) control(kind byte, body []byte, reliable bool) error {
+	c.mu.Lock()
+	channel, ok := c.reliable, c.session
+	c.mu.Unlock()
+	if !ok {
+		if err := c.HandshakeSend(); err != nil {
+			return err
+		}
+		return errHandshakeIncomplete
+	} else if reliable {
+		return channel.Send(kind, body)
+	}
+	return c.sendFrame(kind, body)
+}
+
+// Seals the message under the next sequence number for our session,
+// fragmenting it if it does not fit a single frame, then rotates the
+// session keys if they are due.
+func (c *Client) sendFrame(kind byte, message []byte) error {
+	c.mu.Lock()
+	keys, id := c.keys, c.id
+	c.mu.Unlock()
+
+	frames, err := keys.SealMessage(id, kind, message)
+	if err != nil {
+		return err
+	}
+	for _, data := range frames {
+		if _, err = c.c.WriteTo(data, c.server); err != nil {
+			return err
+		}
+	}
+
+	data, err := keys.RekeyDue(id, c.RekeyMessages, c.RekeyInterval)
+	if err != nil || data == nil {
+		return err
+	}
+	_, err = c.c.WriteTo(data, c.server)
+	return err
+}
+
+// Rotates the session keys immediately.
+func (c *Client) Rekey() error {
+	c.mu.Lock()
+	keys, id, ok := c.keys, c.id, c.session
+	c.mu.Unlock()
+	if !ok {
+		return errHandshakeIncomplete
+	}
+
+	data, err := keys.Rekey(id)
+	if err != nil {
+		return err
+	}
+	_, err = c.c.WriteTo(data, c.server)
+	return err
+}
+
+// Sends a ping at each interval while a session is established, so the
+// server does not evict us while we are quietly reading, and to each peer
+// we reach directly, so the NAT mappings between us stay open.
+//
+// Stops when the client is closed.
+func (c *Client) keepalive() {
+	t := time.NewTicker(c.Keepalive)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-t.C:
+			if !c.Established() {
+				continue
+			} else if err := c.sendFrame(chat.MessagePing, chat.PingBody()); err != nil {
+				log.Printf("failed to send keepalive: %s\n", err)
+			}
+			for _, p := range c.peerList() {
+				if _, direct := p.route(); direct {
+					c.peerSend(p, chat.MessagePing, nil)
+				}
+			}
+		}
+	}
+}
+
+// Measures the round trip to the server now, rather than waiting for the
+// next keepalive.
+func (c *Client) Ping() error {
+	return c.control(chat.MessagePing, chat.PingBody(), false)
+}
+
+// Samples the round trip of our ping, and returns the timestamp of the
+// server so it can measure the round trip too.
+func (c *Client) PongReceive(body []byte) {
+	rtt, err := chat.RoundTrip(body)
+	if err != nil {
+		log.Printf("invalid pong: %s\n", err)
+		return
+	}
+	c.latency.Sample(rtt)
+	if len(body) == 2*chat.TimestampSize {
+		c.sendFrame(chat.MessagePong, body[chat.TimestampSize:])
+	}
+}
+
+// The round trips to the server this session, and the loss of datagrams
+// from it.
+func (c *Client) Metrics() chat.Metrics {
+	return c.latency.Metrics(c.window.Stats())
+}
+
+// The protocol version and capabilities agreed with the server this
+// session.
+func (c *Client) Version() (byte, chat.Capability) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version, c.agreed
+}
+
+// Counters of accepted, duplicate and stale messages this session.
+func (c *Client) ReplayStats() chat.ReplayStats {
+	return c.window.Stats()
+}
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"crypto/rand"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/memnet"
+)
+
+// A client with an established session but no connection, along with
+// the session key the server would hold.
+func session(t *testing.T) (*Client, [chat.KeySize]byte) {
+	var key [chat.KeySize]byte
+	c := &Client{session: true, id: 7}
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	} else if _, err := rand.Read(c.token[:]); err != nil {
+		t.Fatalf("failed to generate token: %s", err)
+	}
+	c.keys = chat.NewKeyRing(chat.SuiteChaCha20Poly1305, key, chat.DirectionToServer, chat.DirectionToClient)
+	return c, key
+}
+
+func TestMessageReplay(t *testing.T) {
+	c, key := session(t)
+
+	seal := func(seq uint64) []byte {
+		data, err := chat.SealFrame(c.keys.Suite().AEAD(&key), chat.DirectionToClient, c.id, seq, chat.MessageChat, []byte("hello"))
+		if err != nil {
+			t.Fatalf("failed to seal frame: %s", err)
+		}
+		return data
+	}
+	captured := [][]byte{seal(1), seal(2), seal(3), seal(200)}
+
+	// reordered, replayed, and finally too old to fit the window
+	for _, i := range []int{2, 0, 1, 2, 0, 3, 1} {
+		c.MessageProcess(captured[i])
+	}
+
+	stats := c.ReplayStats()
+	if stats.Accepted != 4 || stats.Duplicate != 2 || stats.Stale != 1 {
+		t.Fatalf("unexpected counters: %#v", stats)
+	}
+}
+
+func TestUnauthenticatedDisconnect(t *testing.T) {
+	c, _ := session(t)
+
+	c.MessageProcess(chat.ClearFrame(chat.MessageDisconnected, []byte("forged...")))
+
+	forged := make([]byte, chat.ConnectionIDSize+chat.ResetTokenSize)
+	forged[chat.ConnectionIDSize-1] = byte(c.id)
+	c.MessageProcess(chat.ClearFrame(chat.MessageReset, forged))
+
+	if !c.Established() {
+		t.Fatal("expected forged disconnect and reset to be ignored...")
+	}
+}
+
+// Our own frames sent back to us do not open, since they were sealed for
+// the server, so a reflected disconnect or chat is ignored.
+func TestReflected(t *testing.T) {
+	c, _ := session(t)
+	for _, kind := range []byte{chat.MessageChat, chat.MessageAck, chat.MessageDisconnected} {
+		frame, err := c.keys.Seal(c.id, kind, make([]byte, chat.MessageIDSize))
+		if err != nil {
+			t.Fatalf("failed to seal: %s", err)
+		}
+		c.MessageProcess(frame)
+	}
+	if stats := c.ReplayStats(); stats.Accepted != 0 || !c.Established() {
+		t.Fatalf("expected our own frames to be ignored, got %#v", stats)
+	}
+}
+
+// Only a frame the peer sealed, from the host the server introduced,
+// routes our frames straight to it, so neither our own punch sent back
+// to us nor one of theirs sent on from elsewhere can redirect them.
+func TestPeerRoute(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	conn, err := memnet.New(1).Listen("alice")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	hosts, _ := LoadKnownHosts(filepath.Join(t.TempDir(), "known_hosts"), true)
+	c := &Client{OnMessage: func(byte, []byte) {}}
+	if err := c.InitPacketConn("alice", conn, memnet.Addr("server"), hosts); err != nil {
+		t.Fatalf("failed to init client: %s", err)
+	}
+	defer c.Close()
+
+	var key [chat.KeySize]byte
+	p := &peer{identity: "bob", id: 1 << 31, keys: chat.NewKeyRing(chat.PeerSuite, key, chat.DirectionFirstPeer, chat.DirectionSecondPeer), introduced: memnet.Addr("bob:1"), addr: memnet.Addr("bob:1")}
+	bob := chat.NewKeyRing(chat.PeerSuite, key, chat.DirectionSecondPeer, chat.DirectionFirstPeer)
+	c.mu.Lock()
+	c.peers["bob"] = p
+	c.mu.Unlock()
+
+	ours, _ := p.keys.Seal(p.id, chat.MessagePunch, nil)
+	c.PeerProcess(memnet.Addr("bob:1"), ours)
+	theirs, _ := bob.Seal(p.id, chat.MessagePunch, nil)
+	c.PeerProcess(memnet.Addr("mallory:1"), theirs)
+	if addr, direct := p.route(); direct || addr != memnet.Addr("bob:1") {
+		t.Fatalf("expected to still relay to bob:1, got %s direct %t", addr, direct)
+	}
+
+	// a NAT may give them another port, which is kept once found
+	for _, from := range []memnet.Addr{"bob:2", "bob:3"} {
+		theirs, _ := bob.Seal(p.id, chat.MessagePunch, nil)
+		c.PeerProcess(from, theirs)
+	}
+	if addr, direct := p.route(); !direct || addr != memnet.Addr("bob:2") {
+		t.Fatalf("expected to talk to bob:2 directly, got %s direct %t", addr, direct)
+	}
+}
+
+// The server rotates keys mid-conversation, and its messages arrive
+// reordered around the rekey notice.
+func TestRekey(t *testing.T) {
+	c, key := session(t)
+	server := chat.NewKeyRing(c.keys.Suite(), key, chat.DirectionToClient, chat.DirectionToServer)
+
+	before, _ := server.Seal(c.id, chat.MessageChat, []byte("before"))
+	notice, err := server.Rekey(c.id)
+	if err != nil {
+		t.Fatalf("failed to rekey: %s", err)
+	}
+	after, _ := server.Seal(c.id, chat.MessageChat, []byte("after"))
+
+	for _, frame := range [][]byte{before, after, notice} {
+		c.MessageProcess(frame)
+	}
+
+	if stats := c.ReplayStats(); stats.Accepted != 3 {
+		t.Fatalf("expected all 3 messages accepted, got %#v", stats)
+	} else if c.keys.Epoch() != 1 {
+		t.Fatalf("expected epoch 1, got %d", c.keys.Epoch())
+	}
+}
+
+// No datagram from the server, whether it answers our handshake or
+// arrives sealed under the session, makes the client panic.
+func FuzzMessageProcess(f *testing.F) {
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() { log.SetOutput(os.Stderr) })
+	pub := new([chat.KeySize]byte)
+	f.Add(chat.ClearFrame(chat.MessageHandshake, make([]byte, chat.HandshakeReplySize)), byte(0), false)
+	f.Add(chat.ClearFrame(chat.MessageRetry, make([]byte, chat.CookieSize)), byte(0), false)
+	f.Add(chat.ClearFrame(chat.MessageDisconnected, []byte("protocol version 1")), byte(0), false)
+	f.Add([]byte("hello"), chat.MessageChat, true)
+	f.Add(chat.HistoryBody(time.Now(), "bob", []byte("hello")), chat.MessageHistory, true)
+	f.Add(chat.PeerBody(pub, "bob", "127.0.0.1:9"), chat.MessagePeer, true)
+	f.Add(append(make([]byte, chat.MessageIDSize), chat.MessageNotice, 'x'), chat.MessageReliable, true)
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 2, chat.MessageChat, 'x'}, chat.MessageFragment, true)
+
+	// the client is set up once, so each input costs no more than
+	// processing it
+	conn, err := memnet.New(1).Listen("client")
+	if err != nil {
+		f.Fatalf("failed to listen: %s", err)
+	}
+	hosts, _ := LoadKnownHosts(filepath.Join(f.TempDir(), "known_hosts"), true)
+	c := &Client{OnMessage: func(byte, []byte) {}}
+	if err := c.InitPacketConn("alice", conn, memnet.Addr("server"), hosts); err != nil {
+		f.Fatalf("failed to init client: %s", err)
+	}
+	f.Cleanup(func() { c.Close() })
+
+	// cleartext arrives while we wait for the handshake reply, and sealed
+	// frames under a session as the handshake would leave it, sealed to by
+	// the server ring, which is established again whenever an input ends
+	// it or rotates its keys
+	const id = 7
+	var key [chat.KeySize]byte
+	var server *chat.KeyRing
+	establish := func() {
+		c.mu.Lock()
+		c.session, c.id, c.agreed = true, id, chat.Capabilities
+		c.keys = chat.NewKeyRing(chat.SuiteChaCha20Poly1305, key, chat.DirectionToServer, chat.DirectionToClient)
+		c.reliable = chat.NewReliable(c.sendFrame)
+		c.window.Reset()
+		c.mu.Unlock()
+		server = chat.NewKeyRing(chat.SuiteChaCha20Poly1305, key, chat.DirectionToClient, chat.DirectionToServer)
+	}
+	f.Fuzz(func(t *testing.T, body []byte, kind byte, sealed bool) {
+		if !sealed {
+			c.mu.Lock()
+			c.session = false
+			c.mu.Unlock()
+			c.MessageProcess(body)
+		} else {
+			c.mu.Lock()
+			session := c.session && c.id == id && c.keys.Epoch() == server.Epoch()
+			c.mu.Unlock()
+			if !session {
+				establish()
+			}
+			if frames, err := server.SealMessage(id, kind, body); err == nil {
+				for _, frame := range frames {
+					c.MessageProcess(frame)
+				}
+			}
+		}
+	})
+}
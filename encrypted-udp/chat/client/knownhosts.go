@@ -0,0 +1,88 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+var errUnknownHost = errors.New("server identity is not in known hosts...")
+var errHostKeyMismatch = errors.New("server identity does not match known hosts, possible man in the middle...")
+
+// A known hosts file in the spirit of ssh, where each line holds the
+// server address and the base64 encoded ed25519 identity public key.
+//
+// When trust on first use is enabled, unknown servers are pinned by
+// appending them to the file, otherwise they are rejected.
+type KnownHosts struct {
+	path  string
+	tofu  bool
+	mu    sync.Mutex
+	hosts map[string]ed25519.PublicKey
+}
+
+// Loads the known hosts file, which may not exist yet.
+func LoadKnownHosts(path string, tofu bool) (*KnownHosts, error) {
+	k := &KnownHosts{path: path, tofu: tofu, hosts: make(map[string]ed25519.PublicKey)}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected address and key", path, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid key", path, n)
+		}
+		k.hosts[fields[0]] = ed25519.PublicKey(key)
+	}
+	return k, scanner.Err()
+}
+
+// Checks the identity presented by the server at address, pinning it
+// when it is unknown and trust on first use is enabled.
+func (k *KnownHosts) Verify(address string, key ed25519.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if known, ok := k.hosts[address]; ok {
+		if !bytes.Equal(known, key) {
+			return errHostKeyMismatch
+		}
+		return nil
+	} else if !k.tofu {
+		return errUnknownHost
+	}
+
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", address, base64.StdEncoding.EncodeToString(key)); err != nil {
+		return err
+	}
+	// the key may still belong to the buffer the reply was read into
+	k.hosts[address] = append(ed25519.PublicKey(nil), key...)
+	return nil
+}
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"golang.org/x/crypto/nacl/box"
+)
+
+var errNotPeered = fmt.Errorf("not talking to them directly, /peer them first...")
+
+// Another client the server introduced us to, which we talk to with the
+// same sealed frames as the server, under a connection id and key both
+// sides derive from the box keys exchanged through it.
+//
+// Frames go straight to the address of the peer once one of theirs has
+// reached us from the host the server introduced, which is also the
+// address we answer, since a NAT may have given them a different port
+// than the server saw.  Until then, or when punching through fails, they
+// are relayed by the server.
+//
+// @note: the box keys are exchanged through the server and not signed,
+// so while a relay cannot read the frames, a server that swaps the keys
+// could, much like our handshake without a Key.
+//
+// Peer keys are not rotated, and nothing is retransmitted.
+type peer struct {
+	identity   string
+	id         uint32
+	keys       *chat.KeyRing
+	window     chat.ReplayWindow
+	fragments  chat.Reassembler
+	introduced net.Addr
+
+	mu     sync.Mutex
+	addr   net.Addr
+	direct bool
+}
+
+// The box key we sent the server for an identity, waiting for theirs.
+type offer struct {
+	pub, priv *[chat.KeySize]byte
+}
+
+// Routes frames straight to the address a frame sealed by the peer came
+// from, reporting whether it is the first to reach us.
+//
+// Only the host the server introduced is trusted, since a NAT may change
+// the port but not the public address, and the route is kept once found,
+// so a frame captured and sent on from elsewhere cannot move it.
+func (p *peer) reach(addr net.Addr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.direct || host(addr) != host(p.introduced) {
+		return false
+	}
+	p.addr, p.direct = addr, true
+	return true
+}
+
+func host(addr net.Addr) string {
+	if h, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return h
+	}
+	return addr.String()
+}
+
+// Where frames for the peer go, and whether they can go there directly.
+func (p *peer) route() (net.Addr, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addr, p.direct
+}
+
+// Asks the server to introduce us to the identity, which it does once
+// they ask for us too, with a box key used only for them.
+func (c *Client) PeerRequest(identity string) error {
+	if len(identity) == 0 || len(identity) > chat.MaxIdentitySize {
+		return errRecipientTooBig
+	}
+	if _, agreed := c.Version(); !agreed.Has(chat.CapabilityPeers) {
+		return errNoPeers
+	}
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.offers[identity] = offer{pub: pub, priv: priv}
+	c.mu.Unlock()
+	return c.control(chat.MessagePeer, chat.PeerBody(pub, identity, ""), true)
+}
+
+// Completes an introduction we asked for and starts punching through to
+// the address the server sees the peer at.
+func (c *Client) PeerReceive(body []byte) {
+	pub, identity, address, err := chat.PeerSplit(body)
+	if err != nil {
+		log.Printf("invalid peer introduction: %s\n", err)
+		return
+	}
+	c.mu.Lock()
+	ours, ok := c.offers[identity]
+	delete(c.offers, identity)
+	c.mu.Unlock()
+	if !ok {
+		log.Printf("ignoring introduction to %s we did not ask for...\n", identity)
+		return
+	}
+	addr, err := c.resolve(address)
+	if err != nil {
+		log.Printf("failed to resolve %s at %s: %s\n", identity, address, err)
+		return
+	}
+
+	var shared [chat.KeySize]byte
+	box.Precompute(&shared, pub, ours.priv)
+	id, key := chat.PeerKeys(shared)
+	seal, open := chat.PeerDirections(ours.pub, pub)
+	p := &peer{identity: identity, id: id, keys: chat.NewKeyRing(chat.PeerSuite, key, seal, open), introduced: addr, addr: addr}
+	c.mu.Lock()
+	c.peers[identity] = p
+	c.mu.Unlock()
+
+	log.Printf("introduced to %s at %s, punching through...\n", identity, address)
+	go c.punch(p)
+}
+
+// Sends punches to the peer until one of theirs reaches us, which opens
+// our NAT to them while theirs opens to us, falling back to the relay if
+// none has after a few seconds.
+func (c *Client) punch(p *peer) {
+	t := time.NewTicker(chat.PunchInterval)
+	defer t.Stop()
+	for i := 0; i < chat.PunchAttempts; i++ {
+		if _, direct := p.route(); direct || c.peer(p.identity) != p {
+			return
+		} else if err := c.peerSend(p, chat.MessagePunch, nil); err != nil {
+			log.Printf("failed to punch through to %s: %s\n", p.identity, err)
+		}
+		select {
+		case <-c.quit:
+			return
+		case <-t.C:
+		}
+	}
+	if _, direct := p.route(); !direct {
+		c.display(chat.MessageNotice, []byte(fmt.Sprintf("relaying to %s through the server, could not reach them directly...", p.identity)))
+	}
+}
+
+// Reports whether we have been introduced to the identity.
+func (c *Client) Peered(identity string) bool {
+	return c.peer(identity) != nil
+}
+
+func (c *Client) peer(identity string) *peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peers[identity]
+}
+
+// Sends a message to a peer, directly if we can reach them, and through
+// the server otherwise.
+func (c *Client) PeerSend(identity, message string) error {
+	if len(message) > chat.MaxMessageSize {
+		return errMessageTooBig
+	}
+	p := c.peer(identity)
+	if p == nil {
+		return errNotPeered
+	}
+	return c.peerSend(p, chat.MessageChat, []byte(message))
+}
+
+// Seals the message for the peer, fragmenting it if needed, and sends
+// each frame on its way, where punches always go directly.
+func (c *Client) peerSend(p *peer, kind byte, message []byte) error {
+	frames, err := p.keys.SealMessage(p.id, kind, message)
+	if err != nil {
+		return err
+	}
+	addr, direct := p.route()
+	for _, frame := range frames {
+		if direct || kind == chat.MessagePunch {
+			_, err = c.c.WriteTo(frame, addr)
+		} else {
+			err = c.control(chat.MessageRelay, chat.DirectBody(p.identity, frame), false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handles a datagram from somewhere other than the server, which is only
+// accepted when it opens under the keys of a peer and was sealed by them
+// rather than us.
+//
+// The first to arrive from where they were introduced means we can reach
+// each other directly, so the peer is answered with a punch in case none
+// of ours got through yet.
+func (c *Client) PeerProcess(addr net.Addr, frame []byte) {
+	var p *peer
+	id, ok := chat.ConnectionID(frame)
+	c.mu.Lock()
+	for _, candidate := range c.peers {
+		if ok && candidate.id == id {
+			p = candidate
+		}
+	}
+	c.mu.Unlock()
+	if p == nil {
+		log.Printf("ignoring datagram from %s...\n", addr.String())
+		return
+	}
+
+	kind, body, ok := c.peerOpen(p, frame)
+	if !ok {
+		return
+	}
+	if p.reach(addr) {
+		c.display(chat.MessageNotice, []byte(fmt.Sprintf("talking to %s directly", p.identity)))
+		c.peerSend(p, chat.MessagePunch, nil)
+	}
+	c.peerHandle(p, kind, body)
+}
+
+// Handles a frame from a peer that the server relayed.
+func (c *Client) RelayReceive(body []byte) {
+	from, frame, err := chat.DirectSplit(body)
+	if err != nil {
+		log.Printf("invalid relay: %s\n", err)
+		return
+	}
+	p := c.peer(from)
+	if id, ok := chat.ConnectionID(frame); p == nil || !ok || id != p.id {
+		log.Printf("ignoring relay from %s...\n", from)
+		return
+	}
+	if kind, body, ok := c.peerOpen(p, frame); ok {
+		c.peerHandle(p, kind, body)
+	}
+}
+
+// Opens a frame from the peer, dropping replays and holding fragments
+// until the rest arrive, whichever way they came.
+func (c *Client) peerOpen(p *peer, frame []byte) (byte, []byte, bool) {
+	seq, kind, body, err := p.keys.Open(frame)
+	if err != nil {
+		log.Printf("failed to open frame from %s: %s\n", p.identity, err)
+		return 0, nil, false
+	} else if !p.window.Check(seq) {
+		return 0, nil, false
+	} else if err := chat.CheckToClient(kind, body, true); err != nil {
+		log.Printf("malformed %s message from %s: %s\n", chat.MessageName(kind), p.identity, err)
+		return 0, nil, false
+	}
+	if kind == chat.MessageFragment {
+		var ok bool
+		if kind, body, ok, err = p.fragments.Add(body); err != nil {
+			log.Printf("invalid fragment from %s: %s\n", p.identity, err)
+			return 0, nil, false
+		} else if !ok {
+			return 0, nil, false
+		} else if err := chat.CheckToClient(kind, body, true); err != nil {
+			log.Printf("malformed %s message from %s: %s\n", chat.MessageName(kind), p.identity, err)
+			return 0, nil, false
+		}
+	}
+	return kind, body, true
+}
+
+func (c *Client) peerHandle(p *peer, kind byte, body []byte) {
+	switch kind {
+	case chat.MessageChat:
+		c.display(chat.MessagePeer, append([]byte(p.identity+": "), body...))
+	case chat.MessagePunch, chat.MessagePing:
+	case chat.MessageDisconnected:
+		c.mu.Lock()
+		if c.peers[p.identity] == p {
+			delete(c.peers, p.identity)
+		}
+		c.mu.Unlock()
+		c.display(chat.MessageNotice, []byte(fmt.Sprintf("%s stopped talking directly", p.identity)))
+	default:
+		log.Printf("unexpected %s message from %s\n", chat.MessageName(kind), p.identity)
+	}
+}
+
+// A snapshot of our peers.
+func (c *Client) peerList() []*peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	peers := make([]*peer, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Peers are on the same kind of network as the server, so their
+// addresses are resolved as UDP when the server address is one.
+func (c *Client) resolve(address string) (net.Addr, error) {
+	if _, ok := c.server.(*net.UDPAddr); ok {
+		return net.ResolveUDPAddr("udp", address)
+	}
+	return peerAddr{network: c.server.Network(), address: address}, nil
+}
+
+type peerAddr struct {
+	network string
+	address string
+}
+
+func (a peerAddr) Network() string { return a.network }
+func (a peerAddr) String() string  { return a.address }
@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+)
+
+// How each message type travels and what its body holds, which both the
+// server and the client check every message against before acting on it,
+// so a malformed body is refused in one place rather than by whichever
+// handler happens to read it.
+//
+// Clear messages travel in cleartext frames, which start with the
+// Signature and the type, while Sealed ones only travel inside frames
+// sealed under a session.  ToServer checks the body of one a client sent
+// the server, and ToClient the body of one the server or a peer sent a
+// client, either of which is nil when the message is never sent that way.
+//
+// Message types are never reused, so a type a side does not know is
+// refused rather than mistaken for another, and the layout of each body
+// is described where it is prepared:
+//
+//	MessageHandshake     clear   the HandshakeReply to a MessageHello, or the
+//	                             unversioned hello of the first protocol
+//	MessageDisconnected  both    the reason, cleartext only without a session
+//	MessageChat          sealed  the message, prefixed with the sender for clients
+//	MessageReset         clear   the connection id and ResetToken
+//	MessagePing          sealed  nothing, or a timestamp (PingBody)
+//	MessageRekey         sealed  the next epoch
+//	MessageReliable      sealed  the message id, type and body (Reliable)
+//	MessageAck           sealed  the message id
+//	MessageFragment      sealed  a piece of a larger message (Split)
+//	MessageJoin          sealed  the room
+//	MessageLeave         sealed  nothing
+//	MessageDirect        sealed  the recipient and message (DirectBody), or the
+//	                             message prefixed with the sender for clients
+//	MessageNotice        sealed  the notice
+//	MessageRetry         clear   the cookie
+//	MessageWhois         sealed  the identity
+//	MessageProbe         clear   a nonce padded to ProbeSize (package discovery)
+//	MessageAnnounce      clear   a signed announcement (package discovery)
+//	MessagePeer          sealed  a box key, identity and address (PeerBody)
+//	MessagePunch         sealed  nothing
+//	MessageRelay         sealed  the peer and its sealed frame (DirectBody)
+//	MessagePong          sealed  the timestamp pinged, and the server's for clients
+//	MessageWho           sealed  nothing
+//	MessageHistory       sealed  the time, sender and message (HistoryBody)
+//	MessageHello         clear   the versioned Handshake
+type Spec struct {
+	Name     string
+	Clear    bool
+	Sealed   bool
+	ToServer func(body []byte) error
+	ToClient func(body []byte) error
+}
+
+var errUnknownMessage = errors.New("unknown message type...")
+var errUnexpectedMessage = errors.New("message type is not expected here...")
+var errInvalidBody = errors.New("message body is malformed...")
+
+var Specs = [...]Spec{
+	MessageHandshake:    {Name: "handshake", Clear: true, ToServer: anything, ToClient: func(b []byte) error { _, err := ReplySplit(b); return err }},
+	MessageDisconnected: {Name: "disconnected", Clear: true, Sealed: true, ToServer: upTo(MaxPayloadSize), ToClient: upTo(MaxPayloadSize)},
+	MessageChat:         {Name: "chat", Sealed: true, ToServer: upTo(MaxMessageSize), ToClient: upTo(MaxPayloadSize)},
+	MessageReset:        {Name: "reset", Clear: true, ToClient: exactly(ConnectionIDSize + ResetTokenSize)},
+	MessagePing:         {Name: "ping", Sealed: true, ToServer: either(0, TimestampSize), ToClient: exactly(0)},
+	MessageRekey:        {Name: "rekey", Sealed: true, ToServer: exactly(EpochSize), ToClient: exactly(EpochSize)},
+	MessageReliable:     {Name: "reliable", Sealed: true, ToServer: reliable, ToClient: reliable},
+	MessageAck:          {Name: "ack", Sealed: true, ToServer: exactly(MessageIDSize), ToClient: exactly(MessageIDSize)},
+	MessageFragment:     {Name: "fragment", Sealed: true, ToServer: fragment, ToClient: fragment},
+	MessageJoin:         {Name: "join", Sealed: true, ToServer: func(b []byte) error { return ValidRoom(string(b)) }},
+	MessageLeave:        {Name: "leave", Sealed: true, ToServer: exactly(0)},
+	MessageDirect:       {Name: "direct", Sealed: true, ToServer: direct(MaxMessageSize), ToClient: upTo(MaxPayloadSize)},
+	MessageNotice:       {Name: "notice", Sealed: true, ToClient: upTo(MaxPayloadSize)},
+	MessageRetry:        {Name: "retry", Clear: true, ToClient: exactly(CookieSize)},
+	MessageWhois:        {Name: "whois", Sealed: true, ToServer: identity},
+	MessageProbe:        {Name: "probe", Clear: true},
+	MessageAnnounce:     {Name: "announce", Clear: true},
+	MessagePeer:         {Name: "peer", Sealed: true, ToServer: peer(false), ToClient: peer(true)},
+	MessagePunch:        {Name: "punch", Sealed: true, ToClient: exactly(0)},
+	MessageRelay:        {Name: "relay", Sealed: true, ToServer: direct(MaxPayloadSize), ToClient: direct(MaxPayloadSize)},
+	MessagePong:         {Name: "pong", Sealed: true, ToServer: exactly(TimestampSize), ToClient: exactly(2 * TimestampSize)},
+	MessageWho:          {Name: "who", Sealed: true, ToServer: exactly(0)},
+	MessageHistory:      {Name: "history", Sealed: true, ToClient: func(b []byte) error { _, _, _, err := HistorySplit(b); return err }},
+	MessageHello:        {Name: "hello", Clear: true, ToServer: hello},
+}
+
+// The name of the message type, for logging.
+func MessageName(kind byte) string {
+	if int(kind) < len(Specs) && Specs[kind].Name != "" {
+		return Specs[kind].Name
+	}
+	return fmt.Sprintf("unknown (%d)", kind)
+}
+
+// Checks a message a client sent the server, in a cleartext frame or a
+// sealed one, including the message a MessageReliable carries.
+func CheckToServer(kind byte, body []byte, sealed bool) error {
+	return check(kind, body, sealed, func(s Spec) func([]byte) error { return s.ToServer })
+}
+
+// Checks a message the server or a peer sent a client, in a cleartext
+// frame or a sealed one, including the message a MessageReliable carries.
+func CheckToClient(kind byte, body []byte, sealed bool) error {
+	return check(kind, body, sealed, func(s Spec) func([]byte) error { return s.ToClient })
+}
+
+func check(kind byte, body []byte, sealed bool, direction func(Spec) func([]byte) error) error {
+	if int(kind) >= len(Specs) || Specs[kind].Name == "" {
+		return errUnknownMessage
+	}
+	spec := Specs[kind]
+	validate := direction(spec)
+	if validate == nil || (sealed && !spec.Sealed) || (!sealed && !spec.Clear) {
+		return errUnexpectedMessage
+	} else if err := validate(body); err != nil {
+		return err
+	}
+	// @note: a reliable message is checked as the message it carries, which
+	// is fragmented after it is wrapped, and may never be another reliable
+	// message or an acknowledgement
+	if kind != MessageReliable {
+		return nil
+	} else if inner := body[MessageIDSize]; inner == MessageReliable || inner == MessageAck || inner == MessageFragment {
+		return errUnexpectedMessage
+	}
+	return check(body[MessageIDSize], body[ReliableOverhead:], true, direction)
+}
+
+func anything([]byte) error { return nil }
+
+func exactly(n int) func([]byte) error {
+	return func(b []byte) error {
+		if len(b) != n {
+			return errInvalidBody
+		}
+		return nil
+	}
+}
+
+func either(a, b int) func([]byte) error {
+	return func(body []byte) error {
+		if len(body) != a && len(body) != b {
+			return errInvalidBody
+		}
+		return nil
+	}
+}
+
+func upTo(n int) func([]byte) error {
+	return func(b []byte) error {
+		if len(b) > n {
+			return errInvalidBody
+		}
+		return nil
+	}
+}
+
+func identity(b []byte) error {
+	if len(b) == 0 || len(b) > MaxIdentitySize {
+		return errInvalidBody
+	}
+	return nil
+}
+
+func direct(n int) func([]byte) error {
+	return func(b []byte) error {
+		if _, message, err := DirectSplit(b); err != nil {
+			return err
+		} else if len(message) > n {
+			return errInvalidBody
+		}
+		return nil
+	}
+}
+
+// Peer requests sent to the server carry no address, while introductions
+// sent to clients always do.
+func peer(introduction bool) func([]byte) error {
+	return func(b []byte) error {
+		if _, _, address, err := PeerSplit(b); err != nil {
+			return err
+		} else if (address != "") != introduction {
+			return errInvalidBody
+		}
+		return nil
+	}
+}
+
+func reliable(b []byte) error {
+	if len(b) < ReliableOverhead {
+		return errInvalidReliable
+	}
+	return nil
+}
+
+func fragment(b []byte) error {
+	if len(b) < FragmentOverhead {
+		return errInvalidFragment
+	}
+	index, count, kind := b[SequenceSize], b[SequenceSize+1], b[SequenceSize+2]
+	if count == 0 || count > MaxFragments || index >= count || kind == MessageFragment {
+		return errInvalidFragment
+	}
+	return nil
+}
+
+// Only the version is checked for one we do not speak, so the server can
+// refuse it with a reason.
+func hello(b []byte) error {
+	if version, ok := HelloVersion(b); !ok {
+		return errInvalidHandshake
+	} else if _, err := ChooseVersion(version); err != nil {
+		return nil
+	}
+	_, err := HandshakeSplit(b)
+	return err
+}
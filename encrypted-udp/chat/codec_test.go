@@ -0,0 +1,205 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func reliableBody(kind byte, body []byte) []byte {
+	return append(append(make([]byte, MessageIDSize), kind), body...)
+}
+
+// Every message type has a spec, and bodies are checked for the
+// direction and framing they arrive in.
+func TestSpecs(t *testing.T) {
+	for kind := MessageHandshake; kind <= MessageHello; kind++ {
+		if Specs[kind].Name == "" || (!Specs[kind].Clear && !Specs[kind].Sealed) {
+			t.Errorf("message type %d has no spec", kind)
+		}
+	}
+	if MessageName(MessageChat) != "chat" || MessageName(200) != "unknown (200)" {
+		t.Fatal("unexpected message names...")
+	}
+
+	pub := new([KeySize]byte)
+	ping := PingBody()
+	for _, c := range []struct {
+		toServer bool
+		kind     byte
+		body     []byte
+		sealed   bool
+		valid    bool
+	}{
+		{true, MessageHello, HandshakeBody(pub, Suites, nil, "bob"), false, true},
+		{true, MessageHello, HandshakeBody(pub, Suites, nil, "bob"), true, false},
+		{true, MessageHello, []byte{1, 0, 0, 0, 0}, false, true},
+		{true, MessageHello, []byte{ProtocolVersion}, false, false},
+		{true, MessageHandshake, []byte("anything"), false, true},
+		{false, MessageHandshake, make([]byte, HandshakeReplySize), false, true},
+		{false, MessageHandshake, make([]byte, HandshakeReplySize-1), false, false},
+		{true, MessageChat, []byte("hi"), true, true},
+		{true, MessageChat, []byte("hi"), false, false},
+		{true, MessageChat, make([]byte, MaxMessageSize+1), true, false},
+		{true, MessageNotice, []byte("hi"), true, false},
+		{false, MessageNotice, []byte("hi"), true, true},
+		{true, MessagePing, nil, true, true},
+		{true, MessagePing, ping, true, true},
+		{true, MessagePing, ping[:3], true, false},
+		{true, MessageJoin, []byte("dev"), true, true},
+		{true, MessageJoin, nil, true, false},
+		{true, MessageDirect, DirectBody("bob", []byte("hi")), true, true},
+		{true, MessageDirect, []byte{9, 'b'}, true, false},
+		{true, MessageWhois, nil, true, false},
+		{true, MessagePeer, PeerBody(pub, "bob", ""), true, true},
+		{true, MessagePeer, PeerBody(pub, "bob", "10.0.0.1:1"), true, false},
+		{false, MessagePeer, PeerBody(pub, "bob", "10.0.0.1:1"), true, true},
+		{false, MessageReset, make([]byte, ConnectionIDSize+ResetTokenSize), false, true},
+		{false, MessageReset, make([]byte, ConnectionIDSize+ResetTokenSize), true, false},
+		{false, MessageDisconnected, []byte("bye"), false, true},
+		{false, MessageDisconnected, []byte("bye"), true, true},
+		{false, MessageHistory, HistoryBody(time.Now(), "bob", []byte("hi")), true, true},
+		{false, MessageHistory, []byte("short"), true, false},
+		{true, MessageReliable, reliableBody(MessageChat, []byte("hi")), true, true},
+		{true, MessageReliable, reliableBody(MessageJoin, nil), true, false},
+		{true, MessageReliable, reliableBody(MessageAck, make([]byte, MessageIDSize)), true, false},
+		{true, MessageReliable, reliableBody(MessageReliable, reliableBody(MessageChat, nil)), true, false},
+		{true, MessageReliable, reliableBody(MessageNotice, nil), true, false},
+		{true, MessageReliable, make([]byte, MessageIDSize), true, false},
+		{true, MessageFragment, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 2, MessageChat, 'x'}, true, true},
+		{true, MessageFragment, []byte{0, 0, 0, 0, 0, 0, 0, 1, 2, 2, MessageChat, 'x'}, true, false},
+		{true, MessageFragment, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 2, MessageFragment}, true, false},
+		{true, MessageProbe, make([]byte, 256), false, false},
+		{true, 200, nil, true, false},
+	} {
+		check := CheckToClient
+		if c.toServer {
+			check = CheckToServer
+		}
+		if err := check(c.kind, c.body, c.sealed); (err == nil) != c.valid {
+			t.Errorf("%s of %d bytes to server %t sealed %t: expected valid %t, got %v", MessageName(c.kind), len(c.body), c.toServer, c.sealed, c.valid, err)
+		}
+	}
+}
+
+func TestHandshakeReply(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	r := &HandshakeReply{Identity: pub, Version: ProtocolVersion, Capabilities: CapabilityPong, Suite: SuiteAES256GCM, Signature: make([]byte, ed25519.SignatureSize), Sealed: make([]byte, HandshakeReplySize-KeySize-ed25519.PublicKeySize-HelloHeaderSize-1-ed25519.SignatureSize)}
+	rand.Read(r.Key[:])
+	rand.Read(r.Signature)
+	body := r.Body()
+	parsed, err := ReplySplit(body)
+	if err != nil {
+		t.Fatalf("failed to split reply: %s", err)
+	} else if parsed.Key != r.Key || !parsed.Identity.Equal(pub) || parsed.Version != r.Version || parsed.Capabilities != r.Capabilities || parsed.Suite != r.Suite || !bytes.Equal(parsed.Signature, r.Signature) || len(parsed.Sealed) != len(r.Sealed) {
+		t.Fatalf("unexpected reply: %+v", parsed)
+	}
+
+	// the transcript changes with anything offered or chosen
+	h := &Handshake{Version: ProtocolVersion, Capabilities: Capabilities, Key: r.Key, Suites: Suites}
+	transcript := HandshakeTranscript(&r.Key, h, ProtocolVersion, Capabilities, SuiteAES256GCM)
+	downgraded := *h
+	downgraded.Capabilities = CapabilityPong
+	for _, other := range [][]byte{
+		HandshakeTranscript(&r.Key, h, ProtocolVersion, CapabilityPong, SuiteAES256GCM),
+		HandshakeTranscript(&r.Key, h, ProtocolVersion+1, Capabilities, SuiteAES256GCM),
+		HandshakeTranscript(&r.Key, &downgraded, ProtocolVersion, Capabilities, SuiteAES256GCM),
+	} {
+		if bytes.Equal(transcript, other) {
+			t.Fatal("expected the transcript to change...")
+		}
+	}
+}
+
+// No body, whatever its type, direction or framing, makes the checks
+// panic, and every body they accept can be read by the functions that
+// handle it.
+func FuzzCheck(f *testing.F) {
+	pub := new([KeySize]byte)
+	f.Add(MessageHello, HandshakeBody(pub, Suites, nil, "bob"), false)
+	f.Add(MessageReliable, reliableBody(MessageChat, []byte("hi")), true)
+	f.Add(MessageFragment, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 2, MessageChat, 'x'}, true)
+	f.Add(MessagePeer, PeerBody(pub, "bob", "10.0.0.1:1"), true)
+	f.Add(MessageHistory, HistoryBody(time.Now(), "bob", []byte("hi")), true)
+	f.Add(MessageHandshake, make([]byte, HandshakeReplySize), false)
+	f.Fuzz(func(t *testing.T, kind byte, body []byte, sealed bool) {
+		if CheckToServer(kind, body, sealed) == nil {
+			switch kind {
+			case MessageHello:
+				if v, _ := HelloVersion(body); v >= MinProtocolVersion {
+					if _, err := HandshakeSplit(body); err != nil {
+						t.Fatalf("accepted a hello that does not split: %s", err)
+					}
+				}
+			case MessageDirect, MessageRelay:
+				if _, _, err := DirectSplit(body); err != nil {
+					t.Fatalf("accepted a direct message that does not split: %s", err)
+				}
+			case MessagePeer:
+				if _, _, _, err := PeerSplit(body); err != nil {
+					t.Fatalf("accepted a peer request that does not split: %s", err)
+				}
+			}
+		}
+		if CheckToClient(kind, body, sealed) == nil && kind == MessageHandshake {
+			if _, err := ReplySplit(body); err != nil {
+				t.Fatalf("accepted a reply that does not split: %s", err)
+			}
+		}
+	})
+}
+
+// A hello that splits is written back the same way.
+func FuzzHandshakeSplit(f *testing.F) {
+	pub := new([KeySize]byte)
+	f.Add(HandshakeBody(pub, Suites, []byte("cookie"), "bob"))
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signed := &Handshake{Version: ProtocolVersion, Key: *pub, Suites: Suites, Identity: "bob"}
+	signed.Sign(key)
+	f.Add(signed.Body())
+	f.Fuzz(func(t *testing.T, body []byte) {
+		h, err := HandshakeSplit(body)
+		if err != nil {
+			return
+		} else if !bytes.Equal(h.Body(), body) {
+			t.Fatalf("expected %x, got %x", body, h.Body())
+		}
+		h.Verify()
+	})
+}
+
+// Frames of any content, sealed or not, never make opening, reassembling
+// or receiving them reliably panic.
+func FuzzOpen(f *testing.F) {
+	var key [KeySize]byte
+	client := NewKeyRing(SuiteChaCha20Poly1305, key, DirectionToServer, DirectionToClient)
+	ring := NewKeyRing(SuiteChaCha20Poly1305, key, DirectionToClient, DirectionToServer)
+	f.Add(MessageChat, []byte("hello"), false)
+	f.Add(MessageFragment, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 2, MessageChat, 'x'}, true)
+	f.Add(MessageReliable, reliableBody(MessageChat, []byte("hi")), true)
+	f.Fuzz(func(t *testing.T, kind byte, body []byte, seal bool) {
+		frame := body
+		if seal {
+			var err error
+			if frame, err = client.Seal(1, kind, body); err != nil {
+				return
+			}
+		}
+		ConnectionID(frame)
+		_, kind, body, err := ring.Open(frame)
+		if err != nil {
+			return
+		}
+		var fragments Reassembler
+		fragments.Add(body)
+		r := NewReliable(func(byte, []byte) error { return nil })
+		defer r.Close()
+		r.Receive(body)
+		r.Ack(body)
+		RoundTrip(body)
+		HistorySplit(body)
+		ring.Follow(body)
+	})
+}
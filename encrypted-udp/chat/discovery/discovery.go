@@ -0,0 +1,204 @@
+// Finding chat servers on the local network.
+//
+// Clients send a MessageProbe to a well-known multicast group, and every
+// server listening on it answers the client directly with a
+// MessageAnnounce holding its name, the address it chats on and its
+// identity key, signed over the nonce from the probe so a recorded
+// announcement cannot be replayed to later probes.
+//
+// Probes are padded to ProbeSize, which is larger than any announcement,
+// so a spoofed probe cannot be used to amplify traffic.
+package discovery
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+// The multicast group and port servers listen for probes on unless told
+// otherwise, from the organization-local scope.
+const Group = "239.255.42.99:10002"
+
+const (
+	NonceSize   = 8
+	ProbeSize   = 256
+	MaxNameSize = 32
+	MaxAddrSize = 64
+	DefaultWait = time.Second
+)
+
+var errNameTooBig = errors.New("name or address is too large to announce...")
+var errInvalidAnnouncement = errors.New("announcement is malformed or not signed for our probe...")
+
+// A server that answered a probe.
+type Announcement struct {
+	Name    string
+	Address string
+	Key     ed25519.PublicKey
+}
+
+// The fingerprint of the server identity, as it logs it at startup.
+func (a Announcement) Fingerprint() string {
+	return chat.Fingerprint(a.Key)
+}
+
+// Answers probes with the server name, the address it chats on and its
+// identity key.
+type Responder struct {
+	Name    string
+	Address string
+
+	identity ed25519.PrivateKey
+	c        net.PacketConn
+}
+
+// Joins the multicast group on every interface that supports it.
+func (r *Responder) Init(group string, identity ed25519.PrivateKey) error {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return err
+	}
+	c, err := net.ListenMulticastUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	return r.InitPacketConn(c, identity)
+}
+
+// Answers probes arriving on an existing connection, which the responder
+// takes ownership of.
+func (r *Responder) InitPacketConn(c net.PacketConn, identity ed25519.PrivateKey) error {
+	r.c, r.identity = c, identity
+	if len(r.Name) > MaxNameSize || len(r.Address) > MaxAddrSize {
+		c.Close()
+		return errNameTooBig
+	}
+	return nil
+}
+
+// Answers probes until the context is cancelled or the responder is
+// closed.
+func (r *Responder) Run(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { r.Close() })
+	defer stop()
+
+	b := make([]byte, chat.BufferSize)
+	for {
+		n, addr, err := r.c.ReadFrom(b)
+		if errors.Is(err, net.ErrClosed) {
+			return ctx.Err()
+		} else if err != nil {
+			log.Printf("failed to read probe: %s\n", err)
+			continue
+		} else if n != len(chat.Signature)+1+ProbeSize || !chat.Clear(b[:n]) || b[len(chat.Signature)] != chat.MessageProbe {
+			continue
+		}
+		nonce := b[len(chat.Signature)+1 : len(chat.Signature)+1+NonceSize]
+		if _, err := r.c.WriteTo(r.announce(nonce), addr); err != nil {
+			log.Printf("failed to answer probe from %s: %s\n", addr.String(), err)
+		}
+	}
+}
+
+func (r *Responder) Close() error {
+	return r.c.Close()
+}
+
+// The announcement is the nonce, identity key and signature, followed by
+// the length of the name, the name and finally the address.
+func (r *Responder) announce(nonce []byte) []byte {
+	body := append(append([]byte(nil), nonce...), r.identity.Public().(ed25519.PublicKey)...)
+	body = append(body, ed25519.Sign(r.identity, signed(nonce, r.Name, r.Address))...)
+	body = append(append(append(body, byte(len(r.Name))), r.Name...), r.Address...)
+	return chat.ClearFrame(chat.MessageAnnounce, body)
+}
+
+func signed(nonce []byte, name, address string) []byte {
+	data := append([]byte("encrypted-udp announce "), nonce...)
+	return append(append(append(data, byte(len(name))), name...), address...)
+}
+
+// Reads an announcement answering the probe with the nonce, checking its
+// signature.
+func parse(nonce []byte, data []byte) (Announcement, error) {
+	const fixed = NonceSize + ed25519.PublicKeySize + ed25519.SignatureSize
+	if !chat.Clear(data) || data[len(chat.Signature)] != chat.MessageAnnounce {
+		return Announcement{}, errInvalidAnnouncement
+	}
+	body := data[len(chat.Signature)+1:]
+	if len(body) < fixed+1 || len(body) < fixed+1+int(body[fixed]) || string(body[:NonceSize]) != string(nonce) {
+		return Announcement{}, errInvalidAnnouncement
+	}
+	key := ed25519.PublicKey(append([]byte(nil), body[NonceSize:NonceSize+ed25519.PublicKeySize]...))
+	signature := body[NonceSize+ed25519.PublicKeySize : fixed]
+	rest := body[fixed+1:]
+	a := Announcement{Name: string(rest[:body[fixed]]), Address: string(rest[body[fixed]:]), Key: key}
+	if !ed25519.Verify(key, signed(nonce, a.Name, a.Address), signature) {
+		return Announcement{}, errInvalidAnnouncement
+	}
+	return a, nil
+}
+
+// Probes the group from the connection, collecting the servers that
+// answer within the wait, once each.
+//
+// A server announcing an address without a host, such as ":10001", is
+// given the host its announcement came from.
+func Discover(c net.PacketConn, group net.Addr, wait time.Duration) ([]Announcement, error) {
+	probe := make([]byte, ProbeSize)
+	if _, err := rand.Read(probe[:NonceSize]); err != nil {
+		return nil, err
+	}
+	nonce := probe[:NonceSize]
+	if _, err := c.WriteTo(chat.ClearFrame(chat.MessageProbe, probe), group); err != nil {
+		return nil, err
+	}
+
+	c.SetReadDeadline(time.Now().Add(wait))
+	defer c.SetReadDeadline(time.Time{})
+
+	var found []Announcement
+	seen := make(map[string]bool)
+	b := make([]byte, chat.BufferSize)
+	for {
+		n, addr, err := c.ReadFrom(b)
+		var timeout net.Error
+		if errors.As(err, &timeout) && timeout.Timeout() {
+			return found, nil
+		} else if err != nil {
+			return found, err
+		}
+		a, err := parse(nonce, b[:n])
+		if err != nil {
+			log.Printf("ignoring announcement from %s: %s\n", addr.String(), err)
+			continue
+		}
+		a.Address = resolve(a.Address, addr)
+		if key := a.Address + " " + a.Fingerprint(); !seen[key] {
+			seen[key] = true
+			found = append(found, a)
+		}
+	}
+}
+
+// Fills in the host of the announced address from where it came from
+// when it was left unspecified.
+func resolve(address string, from net.Addr) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	} else if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return address
+	}
+	if udp, ok := from.(*net.UDPAddr); ok {
+		return net.JoinHostPort(udp.IP.String(), port)
+	}
+	return address
+}
@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/memnet"
+)
+
+func respond(t *testing.T, r *Responder, c net.PacketConn) ed25519.PrivateKey {
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate identity: %s", err)
+	}
+	if err := r.InitPacketConn(c, identity); err != nil {
+		t.Fatalf("failed to init responder: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("expected Run to return the context error, got %v", err)
+		}
+	})
+	return identity
+}
+
+func TestDiscover(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	n := memnet.New(1)
+	group, _ := n.Listen("group")
+	r := &Responder{Name: "lobby", Address: "chat.example:10001"}
+	identity := respond(t, r, group)
+	prober, _ := n.Listen("")
+	defer prober.Close()
+
+	found, err := Discover(prober, memnet.Addr("group"), 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to discover: %s", err)
+	} else if len(found) != 1 || found[0].Name != "lobby" || found[0].Address != "chat.example:10001" {
+		t.Fatalf("unexpected servers: %+v", found)
+	} else if found[0].Fingerprint() != chat.Fingerprint(identity.Public().(ed25519.PublicKey)) {
+		t.Fatalf("unexpected fingerprint %s", found[0].Fingerprint())
+	}
+
+	// a probe too short to be worth answering gets nothing back
+	prober.WriteTo(chat.ClearFrame(chat.MessageProbe, make([]byte, NonceSize)), memnet.Addr("group"))
+	prober.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := prober.ReadFrom(make([]byte, chat.BufferSize)); err == nil {
+		t.Fatal("expected a short probe to be ignored...")
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	r := &Responder{Name: "lobby", Address: ":10001", identity: identity}
+	nonce := []byte("12345678")
+	announcement := r.announce(nonce)
+	if len(announcement) >= len(chat.Signature)+1+ProbeSize {
+		t.Fatalf("expected the announcement to be smaller than a probe, got %d bytes", len(announcement))
+	}
+
+	if _, err := parse(nonce, announcement); err != nil {
+		t.Fatalf("failed to parse announcement: %s", err)
+	} else if _, err := parse([]byte("87654321"), announcement); err == nil {
+		t.Fatal("expected an announcement for another probe to be refused...")
+	}
+	forged := append([]byte(nil), announcement...)
+	forged[len(forged)-1] = '2'
+	if _, err := parse(nonce, forged); err == nil {
+		t.Fatal("expected an altered announcement to be refused...")
+	} else if _, err := parse(nonce, announcement[:len(chat.Signature)+1+NonceSize]); err == nil {
+		t.Fatal("expected a truncated announcement to be refused...")
+	}
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 7), Port: 10002}
+	for address, expected := range map[string]string{
+		":10001":             "192.168.1.7:10001",
+		"0.0.0.0:10001":      "192.168.1.7:10001",
+		"10.0.0.1:10001":     "10.0.0.1:10001",
+		"chat.example:10001": "chat.example:10001",
+	} {
+		if resolved := resolve(address, from); resolved != expected {
+			t.Errorf("expected %s to resolve to %s, got %s", address, expected, resolved)
+		}
+	}
+}
+
+// Discovery over real multicast, which not every machine or sandbox
+// allows, so this skips rather than fails where it cannot join the group.
+func TestMulticast(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	const group = "239.255.42.99:10012"
+	addr, _ := net.ResolveUDPAddr("udp", group)
+	c, err := net.ListenMulticastUDP("udp", nil, addr)
+	if err != nil {
+		t.Skipf("multicast unavailable: %s", err)
+	}
+	respond(t, &Responder{Name: "lobby", Address: ":10001"}, c)
+
+	prober, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer prober.Close()
+	found, err := Discover(prober, addr, 200*time.Millisecond)
+	if err != nil {
+		t.Skipf("multicast unavailable: %s", err)
+	} else if len(found) == 0 {
+		t.Skip("no announcement, multicast may not loop back here...")
+	} else if found[0].Name != "lobby" {
+		t.Fatalf("unexpected servers: %+v", found)
+	}
+}
@@ -0,0 +1,420 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/client"
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/memnet"
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/server"
+)
+
+// Clients and servers talking over an in-memory network, with whatever
+// faults the network is configured with.
+type harness struct {
+	t        *testing.T
+	network  *memnet.Network
+	identity ed25519.PrivateKey
+	hosts    *client.KnownHosts
+}
+
+func newHarness(t *testing.T, network *memnet.Network) *harness {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate identity: %s", err)
+	}
+	hosts, err := client.LoadKnownHosts(filepath.Join(t.TempDir(), "known_hosts"), true)
+	if err != nil {
+		t.Fatalf("failed to load known hosts: %s", err)
+	}
+	return &harness{t: t, network: network, identity: identity, hosts: hosts}
+}
+
+// Starts a server at the "server" address, returning a function that
+// stops it and waits for Run to return.
+func (h *harness) server() (*server.Server, func()) {
+	conn, err := h.network.Listen("server")
+	if err != nil {
+		h.t.Fatalf("failed to listen: %s", err)
+	}
+	s := &server.Server{}
+	if err := s.InitPacketConn(conn, h.identity); err != nil {
+		h.t.Fatalf("failed to init server: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			if err := <-done; err != context.Canceled {
+				h.t.Errorf("expected Run to return the context error, got %v", err)
+			}
+		})
+	}
+	h.t.Cleanup(stop)
+	return s, stop
+}
+
+// Starts a client that pings often and passes every chat message, peer
+// message and notice it receives to the returned channel, signing its
+// handshakes if it is given a key.
+func (h *harness) client(name string, key ed25519.PrivateKey) (*client.Client, chan string) {
+	conn, err := h.network.Listen("")
+	if err != nil {
+		h.t.Fatalf("failed to listen: %s", err)
+	}
+	return h.start(name, key, conn)
+}
+
+// Starts a client behind the NAT.
+func (h *harness) clientNAT(name string, nat *memnet.NAT) (*client.Client, chan string) {
+	conn, err := h.network.ListenNAT("", nat)
+	if err != nil {
+		h.t.Fatalf("failed to listen: %s", err)
+	}
+	return h.start(name, nil, conn)
+}
+
+func (h *harness) start(name string, key ed25519.PrivateKey, conn *memnet.Conn) (*client.Client, chan string) {
+	messages := make(chan string, 64)
+	c := &client.Client{Keepalive: 20 * time.Millisecond, Key: key}
+	c.OnMessage = func(kind byte, message []byte) {
+		switch kind {
+		case chat.MessageChat:
+			messages <- string(message)
+		case chat.MessagePeer:
+			messages <- "(peer) " + string(message)
+		case chat.MessageHistory:
+			messages <- "(history) " + string(message)
+		case chat.MessageNotice:
+			messages <- "* " + string(message)
+		}
+	}
+	if err := c.InitPacketConn(name, conn, memnet.Addr("server"), h.hosts); err != nil {
+		h.t.Fatalf("failed to init client: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	h.t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return c, messages
+}
+
+// Waits until every client has a session the server has confirmed, and
+// it has stayed that way for a while, since a late duplicate handshake
+// can still replace one.  Handshakes are retried as a user would, since
+// the first may be lost.
+func (h *harness) settle(s *server.Server, clients ...*client.Client) {
+	deadline := time.Now().Add(10 * time.Second)
+	for stable := 0; stable < 5; {
+		if time.Now().After(deadline) {
+			h.t.Fatal("timed out waiting for every client to be established...")
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		stable++
+		for _, c := range clients {
+			if !c.Established() {
+				c.HandshakeSend()
+				stable = 0
+			}
+		}
+		confirmed := 0
+		for _, c := range s.Clients() {
+			if c.Confirmed() {
+				confirmed++
+			}
+		}
+		if confirmed != len(clients) || len(s.Clients()) != len(clients) {
+			stable = 0
+		}
+	}
+}
+
+func expect(t *testing.T, messages chan string, message string) {
+	select {
+	case m := <-messages:
+		if m != message {
+			t.Fatalf("expected %q, got %q", message, m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q...", message)
+	}
+}
+
+// Sessions are established and reliable messages arrive once and in order,
+// while the network loses, duplicates and reorders datagrams.
+func TestLossyChat(t *testing.T) {
+	network := memnet.New(11)
+	network.Loss, network.Duplicate, network.Reorder, network.Delay = 0.2, 0.1, 0.3, 20*time.Millisecond
+	h := newHarness(t, network)
+	s, _ := h.server()
+	alice, _ := h.client("alice", nil)
+	bob, messages := h.client("bob", nil)
+	h.settle(s, alice, bob)
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		if err := alice.MessageSendReliable(strconv.Itoa(i)); err != nil {
+			t.Fatalf("failed to send message %d: %s", i, err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		expect(t, messages, "alice: "+strconv.Itoa(i))
+	}
+	select {
+	case m := <-messages:
+		t.Fatalf("unexpected message: %q", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// A server restarted with the same identity resets the old sessions, and
+// the clients handshake again without tripping over their pinned key.
+func TestReconnect(t *testing.T) {
+	h := newHarness(t, memnet.New(5))
+	s, stop := h.server()
+	alice, _ := h.client("alice", nil)
+	bob, messages := h.client("bob", nil)
+	h.settle(s, alice, bob)
+
+	if err := alice.MessageSend("before"); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	expect(t, messages, "alice: before")
+
+	stop()
+	s, _ = h.server()
+	h.settle(s, alice, bob)
+
+	if err := alice.MessageSendReliable("after"); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	expect(t, messages, "alice: after")
+}
+
+// A server with a different identity at the same address cannot reset
+// the session, and its handshake reply is refused.
+func TestImpostor(t *testing.T) {
+	h := newHarness(t, memnet.New(3))
+	s, stop := h.server()
+	alice, _ := h.client("alice", nil)
+	h.settle(s, alice)
+	stop()
+
+	_, h.identity, _ = ed25519.GenerateKey(rand.Reader)
+	h.server()
+	alice.MessageSend("hello")
+	time.Sleep(100 * time.Millisecond)
+	if !alice.Established() {
+		t.Fatal("expected the reset from the impostor to be ignored...")
+	}
+	alice.HandshakeSend()
+	time.Sleep(100 * time.Millisecond)
+	if alice.Established() {
+		t.Fatal("expected the impostor to be refused...")
+	}
+}
+
+// A client with a key binds its identity on the server, which anyone can
+// then ask for the fingerprint of, while nobody else can claim it.
+func TestIdentityKey(t *testing.T) {
+	h := newHarness(t, memnet.New(9))
+	s, _ := h.server()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	alice, _ := h.client("alice", key)
+	bob, messages := h.client("bob", nil)
+	h.settle(s, alice, bob)
+
+	if err := bob.Whois("alice"); err != nil {
+		t.Fatalf("failed to ask: %s", err)
+	}
+	expect(t, messages, "* alice is "+alice.Fingerprint()+" (online)")
+
+	alice.Close()
+	mallory, _ := h.client("alice", nil)
+	time.Sleep(100 * time.Millisecond)
+	if mallory.Established() {
+		t.Fatal("expected the handshake without the key to be refused...")
+	}
+}
+
+// Introduces the clients to each other through the server, with the
+// second accepting the request of the first.
+func introduce(t *testing.T, a, b *client.Client, aMessages, bMessages chan string, aName, bName string) {
+	if err := a.PeerRequest(bName); err != nil {
+		t.Fatalf("failed to ask for %s: %s", bName, err)
+	}
+	expect(t, aMessages, "* waiting for "+bName+" to accept...")
+	expect(t, bMessages, "* "+aName+" wants to talk directly, /peer "+aName+" to accept")
+	if err := b.PeerRequest(aName); err != nil {
+		t.Fatalf("failed to ask for %s: %s", aName, err)
+	}
+}
+
+// Two clients behind NATs that let replies in punch through to each other
+// with the addresses the server saw, and talk without it.
+func TestPeerToPeer(t *testing.T) {
+	h := newHarness(t, memnet.New(13))
+	s, stop := h.server()
+	alice, aliceMessages := h.clientNAT("alice", &memnet.NAT{})
+	bob, bobMessages := h.clientNAT("bob", &memnet.NAT{})
+	h.settle(s, alice, bob)
+
+	introduce(t, alice, bob, aliceMessages, bobMessages, "alice", "bob")
+	expect(t, aliceMessages, "* talking to bob directly")
+	expect(t, bobMessages, "* talking to alice directly")
+
+	// the server is no longer needed once the peers reach each other
+	stop()
+	if err := alice.PeerSend("bob", "hello"); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	expect(t, bobMessages, "(peer) alice: hello")
+	if err := bob.PeerSend("alice", "hi"); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	expect(t, aliceMessages, "(peer) bob: hi")
+	if err := bob.PeerSend("carol", "hi"); err == nil {
+		t.Fatal("expected sending to someone we were not introduced to to fail...")
+	}
+}
+
+// Behind NATs that give every destination its own address punching
+// fails, so the peers fall back to relaying through the server.
+func TestPeerRelay(t *testing.T) {
+	h := newHarness(t, memnet.New(17))
+	s, _ := h.server()
+	alice, aliceMessages := h.clientNAT("alice", &memnet.NAT{Symmetric: true})
+	bob, bobMessages := h.clientNAT("bob", &memnet.NAT{Symmetric: true})
+	h.settle(s, alice, bob)
+
+	introduce(t, alice, bob, aliceMessages, bobMessages, "alice", "bob")
+	expect(t, aliceMessages, "* relaying to bob through the server, could not reach them directly...")
+	expect(t, bobMessages, "* relaying to alice through the server, could not reach them directly...")
+	if err := alice.PeerSend("bob", "hello"); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	expect(t, bobMessages, "(peer) alice: hello")
+}
+
+// Every keepalive measures the round trip on both sides, over a network
+// that delays some datagrams and loses others.
+func TestMetrics(t *testing.T) {
+	network := memnet.New(19)
+	network.Loss, network.Reorder, network.Delay = 0.1, 0.5, 20*time.Millisecond
+	h := newHarness(t, network)
+	s, _ := h.server()
+	alice, _ := h.client("alice", nil)
+	h.settle(s, alice)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		clients := s.Clients()
+		if len(clients) == 1 && alice.Metrics().Samples >= 5 && clients[0].Metrics().Samples >= 5 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for round trips: %s", alice.Metrics())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if m := alice.Metrics(); m.RTT <= 0 || m.RTT > time.Second || m.Received == 0 {
+		t.Fatalf("unexpected metrics: %s", m)
+	}
+}
+
+// Changing identity handshakes again, after which the server lists the
+// client under its new one.
+func TestNick(t *testing.T) {
+	h := newHarness(t, memnet.New(23))
+	s, _ := h.server()
+	alice, _ := h.client("alice", nil)
+	bob, messages := h.client("bob", nil)
+	h.settle(s, alice, bob)
+
+	if err := alice.Nick("alicia"); err != nil {
+		t.Fatalf("failed to change identity: %s", err)
+	}
+	h.settle(s, alice, bob)
+	if err := bob.Who(); err != nil {
+		t.Fatalf("failed to ask: %s", err)
+	}
+	expect(t, messages, "* 2 online: alicia (#lobby), bob (#lobby)")
+	if err := alice.Nick(""); err == nil {
+		t.Fatal("expected an empty identity to be refused...")
+	}
+}
+
+// A client arriving after a message was relayed is sent it with the time
+// the server received it, once it completes the handshake.
+func TestHistoryReplay(t *testing.T) {
+	h := newHarness(t, memnet.New(29))
+	s, _ := h.server()
+	alice, messages := h.client("alice", nil)
+	h.settle(s, alice)
+	if err := alice.MessageSendReliable("anyone here?"); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	expect(t, messages, "alice: anyone here?")
+
+	_, messages = h.client("bob", nil)
+	select {
+	case m := <-messages:
+		if !strings.HasPrefix(m, "(history) [") || !strings.HasSuffix(m, "] alice: anyone here?") {
+			t.Fatalf("unexpected history: %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for history...")
+	}
+}
+
+// A message too large for the reliable channel once the time and sender
+// are added is still replayed, as an ordinary frame.
+func TestHistoryReplayLarge(t *testing.T) {
+	h := newHarness(t, memnet.New(31))
+	s, _ := h.server()
+	alice, messages := h.client("alice", nil)
+	h.settle(s, alice)
+	large := strings.Repeat("x", chat.MaxMessageSize)
+	if err := alice.MessageSend(large); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	expect(t, messages, "alice: "+large)
+
+	_, messages = h.client("bob", nil)
+	select {
+	case m := <-messages:
+		if !strings.HasPrefix(m, "(history) [") || !strings.HasSuffix(m, "] alice: "+large) {
+			t.Fatalf("unexpected history: %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for history...")
+	}
+}
@@ -0,0 +1,243 @@
+package chat
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Bodies too large for a single frame are split into MessageFragment
+// frames, each carrying the id of the message, its index, the number of
+// fragments, and the type of the message they reassemble into.
+//
+// The receiving side holds partial messages only for a short time, and
+// caps how many and how many bytes it will hold per session.
+//
+// Fragments are as large as the suite of the session allows, but at least
+// FragmentSize, so MaxPayloadSize fits in MaxFragments under every suite.
+const (
+	MaxBodySize               = BufferSize - MinFrameOverhead
+	FragmentOverhead          = SequenceSize + 3
+	FragmentSize              = BufferSize - MaxFrameOverhead - FragmentOverhead
+	MaxFragments              = 32
+	MaxPayloadSize            = MaxFragments * FragmentSize
+	DefaultReassemblyTimeout  = 5 * time.Second
+	DefaultReassemblyMessages = 8
+	DefaultReassemblyBytes    = 4 * MaxPayloadSize
+)
+
+var errPayloadTooBig = errors.New("message is too large to fragment...")
+var errFragmentKind = errors.New("fragments cannot be fragmented...")
+var errInvalidFragment = errors.New("fragment header is invalid...")
+var errFragmentMismatch = errors.New("fragment does not match the rest of its message...")
+
+// Splits the body into the bodies of MessageFragment frames of at most
+// size bytes, all of which carry the message id so the peer can put them
+// back together.
+func Split(msg uint64, kind byte, body []byte, size int) ([][]byte, error) {
+	size -= FragmentOverhead
+	if kind == MessageFragment {
+		return nil, errFragmentKind
+	} else if len(body) > MaxPayloadSize || size < FragmentSize {
+		return nil, errPayloadTooBig
+	}
+
+	count := (len(body) + size - 1) / size
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(body) {
+			end = len(body)
+		}
+		fragment := make([]byte, SequenceSize, FragmentOverhead+end-i*size)
+		binary.BigEndian.PutUint64(fragment, msg)
+		fragment = append(fragment, byte(i), byte(count), kind)
+		fragments = append(fragments, append(fragment, body[i*size:end]...))
+	}
+	return fragments, nil
+}
+
+// Seals the body as a single frame when it fits, otherwise as fragments
+// numbered with consecutive sequence numbers, the first of which serves
+// as the message id since it is unique to the session.
+func (k *KeyRing) SealMessage(id uint32, kind byte, body []byte) ([][]byte, error) {
+	if len(body) <= k.suite.MaxBodySize() {
+		frame, err := k.Seal(id, kind, body)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{frame}, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	fragments, err := Split(k.seq+1, kind, body, k.suite.MaxBodySize())
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, 0, len(fragments))
+	for _, fragment := range fragments {
+		k.seq++
+		k.sealed++
+		frame, err := SealFrame(k.current, k.seal, id, k.seq, MessageFragment, fragment)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// Counters of messages reassembled, and of partial messages dropped for
+// taking too long or to stay under the memory caps.
+type ReassemblyStats struct {
+	Reassembled uint64
+	Expired     uint64
+	Evicted     uint64
+}
+
+type partial struct {
+	kind     byte
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// Puts fragmented messages back together.
+//
+// The zero value is ready to use with the default limits.  A partial
+// message is dropped once it is older than Timeout, and the oldest are
+// evicted to make room when more than Messages or Bytes would be held.
+type Reassembler struct {
+	Timeout  time.Duration
+	Messages int
+	Bytes    int
+
+	mu      sync.Mutex
+	pending map[uint64]*partial
+	size    int
+	stats   ReassemblyStats
+}
+
+// Adds the body of a MessageFragment, returning the type and body of the
+// message once every fragment of it has arrived.
+func (r *Reassembler) Add(fragment []byte) (byte, []byte, bool, error) {
+	if len(fragment) < FragmentOverhead || len(fragment) > MaxBodySize {
+		return 0, nil, false, errInvalidFragment
+	}
+	msg := binary.BigEndian.Uint64(fragment)
+	index, count, kind := int(fragment[SequenceSize]), int(fragment[SequenceSize+1]), fragment[SequenceSize+2]
+	data := fragment[FragmentOverhead:]
+	if count == 0 || count > MaxFragments || index >= count || kind == MessageFragment {
+		return 0, nil, false, errInvalidFragment
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[uint64]*partial)
+	}
+	r.expire()
+
+	p, ok := r.pending[msg]
+	if !ok {
+		r.evict(len(data))
+		p = &partial{kind: kind, parts: make([][]byte, count), started: time.Now()}
+		r.pending[msg] = p
+	} else if p.kind != kind || len(p.parts) != count {
+		r.drop(msg, p)
+		return 0, nil, false, errFragmentMismatch
+	} else if r.size+len(data) > r.maxBytes() {
+		r.drop(msg, p)
+		r.stats.Evicted++
+		return 0, nil, false, nil
+	}
+	if p.parts[index] != nil {
+		return 0, nil, false, nil
+	}
+	p.parts[index] = append([]byte(nil), data...)
+	p.received++
+	p.size += len(data)
+	r.size += len(data)
+	if p.received < count {
+		return 0, nil, false, nil
+	}
+
+	body := make([]byte, 0, p.size)
+	for _, part := range p.parts {
+		body = append(body, part...)
+	}
+	r.drop(msg, p)
+	r.stats.Reassembled++
+	return p.kind, body, true, nil
+}
+
+// Counters since the reassembler was created.
+func (r *Reassembler) Stats() ReassemblyStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// The number of partial messages and bytes currently held.
+func (r *Reassembler) Pending() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending), r.size
+}
+
+func (r *Reassembler) drop(msg uint64, p *partial) {
+	r.size -= p.size
+	delete(r.pending, msg)
+}
+
+func (r *Reassembler) expire() {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultReassemblyTimeout
+	}
+	for msg, p := range r.pending {
+		if time.Since(p.started) > timeout {
+			r.drop(msg, p)
+			r.stats.Expired++
+		}
+	}
+}
+
+// Evicts the oldest partial messages until a new one of at least size
+// bytes fits under the caps.
+func (r *Reassembler) evict(size int) {
+	messages := r.Messages
+	if messages == 0 {
+		messages = DefaultReassemblyMessages
+	}
+	for len(r.pending) > 0 && (len(r.pending) >= messages || r.size+size > r.maxBytes()) {
+		var oldest uint64
+		var first *partial
+		for msg, p := range r.pending {
+			if first == nil || p.started.Before(first.started) {
+				oldest, first = msg, p
+			}
+		}
+		r.drop(oldest, first)
+		r.stats.Evicted++
+	}
+}
+
+func (r *Reassembler) maxBytes() int {
+	if r.Bytes == 0 {
+		return DefaultReassemblyBytes
+	}
+	return r.Bytes
+}
+
+// Forgets every partial message, for when a new session begins numbering
+// its messages from the start.
+func (r *Reassembler) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = nil
+	r.size = 0
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestFragment(t *testing.T) {
+	message := make([]byte, 3*FragmentSize+7)
+	if _, err := rand.Read(message); err != nil {
+		t.Fatalf("failed to generate message: %s", err)
+	}
+
+	for _, suite := range Suites {
+		t.Run(suite.String(), func(t *testing.T) {
+			a, b := rings(t, suite)
+			size := suite.MaxBodySize() - FragmentOverhead
+			frames, err := a.SealMessage(1, MessageChat, message)
+			if err != nil {
+				t.Fatalf("failed to seal message: %s", err)
+			} else if len(frames) != (len(message)+size-1)/size {
+				t.Fatalf("expected %d fragments, got %d", (len(message)+size-1)/size, len(frames))
+			}
+
+			// reversed with a duplicate, completing only on the first fragment
+			order := []int{len(frames) - 1}
+			for i := len(frames) - 1; i >= 0; i-- {
+				order = append(order, i)
+			}
+			var r Reassembler
+			for _, n := range order {
+				if len(frames[n]) > BufferSize {
+					t.Fatalf("fragment %d exceeds the buffer size: %d", n, len(frames[n]))
+				}
+				_, kind, body, err := b.Open(frames[n])
+				if err != nil || kind != MessageFragment {
+					t.Fatalf("failed to open fragment %d: %d %v", n, kind, err)
+				}
+				kind, body, ok, err := r.Add(body)
+				if err != nil {
+					t.Fatalf("failed to add fragment %d: %s", n, err)
+				} else if ok != (n == 0) {
+					t.Fatalf("unexpected completion at fragment %d", n)
+				} else if ok && (kind != MessageChat || !bytes.Equal(body, message)) {
+					t.Fatal("reassembled message does not match...")
+				}
+			}
+			if messages, held := r.Pending(); messages != 0 || held != 0 {
+				t.Fatalf("expected nothing held, got %d messages of %d bytes", messages, held)
+			}
+
+			// small messages are not fragmented
+			if frames, err := a.SealMessage(1, MessageChat, []byte("hello")); err != nil || len(frames) != 1 {
+				t.Fatalf("expected a single frame, got %d: %v", len(frames), err)
+			}
+			if _, err := a.SealMessage(1, MessageChat, make([]byte, MaxPayloadSize+1)); err == nil {
+				t.Fatal("expected oversized message to fail...")
+			}
+		})
+	}
+}
+
+func TestReassemblyLimits(t *testing.T) {
+	r := Reassembler{Timeout: 50 * time.Millisecond, Messages: 2, Bytes: 3 * FragmentSize}
+	first := func(msg uint64) []byte {
+		fragments, err := Split(msg, MessageChat, make([]byte, 2*FragmentSize), FragmentSize+FragmentOverhead)
+		if err != nil {
+			t.Fatalf("failed to split: %s", err)
+		}
+		return fragments[0]
+	}
+
+	// a third partial message evicts the oldest, as would running out of bytes
+	for msg := uint64(1); msg <= 4; msg++ {
+		if _, _, ok, err := r.Add(first(msg)); ok || err != nil {
+			t.Fatalf("unexpected result adding message %d: %t %v", msg, ok, err)
+		}
+	}
+	if messages, size := r.Pending(); messages != 2 || size != 2*FragmentSize {
+		t.Fatalf("expected 2 messages of %d bytes, got %d of %d", 2*FragmentSize, messages, size)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	r.Add(first(5))
+	if stats := r.Stats(); stats.Evicted != 2 || stats.Expired != 2 {
+		t.Fatalf("unexpected counters: %#v", stats)
+	}
+
+	invalid := first(6)
+	invalid[SequenceSize] = MaxFragments
+	if _, _, _, err := r.Add(invalid); err == nil {
+		t.Fatal("expected out of range index to fail...")
+	}
+	mismatch := first(5)
+	mismatch[SequenceSize], mismatch[SequenceSize+2] = 1, MessageDisconnected
+	if _, _, _, err := r.Add(mismatch); err == nil {
+		t.Fatal("expected mismatched fragment to fail...")
+	}
+}
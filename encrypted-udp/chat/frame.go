@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// Shared constants representing a known message types,
+// sizes used to establish buffers, and service signature
+// to easily drop unknown traffic.
+const (
+	MessageHandshake byte = iota
+	MessageDisconnected
+	MessageChat
+	MessageReset
+	MessagePing
+	MessageRekey
+	MessageReliable
+	MessageAck
+	MessageFragment
+	MessageJoin
+	MessageLeave
+	MessageDirect
+	MessageNotice
+	MessageRetry
+	MessageWhois
+	MessageProbe
+	MessageAnnounce
+	MessagePeer
+	MessagePunch
+	MessageRelay
+	MessagePong
+	MessageWho
+	MessageHistory
+	MessageHello
+)
+
+const (
+	BufferSize       = 508
+	KeySize          = 32
+	ConnectionIDSize = 4
+	ResetTokenSize   = 16
+	CookieSize       = 16
+	MaxIdentitySize  = 20
+	MinFrameOverhead = frameHeaderSize + GCMNonceSize + GCMOverhead
+	MaxFrameOverhead = frameHeaderSize + NaClNonceSize + NaClOverhead
+	MaxMessageSize   = MaxPayloadSize - (MaxIdentitySize + 2) // 2 spaces for formatting
+
+	frameHeaderSize = ConnectionIDSize + SequenceSize + 1
+)
+
+// Cleartext frames, used only for the handshake and for notices to peers
+// without a session, begin with the signature and the message type.
+//
+// Once a handshake completes every frame is sealed, leaving only the
+// connection id assigned by the server in the clear.  Since connection
+// ids never match the signature the two kinds cannot be confused.
+var Signature = [...]byte{1, 2, 3, 4}
+
+var errFrameTooSmall = errors.New("frame is too small...")
+var errFrameDecrypt = errors.New("failed to decrypt frame...")
+
+// Reports whether the data is a cleartext frame with a message type.
+func Clear(data []byte) bool {
+	return len(data) > len(Signature) && bytes.Equal(data[:len(Signature)], Signature[:])
+}
+
+// Prepares a cleartext frame of the message type and body.
+func ClearFrame(kind byte, body []byte) []byte {
+	return append(append(Signature[:], kind), body...)
+}
+
+// Reports whether a connection id could be mistaken for a cleartext frame.
+func ValidConnectionID(id uint32) bool {
+	return id != 0 && id != binary.BigEndian.Uint32(Signature[:])
+}
+
+// Reads the connection id from the front of a sealed frame.
+func ConnectionID(frame []byte) (uint32, bool) {
+	if len(frame) < MinFrameOverhead {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(frame), true
+}
+
+// The direction a sealed frame travels in, which is authenticated along
+// with the connection id as additional data, since both sides of a
+// session seal with the same key.  Without it a frame sent back to the
+// side that sealed it would open there, and one moved to another
+// connection under the same key would open as that connection.
+const (
+	DirectionToServer byte = iota
+	DirectionToClient
+	// between peers, sealed by the one whose box key sorts first, and by
+	// the other, see PeerDirections
+	DirectionFirstPeer
+	DirectionSecondPeer
+)
+
+func additional(direction byte, id uint32) []byte {
+	ad := make([]byte, 1+ConnectionIDSize)
+	ad[0] = direction
+	binary.BigEndian.PutUint32(ad[1:], id)
+	return ad
+}
+
+// Seals the sequence number, message type and body with the session
+// suite, prefixed with the connection id and a random nonce, for the
+// direction it is sent in.
+func SealFrame(aead cipher.AEAD, direction byte, id uint32, seq uint64, kind byte, body []byte) ([]byte, error) {
+	frame := make([]byte, ConnectionIDSize+aead.NonceSize(), frameHeaderSize+aead.NonceSize()+aead.Overhead()+len(body))
+	binary.BigEndian.PutUint32(frame, id)
+	nonce := frame[ConnectionIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(frame, nonce, SequencePut(seq, append([]byte{kind}, body...)), additional(direction, id)), nil
+}
+
+// Opens a sealed frame that was sent in the direction, returning the
+// sequence number, type and body.
+//
+// The sequence number must still be checked against a ReplayWindow.
+func OpenFrame(aead cipher.AEAD, direction byte, frame []byte) (uint64, byte, []byte, error) {
+	if len(frame) < frameHeaderSize+aead.NonceSize()+aead.Overhead() {
+		return 0, 0, nil, errFrameTooSmall
+	}
+	id := binary.BigEndian.Uint32(frame)
+	payload, err := aead.Open(nil, frame[ConnectionIDSize:ConnectionIDSize+aead.NonceSize()], frame[ConnectionIDSize+aead.NonceSize():], additional(direction, id))
+	if err != nil {
+		return 0, 0, nil, errFrameDecrypt
+	}
+	seq, data, err := SequenceSplit(payload)
+	if err != nil || len(data) < 1 {
+		return 0, 0, nil, errFrameTooSmall
+	}
+	return seq, data[0], data[1:], nil
+}
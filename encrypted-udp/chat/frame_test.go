@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	var key [KeySize]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	for _, suite := range Suites {
+		aead := suite.AEAD(&key)
+		frame, err := SealFrame(aead, DirectionToServer, 99, 5, MessageChat, []byte("hello"))
+		if err != nil {
+			t.Fatalf("%s failed to seal frame: %s", suite, err)
+		} else if Clear(frame) {
+			t.Fatalf("%s sealed frame mistaken for cleartext...", suite)
+		} else if len(frame) != suite.FrameOverhead()+len("hello") {
+			t.Fatalf("%s frame is %d bytes, expected %d", suite, len(frame), suite.FrameOverhead()+len("hello"))
+		}
+
+		if id, ok := ConnectionID(frame); !ok || id != 99 {
+			t.Fatalf("%s expected connection id 99, got %d", suite, id)
+		}
+
+		seq, kind, body, err := OpenFrame(aead, DirectionToServer, frame)
+		if err != nil {
+			t.Fatalf("%s failed to open frame: %s", suite, err)
+		} else if seq != 5 || kind != MessageChat || !bytes.Equal(body, []byte("hello")) {
+			t.Fatalf("%s unexpected frame contents: %d %d %s", suite, seq, kind, body)
+		}
+
+		// sent back to the side that sealed it, or moved to another
+		// connection under the same key
+		if _, _, _, err := OpenFrame(aead, DirectionToClient, frame); err == nil {
+			t.Fatalf("%s expected a frame sent back to fail...", suite)
+		}
+		moved := append([]byte{0, 0, 0, 98}, frame[ConnectionIDSize:]...)
+		if _, _, _, err := OpenFrame(aead, DirectionToServer, moved); err == nil {
+			t.Fatalf("%s expected a frame moved to another connection to fail...", suite)
+		}
+
+		frame[len(frame)-1] ^= 1
+		if _, _, _, err := OpenFrame(aead, DirectionToServer, frame); err == nil {
+			t.Fatalf("%s expected tampered frame to fail...", suite)
+		}
+
+		if _, _, _, err := OpenFrame(aead, DirectionToServer, frame[:suite.FrameOverhead()-1]); err == nil {
+			t.Fatalf("%s expected short frame to fail...", suite)
+		}
+	}
+}
+
+func TestValidConnectionID(t *testing.T) {
+	if ValidConnectionID(0) || ValidConnectionID(0x01020304) || !ValidConnectionID(5) {
+		t.Fatal("unexpected connection id validity...")
+	}
+}
@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+)
+
+// A client offers at most this many suites in its handshake.
+//
+// The hello starts with the protocol version and capabilities, which
+// every later version keeps in place, so a server can always tell which
+// version a client speaks before reading the rest.
+const (
+	MaxSuites          = 8
+	CapabilitiesSize   = 4
+	HelloHeaderSize    = 1 + CapabilitiesSize
+	HandshakeReplySize = KeySize + ed25519.PublicKeySize + HelloHeaderSize + 1 + ed25519.SignatureSize + NaClNonceSize + NaClOverhead + ConnectionIDSize + ResetTokenSize
+)
+
+var errInvalidHandshake = errors.New("handshake must contain a version, capabilities, a key, the offered suites, a cookie and an optional identity key...")
+var errInvalidReply = errors.New("handshake reply is the wrong size...")
+
+// A handshake from the client, holding the protocol version it speaks and
+// the capabilities it asks for, its box key, the suites it offers in order
+// of preference, the cookie from the last MessageRetry if any, and the
+// identity it claims.
+//
+// When the client has a long-lived identity key it signs the handshake,
+// binding the identity to the box key so the signature cannot be reused
+// by anyone who does not also hold the box key.
+//
+// @note: the first version of the protocol sent the same thing without a
+// version or capabilities as a MessageHandshake, which is how the server
+// still replies, so clients that old can be told they are.
+type Handshake struct {
+	Version      byte
+	Capabilities Capability
+	Key          [KeySize]byte
+	Suites       []Suite
+	Cookie       []byte
+	Identity     string
+	PublicKey    ed25519.PublicKey
+	Signature    []byte
+}
+
+// Prepares the body of an unsigned MessageHello for this version, asking
+// for every capability.
+func HandshakeBody(pub *[KeySize]byte, suites []Suite, cookie []byte, identity string) []byte {
+	return (&Handshake{Version: ProtocolVersion, Capabilities: Capabilities, Key: *pub, Suites: suites, Cookie: cookie, Identity: identity}).Body()
+}
+
+// The body of a MessageHello, which is the version, the capabilities, the
+// box key, the number of suites followed by the suites, the length of the
+// cookie followed by the cookie, the length of the identity key followed
+// by the key and its signature, and finally the identity.
+func (h *Handshake) Body() []byte {
+	body := binary.BigEndian.AppendUint32([]byte{h.Version}, uint32(h.Capabilities))
+	body = append(append(append(body, h.Key[:]...), byte(len(h.Suites))), make([]byte, len(h.Suites))...)
+	for i, s := range h.Suites {
+		body[HelloHeaderSize+KeySize+1+i] = byte(s)
+	}
+	body = append(append(body, byte(len(h.Cookie))), h.Cookie...)
+	body = append(append(append(body, byte(len(h.PublicKey))), h.PublicKey...), h.Signature...)
+	return append(body, h.Identity...)
+}
+
+// Signs the box key and identity with the identity key.
+func (h *Handshake) Sign(key ed25519.PrivateKey) {
+	h.PublicKey = key.Public().(ed25519.PublicKey)
+	h.Signature = ed25519.Sign(key, h.signed())
+}
+
+// Reports whether the handshake is signed by its identity key.
+func (h *Handshake) Verify() bool {
+	return len(h.PublicKey) == ed25519.PublicKeySize && ed25519.Verify(h.PublicKey, h.signed(), h.Signature)
+}
+
+func (h *Handshake) signed() []byte {
+	return append(append([]byte("encrypted-udp client "), h.Key[:]...), h.Identity...)
+}
+
+// The version a MessageHello is for, which is all that can be read from
+// one for a version we do not speak.
+func HelloVersion(body []byte) (byte, bool) {
+	if len(body) < HelloHeaderSize {
+		return 0, false
+	}
+	return body[0], true
+}
+
+// Separates the parts of a client handshake, leaving the version, the
+// cookie, the signature and the identity to be checked by the caller.
+func HandshakeSplit(body []byte) (*Handshake, error) {
+	if len(body) < HelloHeaderSize {
+		return nil, errInvalidHandshake
+	}
+	h := &Handshake{Version: body[0], Capabilities: Capability(binary.BigEndian.Uint32(body[1:]))}
+	body = body[HelloHeaderSize:]
+	if len(body) < KeySize+1 || body[KeySize] == 0 || body[KeySize] > MaxSuites || len(body) < KeySize+2+int(body[KeySize]) {
+		return nil, errInvalidHandshake
+	}
+	copy(h.Key[:], body)
+	h.Suites = make([]Suite, body[KeySize])
+	for i := range h.Suites {
+		h.Suites[i] = Suite(body[KeySize+1+i])
+	}
+
+	rest := body[KeySize+1+len(h.Suites):]
+	if int(rest[0]) > CookieSize || len(rest) < 2+int(rest[0]) {
+		return nil, errInvalidHandshake
+	}
+	h.Cookie, rest = rest[1:1+rest[0]], rest[1+rest[0]:]
+
+	switch {
+	case rest[0] == 0:
+		rest = rest[1:]
+	case rest[0] == ed25519.PublicKeySize && len(rest) >= 1+ed25519.PublicKeySize+ed25519.SignatureSize:
+		h.PublicKey = rest[1 : 1+ed25519.PublicKeySize]
+		h.Signature = rest[1+ed25519.PublicKeySize : 1+ed25519.PublicKeySize+ed25519.SignatureSize]
+		rest = rest[1+ed25519.PublicKeySize+ed25519.SignatureSize:]
+	default:
+		return nil, errInvalidHandshake
+	}
+	h.Identity = string(rest)
+	return h, nil
+}
+
+// The reply to a MessageHello, holding the box key and identity key of
+// the server, the version and capabilities it chose, the suite, and its
+// signature over the transcript, followed by the nonce and the sealed
+// connection id and reset token.
+type HandshakeReply struct {
+	Key          [KeySize]byte
+	Identity     ed25519.PublicKey
+	Version      byte
+	Capabilities Capability
+	Suite        Suite
+	Signature    []byte
+	Sealed       []byte
+}
+
+// The body of the MessageHandshake replying to a hello, in the order of
+// the fields.
+func (r *HandshakeReply) Body() []byte {
+	body := append(append(r.Key[:KeySize:KeySize], r.Identity...), r.Version)
+	body = binary.BigEndian.AppendUint32(body, uint32(r.Capabilities))
+	return append(append(append(body, byte(r.Suite)), r.Signature...), r.Sealed...)
+}
+
+// Separates the parts of a handshake reply, leaving the signature and the
+// sealed session to be checked by the caller.
+func ReplySplit(body []byte) (*HandshakeReply, error) {
+	if len(body) != HandshakeReplySize {
+		return nil, errInvalidReply
+	}
+	r := &HandshakeReply{}
+	copy(r.Key[:], body)
+	body = body[KeySize:]
+	r.Identity, body = ed25519.PublicKey(body[:ed25519.PublicKeySize]), body[ed25519.PublicKeySize:]
+	r.Version, r.Capabilities = body[0], Capability(binary.BigEndian.Uint32(body[1:]))
+	r.Suite, body = Suite(body[HelloHeaderSize]), body[HelloHeaderSize+1:]
+	r.Signature, r.Sealed = body[:ed25519.SignatureSize], body[ed25519.SignatureSize:]
+	return r, nil
+}
+
+// What the server signs in its reply, binding its box key to the clients,
+// the chosen suite to those offered, and the chosen version and
+// capabilities to those asked for, so neither a captured reply nor a
+// downgraded offer can be passed off as this handshake.
+func HandshakeTranscript(server *[KeySize]byte, h *Handshake, version byte, capabilities Capability, chosen Suite) []byte {
+	transcript := append(append(server[:KeySize:KeySize], h.Key[:]...), byte(len(h.Suites)))
+	for _, s := range h.Suites {
+		transcript = append(transcript, byte(s))
+	}
+	transcript = binary.BigEndian.AppendUint32(append(transcript, h.Version), uint32(h.Capabilities))
+	transcript = binary.BigEndian.AppendUint32(append(transcript, version), uint32(capabilities))
+	return append(transcript, byte(chosen))
+}
@@ -0,0 +1,29 @@
+package chat
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var errInvalidHistory = errors.New("history must hold a timestamp, a sender and a message...")
+
+// Prepares the body of a MessageHistory, which replays a message relayed
+// before we joined, prefixed with the wall clock time the server received
+// it and the sender in the same form as a MessageDirect.
+func HistoryBody(at time.Time, sender string, message []byte) []byte {
+	body := binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano()))
+	return append(body, DirectBody(sender, message)...)
+}
+
+// Separates the time, sender and message of a MessageHistory.
+func HistorySplit(body []byte) (time.Time, string, []byte, error) {
+	if len(body) < TimestampSize {
+		return time.Time{}, "", nil, errInvalidHistory
+	}
+	sender, message, err := DirectSplit(body[TimestampSize:])
+	if err != nil {
+		return time.Time{}, "", nil, errInvalidHistory
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(body))), sender, message, nil
+}
@@ -0,0 +1,20 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 0, 5, time.UTC)
+	when, sender, message, err := HistorySplit(HistoryBody(at, "alice", []byte("hello")))
+	if err != nil || !when.Equal(at) || sender != "alice" || string(message) != "hello" {
+		t.Fatalf("unexpected history: %s %q %q %v", when, sender, message, err)
+	}
+
+	for _, body := range [][]byte{nil, make([]byte, TimestampSize), append(make([]byte, TimestampSize), 5, 'a')} {
+		if _, _, _, err := HistorySplit(body); err == nil {
+			t.Fatalf("expected %v to fail...", body)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+var errInvalidIdentityKey = errors.New("identity file does not contain an ed25519 private key...")
+
+// Loads the long-lived ed25519 identity key from a PEM encoded file,
+// generating and saving a new one when the file does not exist.
+//
+// The server uses its key to sign the ephemeral box key sent with each
+// handshake reply, so clients can pin it much like ssh known_hosts, and
+// clients may use one to sign their handshake, so the server can bind
+// their identity to it on first use.
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return generateIdentity(path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errInvalidIdentityKey
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errInvalidIdentityKey
+	}
+	return priv, nil
+}
+
+func generateIdentity(path string) (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// A printable fingerprint of an identity key, so that users can compare
+// the ones they are shown out of band.
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,247 @@
+// An in-memory packet network for testing the chat client and server
+// together without sockets.
+//
+// Datagrams may be dropped, duplicated or delayed past the ones sent after
+// them, as they can be over UDP, with every decision drawn from a seeded
+// source so a test sees the same mix of faults each time it runs.
+package memnet
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The number of datagrams a connection holds before further ones are
+// dropped, as a full socket buffer would.
+const QueueSize = 256
+
+var errAddressInUse = errors.New("address already in use...")
+
+// The address of a connection on the network, which is simply its name.
+type Addr string
+
+func (a Addr) Network() string { return "mem" }
+func (a Addr) String() string  { return string(a) }
+
+// A network of named packet connections.
+//
+// Loss, Duplicate and Reorder are the chances that each datagram is
+// dropped, delivered twice, or held for up to Delay so that later ones
+// overtake it.  They should be set before any connection is made.
+type Network struct {
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	Delay     time.Duration
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	conns map[Addr]*Conn
+	next  int
+}
+
+// Prepares a network whose faults are drawn from the seed.
+func New(seed int64) *Network {
+	return &Network{
+		Delay: 10 * time.Millisecond,
+		rng:   rand.New(rand.NewSource(seed)),
+		conns: make(map[Addr]*Conn),
+	}
+}
+
+// Opens a connection under the name, or a new unique name when it is
+// empty.  A name is free again once its connection is closed.
+func (n *Network) Listen(name string) (*Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if name == "" {
+		n.next++
+		name = "mem" + strconv.Itoa(n.next)
+	}
+	addr := Addr(name)
+	if _, ok := n.conns[addr]; ok {
+		return nil, errAddressInUse
+	}
+	c := &Conn{
+		network:  n,
+		addr:     addr,
+		queue:    make(chan datagram, QueueSize),
+		closed:   make(chan struct{}),
+		deadline: make(chan struct{}),
+	}
+	n.conns[addr] = c
+	return c, nil
+}
+
+// Decides the fate of a datagram, returning the delay of each copy to
+// deliver, which is none when it is lost.
+func (n *Network) faults() []time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.rng.Float64() < n.Loss {
+		return nil
+	}
+	copies := 1
+	if n.rng.Float64() < n.Duplicate {
+		copies++
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		if n.Delay > 0 && n.rng.Float64() < n.Reorder {
+			delays[i] = time.Duration(n.rng.Int63n(int64(n.Delay)))
+		}
+	}
+	return delays
+}
+
+func (n *Network) send(from Addr, to net.Addr, b []byte) {
+	n.mu.Lock()
+	c, ok := n.conns[Addr(to.String())]
+	ok = ok && (c.nat == nil || c.nat.inbound(Addr(to.String()), from))
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, delay := range n.faults() {
+		d := datagram{from: from, b: append([]byte(nil), b...)}
+		if delay == 0 {
+			c.deliver(d)
+		} else {
+			time.AfterFunc(delay, func() { c.deliver(d) })
+		}
+	}
+}
+
+func (n *Network) remove(c *Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conns[c.addr] == c {
+		delete(n.conns, c.addr)
+	}
+	if c.nat != nil {
+		for _, public := range c.nat.mappings {
+			delete(n.conns, public)
+		}
+	}
+}
+
+type datagram struct {
+	from Addr
+	b    []byte
+}
+
+// A packet connection on the network, safe for concurrent use.
+//
+// Writes to names with no connection are silently lost, as they would be
+// over UDP, and only reads honour deadlines since writes never block.
+//
+// Behind a NAT the connection writes from its public addresses, while
+// LocalAddr is still its own name.
+type Conn struct {
+	network *Network
+	addr    Addr
+	nat     *NAT
+	queue   chan datagram
+	once    sync.Once
+	closed  chan struct{}
+
+	mu       sync.Mutex
+	read     time.Time
+	deadline chan struct{}
+}
+
+func (c *Conn) deliver(d datagram) {
+	select {
+	case <-c.closed:
+	case c.queue <- d:
+	default:
+	}
+}
+
+// Reads the next datagram, waiting until one arrives, the read deadline
+// passes or the connection is closed.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		read, changed := c.read, c.deadline
+		c.mu.Unlock()
+
+		select {
+		case <-c.closed:
+			return 0, nil, c.error("read", net.ErrClosed)
+		default:
+		}
+
+		var expired <-chan time.Time
+		stop := func() {}
+		if !read.IsZero() {
+			t := time.NewTimer(time.Until(read))
+			expired, stop = t.C, func() { t.Stop() }
+		}
+		select {
+		case d := <-c.queue:
+			stop()
+			return copy(b, d.b), d.from, nil
+		case <-c.closed:
+			stop()
+			return 0, nil, c.error("read", net.ErrClosed)
+		case <-expired:
+			return 0, nil, c.error("read", os.ErrDeadlineExceeded)
+		case <-changed:
+			stop()
+		}
+	}
+}
+
+// Sends a copy of the datagram, subject to the faults of the network.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.error("write", net.ErrClosed)
+	default:
+	}
+	c.network.send(c.network.outbound(c, addr), addr, b)
+	return len(b), nil
+}
+
+// Closes the connection, freeing its name and waking any readers.
+func (c *Conn) Close() error {
+	err := c.error("close", net.ErrClosed)
+	c.once.Do(func() {
+		close(c.closed)
+		c.network.remove(c)
+		err = nil
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// Sets when reads give up, waking any read in progress so it notices.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read = t
+	close(c.deadline)
+	c.deadline = make(chan struct{})
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *Conn) error(op string, err error) error {
+	return &net.OpError{Op: op, Net: "mem", Addr: c.addr, Err: err}
+}
@@ -0,0 +1,111 @@
+package memnet
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, n *Network, name string) *Conn {
+	c, err := n.Listen(name)
+	if err != nil {
+		t.Fatalf("failed to listen on %q: %s", name, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestDelivery(t *testing.T) {
+	n := New(1)
+	a, b := listen(t, n, "a"), listen(t, n, "")
+	if _, err := n.Listen("a"); err == nil {
+		t.Fatal("expected a name in use to fail...")
+	}
+
+	if _, err := a.WriteTo([]byte("hello"), b.LocalAddr()); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	buf := make([]byte, 16)
+	if l, from, err := b.ReadFrom(buf); err != nil || string(buf[:l]) != "hello" || from.String() != "a" {
+		t.Fatalf("unexpected datagram %q from %v: %v", buf[:l], from, err)
+	}
+
+	// nothing listens here, so the datagram is simply lost
+	if _, err := a.WriteTo([]byte("hello"), Addr("nobody")); err != nil {
+		t.Fatalf("expected a write to nowhere to succeed: %s", err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := b.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+
+	b.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.Close()
+	}()
+	if _, _, err := b.ReadFrom(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected a closed error, got %v", err)
+	}
+	if _, err := b.WriteTo([]byte("hello"), a.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected writing after close to fail, got %v", err)
+	}
+	listen(t, n, b.LocalAddr().String())
+}
+
+// The same seed makes the same decisions, which with every fault enabled
+// loses some datagrams, duplicates others and delivers them out of order.
+func TestFaults(t *testing.T) {
+	const count = 200
+	run := func() []byte {
+		n := New(7)
+		n.Loss, n.Duplicate, n.Reorder, n.Delay = 0.2, 0.2, 0.3, 20*time.Millisecond
+		a, b := listen(t, n, "a"), listen(t, n, "b")
+		for i := 0; i < count; i++ {
+			a.WriteTo([]byte{byte(i)}, b.LocalAddr())
+		}
+
+		var received []byte
+		buf := make([]byte, 1)
+		for {
+			b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, _, err := b.ReadFrom(buf); err != nil {
+				return received
+			}
+			received = append(received, buf[0])
+		}
+	}
+
+	received := run()
+	seen := make(map[byte]int)
+	reordered := false
+	for i, b := range received {
+		seen[b]++
+		if i > 0 && b < received[i-1] {
+			reordered = true
+		}
+	}
+	duplicated := false
+	for _, n := range seen {
+		duplicated = duplicated || n > 1
+	}
+	if len(seen) == count || !duplicated || !reordered {
+		t.Fatalf("expected loss, duplicates and reordering: %d of %d unique, %t, %t", len(seen), count, duplicated, reordered)
+	}
+
+	again := make(map[byte]int)
+	for _, b := range run() {
+		again[b]++
+	}
+	if len(again) != len(seen) {
+		t.Fatalf("expected the same losses with the same seed, got %d and %d", len(seen), len(again))
+	}
+	for b, n := range seen {
+		if again[b] != n {
+			t.Fatalf("expected datagram %d to arrive %d times, got %d", b, n, again[b])
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package memnet
+
+import (
+	"net"
+	"strconv"
+)
+
+// A NAT in front of a connection, which sends from a public address it
+// allocates, and only lets datagrams in to that address from the ones the
+// connection has sent to, like a port restricted cone NAT.
+//
+// A Symmetric NAT allocates a public address for each destination, so
+// the address one peer sees is useless to another and hole punching
+// fails, which is the case relaying is for.
+//
+// The mappings are guarded by the network lock.
+type NAT struct {
+	Symmetric bool
+
+	ports    int
+	mappings map[Addr]Addr
+	allowed  map[Addr]map[Addr]bool
+}
+
+// Opens a connection behind the NAT, which is unreachable under its own
+// name and only reached through the public addresses it is mapped to.
+func (n *Network) ListenNAT(name string, nat *NAT) (*Conn, error) {
+	c, err := n.Listen(name)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	c.nat = nat
+	n.mu.Unlock()
+	return c, nil
+}
+
+// The address a datagram from the connection to the destination leaves
+// from, allocating one on first use and opening it to the destination.
+func (n *Network) outbound(c *Conn, to net.Addr) Addr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c.nat == nil {
+		return c.addr
+	}
+	t := c.nat
+	if t.mappings == nil {
+		t.mappings, t.allowed = make(map[Addr]Addr), make(map[Addr]map[Addr]bool)
+	}
+
+	var key Addr
+	if t.Symmetric {
+		key = Addr(to.String())
+	}
+	public, ok := t.mappings[key]
+	for !ok {
+		t.ports++
+		public = Addr(string(c.addr) + ":" + strconv.Itoa(t.ports))
+		if _, used := n.conns[public]; !used {
+			t.mappings[key], t.allowed[public] = public, make(map[Addr]bool)
+			n.conns[public] = c
+			ok = true
+		}
+	}
+	t.allowed[public][Addr(to.String())] = true
+	return public
+}
+
+// Reports whether a datagram to the public address from the sender is let
+// through; the caller must hold the network lock.
+func (t *NAT) inbound(to, from Addr) bool {
+	return t.allowed[to][from]
+}
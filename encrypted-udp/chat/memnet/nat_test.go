@@ -0,0 +1,76 @@
+package memnet
+
+import (
+	"testing"
+	"time"
+)
+
+// Reads a datagram, returning who it came from, or nothing if none
+// arrives in time.
+func receive(t *testing.T, c *Conn) string {
+	t.Helper()
+	buf := make([]byte, 16)
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, from, err := c.ReadFrom(buf); err == nil {
+		return from.String()
+	}
+	return ""
+}
+
+func listenNAT(t *testing.T, n *Network, name string, nat *NAT) *Conn {
+	c, err := n.ListenNAT(name, nat)
+	if err != nil {
+		t.Fatalf("failed to listen on %q: %s", name, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestNAT(t *testing.T) {
+	n := New(1)
+	server, peer := listen(t, n, "server"), listen(t, n, "peer")
+	a := listenNAT(t, n, "a", &NAT{})
+
+	a.WriteTo([]byte("hello"), server.LocalAddr())
+	if from := receive(t, server); from != "a:1" {
+		t.Fatalf("expected the public address, got %q", from)
+	}
+	server.WriteTo([]byte("hello"), Addr("a:1"))
+	if from := receive(t, a); from != "server" {
+		t.Fatalf("expected the reply let in, got %q", from)
+	}
+
+	// the peer is kept out until a has sent to it, and neither can reach
+	// the private name
+	peer.WriteTo([]byte("hello"), Addr("a:1"))
+	peer.WriteTo([]byte("hello"), Addr("a"))
+	if from := receive(t, a); from != "" {
+		t.Fatalf("expected the peer to be kept out, got %q", from)
+	}
+	a.WriteTo([]byte("punch"), peer.LocalAddr())
+	if from := receive(t, peer); from != "a:1" {
+		t.Fatalf("expected the same public address for every destination, got %q", from)
+	}
+	peer.WriteTo([]byte("hello"), Addr("a:1"))
+	if from := receive(t, a); from != "peer" {
+		t.Fatalf("expected the peer let in after punching, got %q", from)
+	}
+
+	b := listenNAT(t, n, "b", &NAT{Symmetric: true})
+	b.WriteTo([]byte("hello"), server.LocalAddr())
+	b.WriteTo([]byte("hello"), peer.LocalAddr())
+	if from := receive(t, server); from != "b:1" {
+		t.Fatalf("unexpected address %q", from)
+	} else if from := receive(t, peer); from != "b:2" {
+		t.Fatalf("expected a new address for another destination, got %q", from)
+	}
+	peer.WriteTo([]byte("hello"), Addr("b:1"))
+	if from := receive(t, b); from != "" {
+		t.Fatalf("expected the address given to the server to be closed to the peer, got %q", from)
+	}
+
+	b.Close()
+	if _, err := n.Listen("b:1"); err != nil {
+		t.Fatalf("expected the public addresses freed on close: %s", err)
+	}
+}
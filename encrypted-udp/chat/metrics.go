@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pings carry a timestamp from the clock of the sender, which the pong
+// echoes, so round trips are measured without the clocks agreeing.
+//
+// Round trips longer than MaxRTT are assumed to be bogus and ignored.
+const (
+	TimestampSize = 8
+	MaxRTT        = 10 * time.Second
+)
+
+var errInvalidTimestamp = errors.New("timestamp is malformed or from the future...")
+
+// Timestamps count from when the process started on the monotonic clock,
+// so they are unaffected by changes to the wall clock.
+var started = time.Now()
+
+// Prepares the body of a MessagePing holding the time now.
+func PingBody() []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(time.Since(started)))
+}
+
+// The round trip since the timestamp at the front of the body was taken.
+func RoundTrip(body []byte) (time.Duration, error) {
+	if len(body) < TimestampSize {
+		return 0, errInvalidTimestamp
+	}
+	rtt := time.Since(started) - time.Duration(binary.BigEndian.Uint64(body))
+	if rtt < 0 || rtt > MaxRTT {
+		return 0, errInvalidTimestamp
+	}
+	return rtt, nil
+}
+
+// Smooths round trip samples the way TCP does (_RFC 6298_), with a
+// moving average of the round trip and of how far each sample strays
+// from it, which is reported as the jitter.
+type Latency struct {
+	mu       sync.Mutex
+	smoothed time.Duration
+	variance time.Duration
+	last     time.Duration
+	samples  uint64
+}
+
+// Adds a round trip to the averages.
+func (l *Latency) Sample(rtt time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.samples == 0 {
+		l.smoothed, l.variance = rtt, rtt/2
+	} else {
+		delta := l.smoothed - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		l.variance += (delta - l.variance) / 4
+		l.smoothed += (rtt - l.smoothed) / 8
+	}
+	l.last = rtt
+	l.samples++
+}
+
+// The averages so far, along with the loss estimated from the sequence
+// numbers of the session.
+func (l *Latency) Metrics(replay ReplayStats) Metrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Metrics{
+		RTT:      l.smoothed,
+		Jitter:   l.variance,
+		Last:     l.last,
+		Samples:  l.samples,
+		Received: replay.Accepted,
+		Lost:     replay.Lost(),
+	}
+}
+
+// Forgets every sample, for use when a new session is established.
+func (l *Latency) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.smoothed, l.variance, l.last, l.samples = 0, 0, 0, 0
+}
+
+// The quality of a session as seen from one side, where loss is of the
+// datagrams sent to that side.
+type Metrics struct {
+	RTT      time.Duration
+	Jitter   time.Duration
+	Last     time.Duration
+	Samples  uint64
+	Received uint64
+	Lost     uint64
+}
+
+// The fraction of datagrams that were lost.
+func (m Metrics) Loss() float64 {
+	if m.Received+m.Lost == 0 {
+		return 0
+	}
+	return float64(m.Lost) / float64(m.Received+m.Lost)
+}
+
+func (m Metrics) String() string {
+	return fmt.Sprintf("rtt %s (last %s, jitter %s over %d pings), lost %d of %d (%.1f%%)",
+		m.RTT.Round(time.Microsecond), m.Last.Round(time.Microsecond), m.Jitter.Round(time.Microsecond), m.Samples,
+		m.Lost, m.Received+m.Lost, 100*m.Loss())
+}
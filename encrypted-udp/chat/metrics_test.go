@@ -0,0 +1,44 @@
+package chat
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestLatency(t *testing.T) {
+	var l Latency
+	for _, rtt := range []time.Duration{100, 100, 180, 100} {
+		l.Sample(rtt * time.Millisecond)
+	}
+	m := l.Metrics(ReplayStats{Accepted: 95, Highest: 100})
+	if m.Samples != 4 || m.Last != 100*time.Millisecond {
+		t.Fatalf("unexpected samples: %#v", m)
+	} else if m.RTT <= 100*time.Millisecond || m.RTT >= 110*time.Millisecond {
+		t.Fatalf("expected the spike to nudge the average, got %s", m.RTT)
+	} else if m.Jitter <= 0 {
+		t.Fatalf("expected jitter, got %s", m.Jitter)
+	} else if m.Lost != 5 || m.Loss() != 0.05 {
+		t.Fatalf("expected 5%% loss, got %d (%f)", m.Lost, m.Loss())
+	}
+
+	l.Reset()
+	if m := l.Metrics(ReplayStats{}); m.Samples != 0 || m.RTT != 0 || m.Loss() != 0 {
+		t.Fatalf("expected nothing after a reset, got %#v", m)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	body := PingBody()
+	time.Sleep(time.Millisecond)
+	if rtt, err := RoundTrip(body); err != nil || rtt < time.Millisecond {
+		t.Fatalf("unexpected round trip %s: %v", rtt, err)
+	}
+
+	future := binary.BigEndian.AppendUint64(nil, uint64(time.Since(started)+time.Hour))
+	for _, body := range [][]byte{nil, make([]byte, TimestampSize-1), future} {
+		if _, err := RoundTrip(body); err == nil {
+			t.Fatalf("expected %v to be refused...", body)
+		}
+	}
+}
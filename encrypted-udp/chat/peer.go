@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Peers try to reach each other directly this often, giving up and
+// relaying through the server after PunchAttempts.
+const (
+	PunchInterval = 100 * time.Millisecond
+	PunchAttempts = 20
+	MaxAddrSize   = 64
+)
+
+// Frames between peers are always sealed with this suite, since each
+// peer chose its own with the server.
+const PeerSuite = SuiteChaCha20Poly1305
+
+var errInvalidPeer = errors.New("peer introduction must hold a key, an identity and an address...")
+
+// Prepares the body of a MessagePeer, which asks the server to introduce
+// us to the identity with an empty address, and introduces the identity
+// to us with the address the server sees it at.
+//
+// The box key is fresh for each request, and is followed by the length
+// of the identity, the identity and finally the address.
+func PeerBody(pub *[KeySize]byte, identity, address string) []byte {
+	body := append(append([]byte(nil), pub[:]...), byte(len(identity)))
+	return append(append(body, identity...), address...)
+}
+
+// Separates the box key, identity and address of a MessagePeer.
+func PeerSplit(body []byte) (*[KeySize]byte, string, string, error) {
+	if len(body) < KeySize+1 {
+		return nil, "", "", errInvalidPeer
+	}
+	size := int(body[KeySize])
+	rest := body[KeySize+1:]
+	if size == 0 || size > MaxIdentitySize || len(rest) < size || len(rest)-size > MaxAddrSize {
+		return nil, "", "", errInvalidPeer
+	}
+	var pub [KeySize]byte
+	copy(pub[:], body)
+	return &pub, string(rest[:size]), string(rest[size:]), nil
+}
+
+// The directions we seal and open frames between peers in, decided by
+// whether our box key sorts before theirs, which both sides see the same
+// way round without another exchange, so a frame sent back to the peer
+// that sealed it does not open.
+//
+// Were we given our own key back, we would open neither direction we
+// seal in.
+func PeerDirections(ours, theirs *[KeySize]byte) (seal, open byte) {
+	if bytes.Compare(ours[:], theirs[:]) < 0 {
+		return DirectionFirstPeer, DirectionSecondPeer
+	}
+	return DirectionSecondPeer, DirectionFirstPeer
+}
+
+// Derives the connection id and key two peers seal their frames with
+// from the key precomputed from their box keys, so both arrive at the
+// same ones without another exchange.
+//
+// The top bit of the connection id is set, so it is never zero or the
+// signature and cannot be mistaken for a cleartext frame.
+func PeerKeys(shared [KeySize]byte) (uint32, [KeySize]byte) {
+	var b [ConnectionIDSize + KeySize]byte
+	io.ReadFull(hkdf.New(sha256.New, shared[:], nil, []byte("encrypted-udp peer")), b[:])
+	var key [KeySize]byte
+	copy(key[:], b[ConnectionIDSize:])
+	return binary.BigEndian.Uint32(b[:]) | 1<<31, key
+}
@@ -0,0 +1,46 @@
+package chat
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestPeer(t *testing.T) {
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	key, identity, address, err := PeerSplit(PeerBody(pub, "alice", "10.0.0.1:4000"))
+	if err != nil || *key != *pub || identity != "alice" || address != "10.0.0.1:4000" {
+		t.Fatalf("unexpected introduction: %q %q %v", identity, address, err)
+	}
+	if _, _, address, err := PeerSplit(PeerBody(pub, "alice", "")); err != nil || address != "" {
+		t.Fatalf("expected a request without an address, got %q %v", address, err)
+	}
+
+	for _, body := range [][]byte{nil, make([]byte, KeySize), PeerBody(pub, "", "x"), PeerBody(pub, "alice", string(make([]byte, MaxAddrSize+1)))} {
+		if _, _, _, err := PeerSplit(body); err == nil {
+			t.Fatalf("expected %v to fail...", body)
+		}
+	}
+
+	// both peers derive the same keys from their side of the exchange
+	aPub, aPriv, _ := box.GenerateKey(rand.Reader)
+	bPub, bPriv, _ := box.GenerateKey(rand.Reader)
+	var aShared, bShared [KeySize]byte
+	box.Precompute(&aShared, bPub, aPriv)
+	box.Precompute(&bShared, aPub, bPriv)
+	aID, aKey := PeerKeys(aShared)
+	bID, bKey := PeerKeys(bShared)
+	if aID != bID || aKey != bKey || !ValidConnectionID(aID) {
+		t.Fatalf("expected matching peer keys, got %d and %d", aID, bID)
+	}
+
+	// each opens what the other seals, but not its own
+	aSeal, aOpen := PeerDirections(aPub, bPub)
+	bSeal, bOpen := PeerDirections(bPub, aPub)
+	if aSeal != bOpen || bSeal != aOpen || aSeal == aOpen {
+		t.Fatalf("expected opposite directions, got %d/%d and %d/%d", aSeal, aOpen, bSeal, bOpen)
+	} else if seal, open := PeerDirections(aPub, aPub); seal == open {
+		t.Fatalf("expected our own key not to open what we seal, got %d both ways", seal)
+	}
+}
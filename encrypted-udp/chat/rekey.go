@@ -0,0 +1,174 @@
+package chat
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Sessions rotate keys after sealing this many messages or after this
+// much time, whichever comes first, unless configured otherwise.
+const (
+	DefaultRekeyMessages = 1 << 16
+	DefaultRekeyInterval = 10 * time.Minute
+	EpochSize            = 4
+)
+
+var errInvalidRekey = errors.New("rekey message must contain an epoch...")
+
+// Derives the key for the following epoch from the current one, so each
+// side can ratchet forward independently and old keys are forgotten.
+func Ratchet(key [KeySize]byte) [KeySize]byte {
+	var next [KeySize]byte
+	io.ReadFull(hkdf.New(sha256.New, key[:], nil, []byte("encrypted-udp rekey")), next[:])
+	return next
+}
+
+// The keys of a session, which move forward one epoch at a time, along
+// with the sequence numbers of the messages sealed with them.
+//
+// Either side may rotate by sending a MessageRekey with the new epoch
+// sealed under the old key, after which it seals with the new key.
+// Sequence numbers continue across epochs, so the ReplayWindow of the
+// peer is unaffected.
+//
+// The previous key is kept so messages that were in flight during the
+// rotation still open, and the next key is tried so messages that
+// overtake the rekey notice are not dropped either.
+//
+// Every key is used with the suite chosen in the handshake, sealing
+// frames for the direction they are sent in and opening only those sent
+// the other way.
+type KeyRing struct {
+	mu       sync.Mutex
+	suite    Suite
+	seal     byte
+	open     byte
+	epoch    uint32
+	key      [KeySize]byte
+	current  cipher.AEAD
+	previous cipher.AEAD
+	nextKey  [KeySize]byte
+	next     cipher.AEAD
+	seq      uint64
+	sealed   uint64
+	since    time.Time
+}
+
+// Starts the ring at epoch zero with the suite and key from the handshake,
+// sealing in one direction and opening the other, such as a client that
+// seals DirectionToServer and opens DirectionToClient.
+func NewKeyRing(suite Suite, key [KeySize]byte, seal, open byte) *KeyRing {
+	k := &KeyRing{suite: suite, seal: seal, open: open, key: key, current: suite.AEAD(&key), nextKey: Ratchet(key), since: time.Now()}
+	k.next = suite.AEAD(&k.nextKey)
+	return k
+}
+
+// The suite every key is used with.
+func (k *KeyRing) Suite() Suite {
+	return k.suite
+}
+
+// The epoch of the key currently used to seal.
+func (k *KeyRing) Epoch() uint32 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.epoch
+}
+
+// Seals a frame with the current key under the next sequence number.
+func (k *KeyRing) Seal(id uint32, kind byte, body []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.seq++
+	k.sealed++
+	return SealFrame(k.current, k.seal, id, k.seq, kind, body)
+}
+
+// Opens a frame with the current, previous or next key, moving forward
+// if the peer has already rotated.
+func (k *KeyRing) Open(frame []byte) (uint64, byte, []byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	seq, kind, body, err := OpenFrame(k.current, k.open, frame)
+	if err == nil {
+		return seq, kind, body, nil
+	}
+	if k.previous != nil {
+		if seq, kind, body, err := OpenFrame(k.previous, k.open, frame); err == nil {
+			return seq, kind, body, nil
+		}
+	}
+	if seq, kind, body, err := OpenFrame(k.next, k.open, frame); err == nil {
+		k.rotate()
+		return seq, kind, body, nil
+	}
+	return 0, 0, nil, err
+}
+
+// Moves to the next epoch if the current key has sealed enough messages
+// or lived long enough, returning the MessageRekey frame sealed under the
+// old key that must be sent to the peer, or nil when no rotation is due.
+//
+// A limit of zero disables that condition.
+func (k *KeyRing) RekeyDue(id uint32, messages uint64, interval time.Duration) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if (messages > 0 && k.sealed >= messages) || (interval > 0 && time.Since(k.since) >= interval) {
+		return k.rekey(id)
+	}
+	return nil, nil
+}
+
+// Moves to the next epoch now, returning the MessageRekey frame.
+func (k *KeyRing) Rekey(id uint32) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.rekey(id)
+}
+
+// The notice is sealed and the key rotated under one lock, so nothing
+// else can be sealed between them.
+func (k *KeyRing) rekey(id uint32) ([]byte, error) {
+	body := make([]byte, EpochSize)
+	binary.BigEndian.PutUint32(body, k.epoch+1)
+	k.seq++
+	frame, err := SealFrame(k.current, k.seal, id, k.seq, MessageRekey, body)
+	if err != nil {
+		return nil, err
+	}
+	k.rotate()
+	return frame, nil
+}
+
+// Follows a MessageRekey from the peer, ignoring epochs we have already
+// reached, which happens when both sides rotate at once or the peer
+// overtook its own notice.
+func (k *KeyRing) Follow(body []byte) error {
+	if len(body) != EpochSize {
+		return errInvalidRekey
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if binary.BigEndian.Uint32(body) == k.epoch+1 {
+		k.rotate()
+	}
+	return nil
+}
+
+func (k *KeyRing) rotate() {
+	k.previous = k.current
+	k.key, k.current = k.nextKey, k.next
+	k.nextKey = Ratchet(k.key)
+	k.next = k.suite.AEAD(&k.nextKey)
+	k.epoch++
+	k.sealed = 0
+	k.since = time.Now()
+}
@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func rings(t *testing.T, suite Suite) (*KeyRing, *KeyRing) {
+	var key [KeySize]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	return NewKeyRing(suite, key, DirectionToServer, DirectionToClient), NewKeyRing(suite, key, DirectionToClient, DirectionToServer)
+}
+
+func TestRekeyInFlight(t *testing.T) {
+	for _, suite := range Suites {
+		t.Run(suite.String(), func(t *testing.T) {
+			a, b := rings(t, suite)
+
+			before, _ := a.Seal(1, MessageChat, []byte("before"))
+			notice, err := a.Rekey(1)
+			if err != nil {
+				t.Fatalf("failed to rekey: %s", err)
+			}
+			after, _ := a.Seal(1, MessageChat, []byte("after"))
+
+			// the new key overtakes both the notice and an in-flight message
+			for i, frame := range [][]byte{after, before, notice} {
+				seq, kind, body, err := b.Open(frame)
+				if err != nil {
+					t.Fatalf("frame %d failed to open: %s", i, err)
+				} else if kind == MessageRekey {
+					if err := b.Follow(body); err != nil {
+						t.Fatalf("failed to follow rekey: %s", err)
+					}
+				} else if seq == 0 {
+					t.Fatalf("frame %d has no sequence number", i)
+				}
+			}
+
+			if a.Epoch() != 1 || b.Epoch() != 1 {
+				t.Fatalf("expected both rings at epoch 1, got %d and %d", a.Epoch(), b.Epoch())
+			}
+
+			// and both directions now use the new key
+			reply, _ := b.Seal(1, MessageChat, []byte("reply"))
+			if _, _, body, err := a.Open(reply); err != nil || string(body) != "reply" {
+				t.Fatalf("failed to open reply: %s", err)
+			}
+		})
+	}
+}
+
+func TestRekeySimultaneous(t *testing.T) {
+	for _, suite := range Suites {
+		t.Run(suite.String(), func(t *testing.T) {
+			a, b := rings(t, suite)
+
+			fromA, _ := a.Rekey(1)
+			fromB, _ := b.Rekey(1)
+			for _, c := range []struct {
+				ring  *KeyRing
+				frame []byte
+			}{{b, fromA}, {a, fromB}} {
+				_, kind, body, err := c.ring.Open(c.frame)
+				if err != nil || kind != MessageRekey {
+					t.Fatalf("failed to open rekey: %s", err)
+				} else if err := c.ring.Follow(body); err != nil {
+					t.Fatalf("failed to follow rekey: %s", err)
+				}
+			}
+
+			if a.Epoch() != 1 || b.Epoch() != 1 {
+				t.Fatalf("expected both rings at epoch 1, got %d and %d", a.Epoch(), b.Epoch())
+			}
+		})
+	}
+}
+
+func TestRekeyDue(t *testing.T) {
+	for _, suite := range Suites {
+		t.Run(suite.String(), func(t *testing.T) {
+			a, b := rings(t, suite)
+
+			for i := 0; i < 7; i++ {
+				data, err := a.Seal(1, MessageChat, []byte("hello"))
+				if err != nil {
+					t.Fatalf("failed to seal: %s", err)
+				} else if _, _, _, err := b.Open(data); err != nil {
+					t.Fatalf("message %d failed to open: %s", i, err)
+				}
+				if data, err := a.RekeyDue(1, 3, 0); err != nil {
+					t.Fatalf("failed to rekey: %s", err)
+				} else if data != nil {
+					_, _, body, err := b.Open(data)
+					if err != nil {
+						t.Fatalf("rekey failed to open: %s", err)
+					}
+					b.Follow(body)
+				}
+			}
+
+			if a.Epoch() != 2 || b.Epoch() != 2 {
+				t.Fatalf("expected both rings at epoch 2, got %d and %d", a.Epoch(), b.Epoch())
+			}
+		})
+	}
+}
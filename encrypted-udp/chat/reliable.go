@@ -0,0 +1,196 @@
+package chat
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reliable messages carry an id and the type of the message they wrap,
+// and are retransmitted with exponential backoff until acknowledged.
+const (
+	MessageIDSize          = 8
+	ReliableOverhead       = MessageIDSize + 1
+	MaxReliableMessageSize = MaxMessageSize - ReliableOverhead
+	RetransmitTimeout      = 250 * time.Millisecond
+	MaxRetransmitTimeout   = 4 * time.Second
+	MaxRetransmits         = 8
+	ReliableWindow         = 64
+)
+
+var errReliableWindowFull = errors.New("too many reliable messages awaiting acknowledgement...")
+var errReliableKind = errors.New("acknowledgements and reliable messages cannot be wrapped...")
+var errInvalidReliable = errors.New("reliable message is too short...")
+
+// A message delivered in order by a Reliable channel.
+type Delivery struct {
+	Kind byte
+	Body []byte
+}
+
+type outgoing struct {
+	body     []byte
+	attempts int
+	timeout  time.Duration
+	timer    *time.Timer
+}
+
+// An optional reliable, ordered channel on top of the sealed frames of a
+// session, while unreliable messages continue to be sent as they are.
+//
+// Each message is wrapped in a MessageReliable with an increasing id, and
+// the peer answers every one with a MessageAck, including duplicates in
+// case the first acknowledgement was lost.  Messages arriving early are
+// held until the gap is filled, so the application sees them in order.
+//
+// The send function seals and writes a frame of the given type, and is
+// called from timers as well as from Send.
+type Reliable struct {
+	Timeout time.Duration
+	OnFail  func(Delivery)
+
+	send     func(kind byte, body []byte) error
+	mu       sync.Mutex
+	closed   bool
+	next     uint64
+	pending  map[uint64]*outgoing
+	expect   uint64
+	buffered map[uint64]Delivery
+}
+
+// Prepares a channel that writes its frames with the send function.
+func NewReliable(send func(kind byte, body []byte) error) *Reliable {
+	return &Reliable{
+		Timeout:  RetransmitTimeout,
+		send:     send,
+		next:     1,
+		expect:   1,
+		pending:  make(map[uint64]*outgoing),
+		buffered: make(map[uint64]Delivery),
+	}
+}
+
+// Sends the message reliably, retransmitting until it is acknowledged or
+// MaxRetransmits is reached, at which point OnFail is called with it.
+func (r *Reliable) Send(kind byte, body []byte) error {
+	if kind == MessageReliable || kind == MessageAck {
+		return errReliableKind
+	}
+
+	r.mu.Lock()
+	if len(r.pending) >= ReliableWindow {
+		r.mu.Unlock()
+		return errReliableWindowFull
+	}
+	id := r.next
+	r.next++
+	data := make([]byte, MessageIDSize, ReliableOverhead+len(body))
+	binary.BigEndian.PutUint64(data, id)
+	data = append(append(data, kind), body...)
+	o := &outgoing{body: data, timeout: r.Timeout}
+	r.pending[id] = o
+	o.timer = time.AfterFunc(o.timeout, func() { r.retransmit(id) })
+	r.mu.Unlock()
+
+	return r.send(MessageReliable, data)
+}
+
+func (r *Reliable) retransmit(id uint64) {
+	r.mu.Lock()
+	o, ok := r.pending[id]
+	if !ok || r.closed {
+		r.mu.Unlock()
+		return
+	} else if o.attempts >= MaxRetransmits {
+		delete(r.pending, id)
+		r.mu.Unlock()
+		if r.OnFail != nil {
+			r.OnFail(Delivery{Kind: o.body[MessageIDSize], Body: o.body[ReliableOverhead:]})
+		}
+		return
+	}
+	o.attempts++
+	if o.timeout *= 2; o.timeout > MaxRetransmitTimeout {
+		o.timeout = MaxRetransmitTimeout
+	}
+	o.timer.Reset(o.timeout)
+	r.mu.Unlock()
+
+	r.send(MessageReliable, o.body)
+}
+
+// Handles a MessageAck from the peer.
+func (r *Reliable) Ack(body []byte) {
+	if len(body) != MessageIDSize {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := binary.BigEndian.Uint64(body)
+	if o, ok := r.pending[id]; ok {
+		o.timer.Stop()
+		delete(r.pending, id)
+	}
+}
+
+// Handles a MessageReliable from the peer, acknowledging it and returning
+// the messages that are now ready in order, which may be none.
+func (r *Reliable) Receive(body []byte) ([]Delivery, error) {
+	if len(body) < ReliableOverhead {
+		return nil, errInvalidReliable
+	}
+	id := binary.BigEndian.Uint64(body)
+	kind := body[MessageIDSize]
+
+	r.mu.Lock()
+	if id >= r.expect+ReliableWindow {
+		// too far ahead to hold, the peer will retransmit it later
+		r.mu.Unlock()
+		return nil, nil
+	}
+	var ready []Delivery
+	if _, ok := r.buffered[id]; !ok && id >= r.expect {
+		r.buffered[id] = Delivery{Kind: kind, Body: append([]byte(nil), body[ReliableOverhead:]...)}
+	}
+	for d, ok := r.buffered[r.expect]; ok; d, ok = r.buffered[r.expect] {
+		if d.Kind != MessageReliable && d.Kind != MessageAck {
+			ready = append(ready, d)
+		}
+		delete(r.buffered, r.expect)
+		r.expect++
+	}
+	r.mu.Unlock()
+
+	return ready, r.send(MessageAck, body[:MessageIDSize])
+}
+
+// The messages sent but not yet acknowledged, in order, which can be sent
+// again over a new session.
+func (r *Reliable) Pending() []Delivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]uint64, 0, len(r.pending))
+	for id := range r.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	pending := make([]Delivery, 0, len(ids))
+	for _, id := range ids {
+		o := r.pending[id]
+		pending = append(pending, Delivery{Kind: o.body[MessageIDSize], Body: o.body[ReliableOverhead:]})
+	}
+	return pending
+}
+
+// Stops all retransmissions.
+func (r *Reliable) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, o := range r.pending {
+		o.timer.Stop()
+	}
+}
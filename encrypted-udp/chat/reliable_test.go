@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Connects two reliable channels over a link that drops every third
+// frame and delays every fourth, so frames are both lost and reordered.
+func link(t *testing.T) (*Reliable, *Reliable, chan Delivery) {
+	var a, b *Reliable
+	var mu sync.Mutex
+	var n int
+	delivered := make(chan Delivery, 100)
+
+	deliver := func(to *Reliable, kind byte, body []byte) {
+		switch kind {
+		case MessageAck:
+			to.Ack(body)
+		case MessageReliable:
+			ready, err := to.Receive(body)
+			if err != nil {
+				t.Errorf("failed to receive: %s", err)
+			}
+			if to == b {
+				for _, d := range ready {
+					delivered <- d
+				}
+			}
+		}
+	}
+	network := func(to **Reliable) func(byte, []byte) error {
+		return func(kind byte, body []byte) error {
+			body = append([]byte(nil), body...)
+			mu.Lock()
+			n++
+			i := n
+			mu.Unlock()
+			if i%3 == 0 {
+				return nil
+			} else if i%4 == 0 {
+				time.AfterFunc(10*time.Millisecond, func() { deliver(*to, kind, body) })
+				return nil
+			}
+			go deliver(*to, kind, body)
+			return nil
+		}
+	}
+
+	a = NewReliable(network(&b))
+	b = NewReliable(network(&a))
+	a.Timeout, b.Timeout = 5*time.Millisecond, 5*time.Millisecond
+	t.Cleanup(a.Close)
+	t.Cleanup(b.Close)
+	return a, b, delivered
+}
+
+func TestReliableInOrder(t *testing.T) {
+	a, _, delivered := link(t)
+
+	for i := 0; i < 50; i++ {
+		if err := a.Send(MessageChat, []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("failed to send %d: %s", i, err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		select {
+		case d := <-delivered:
+			if d.Kind != MessageChat || string(d.Body) != fmt.Sprintf("%d", i) {
+				t.Fatalf("expected message %d, got %d %s", i, d.Kind, d.Body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	select {
+	case d := <-delivered:
+		t.Fatalf("unexpected duplicate delivery: %s", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.Pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(a.Pending()); n > 0 {
+		t.Fatalf("expected every message to be acknowledged, %d pending", n)
+	}
+}
+
+func TestReliableGiveUp(t *testing.T) {
+	failed := make(chan Delivery, 1)
+	r := NewReliable(func(byte, []byte) error { return nil })
+	r.Timeout = time.Millisecond
+	r.OnFail = func(d Delivery) { failed <- d }
+	defer r.Close()
+
+	if err := r.Send(MessageChat, []byte("lost")); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	select {
+	case d := <-failed:
+		if string(d.Body) != "lost" {
+			t.Fatalf("unexpected failed message: %s", d.Body)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("expected the message to be given up on...")
+	}
+
+	if err := r.Send(MessageAck, nil); err == nil {
+		t.Fatal("expected acknowledgements to be refused...")
+	}
+}
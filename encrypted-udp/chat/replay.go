@@ -0,0 +1,114 @@
+// Package chat holds the pieces of the encrypted udp chat protocol that
+// are shared by the client and the server.
+package chat
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Every sealed payload is prefixed with a per-session sequence number,
+// so a captured datagram cannot be replayed even though it decrypts.
+const (
+	SequenceSize = 8
+	WindowSize   = 64
+)
+
+var errNoSequence = errors.New("payload is too short to contain a sequence number...")
+
+// Prefixes the message with the big endian sequence number.
+func SequencePut(seq uint64, message []byte) []byte {
+	data := make([]byte, SequenceSize, SequenceSize+len(message))
+	binary.BigEndian.PutUint64(data, seq)
+	return append(data, message...)
+}
+
+// Separates the sequence number from the decrypted payload.
+func SequenceSplit(payload []byte) (uint64, []byte, error) {
+	if len(payload) < SequenceSize {
+		return 0, nil, errNoSequence
+	}
+	return binary.BigEndian.Uint64(payload[:SequenceSize]), payload[SequenceSize:], nil
+}
+
+// Counters describing what a ReplayWindow has seen, useful for logging,
+// along with the highest sequence number accepted.
+type ReplayStats struct {
+	Accepted  uint64
+	Duplicate uint64
+	Stale     uint64
+	Highest   uint64
+}
+
+// The sequence numbers below the highest that never arrived, which is an
+// estimate of how many datagrams were lost since some may still be on
+// their way, and those sent after the highest are not counted at all.
+func (s ReplayStats) Lost() uint64 {
+	if s.Highest < s.Accepted {
+		return 0
+	}
+	return s.Highest - s.Accepted
+}
+
+// A sliding anti-replay window like the one used by IPsec and DTLS.
+//
+// The highest accepted sequence number is tracked along with a bitmap
+// of the WindowSize numbers below it, so packets may arrive out of order
+// but never twice, and anything older than the window is dropped.
+//
+// Sequence numbers start at 1, and only authenticated payloads should
+// be checked, otherwise a forged number could advance the window.
+type ReplayWindow struct {
+	mu     sync.Mutex
+	top    uint64
+	bitmap uint64
+	stats  ReplayStats
+}
+
+// Reports whether the sequence number is new, recording it if so.
+func (w *ReplayWindow) Check(seq uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq == 0 {
+		w.stats.Stale++
+		return false
+	} else if seq > w.top {
+		if shift := seq - w.top; shift < WindowSize {
+			w.bitmap = w.bitmap<<shift | 1
+		} else {
+			w.bitmap = 1
+		}
+		w.top, w.stats.Highest = seq, seq
+		w.stats.Accepted++
+		return true
+	}
+
+	offset := w.top - seq
+	if offset >= WindowSize {
+		w.stats.Stale++
+		return false
+	} else if w.bitmap&(1<<offset) != 0 {
+		w.stats.Duplicate++
+		return false
+	}
+	w.bitmap |= 1 << offset
+	w.stats.Accepted++
+	return true
+}
+
+// A copy of the counters.
+func (w *ReplayWindow) Stats() ReplayStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+// Forget all sequence numbers and counters, for use when a new session
+// is established.
+func (w *ReplayWindow) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.top, w.bitmap, w.stats = 0, 0, ReplayStats{}
+}
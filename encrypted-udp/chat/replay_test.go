@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSequence(t *testing.T) {
+	message := []byte("hello")
+	seq, data, err := SequenceSplit(SequencePut(42, message))
+	if err != nil {
+		t.Fatalf("failed to split sequence: %s", err)
+	} else if seq != 42 || !bytes.Equal(data, message) {
+		t.Fatalf("expected 42 and %s, got %d and %s", message, seq, data)
+	}
+
+	if _, _, err := SequenceSplit(make([]byte, SequenceSize-1)); err == nil {
+		t.Fatal("expected short payload to fail...")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w ReplayWindow
+
+	// in order, reordered, duplicated, and stale packets
+	cases := []struct {
+		seq    uint64
+		accept bool
+	}{
+		{0, false},
+		{1, true},
+		{2, true},
+		{2, false},
+		{5, true},
+		{4, true},
+		{3, true},
+		{4, false},
+		{1, false},
+		{100, true},
+		{36, false},
+		{37, true},
+		{37, false},
+		{99, true},
+		{1000, true},
+		{100, false},
+	}
+	for i, c := range cases {
+		if w.Check(c.seq) != c.accept {
+			t.Fatalf("case %d: expected sequence %d accept to be %t", i, c.seq, c.accept)
+		}
+	}
+
+	stats := w.Stats()
+	if stats.Accepted != 9 || stats.Duplicate != 4 || stats.Stale != 3 {
+		t.Fatalf("unexpected counters: %#v", stats)
+	} else if stats.Highest != 1000 || stats.Lost() != 991 {
+		t.Fatalf("expected 991 lost below 1000, got %d below %d", stats.Lost(), stats.Highest)
+	}
+
+	w.Reset()
+	if !w.Check(1) {
+		t.Fatal("expected reset window to accept sequence 1...")
+	}
+}
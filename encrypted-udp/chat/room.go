@@ -0,0 +1,55 @@
+package chat
+
+import (
+	"errors"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Every session starts in the default room, and chat messages are only
+// relayed to the members of the room the sender is in.
+const (
+	DefaultRoom = "lobby"
+	MaxRoomSize = MaxIdentitySize
+)
+
+var errInvalidRoom = errors.New("room names must be between 1 and 20 bytes...")
+var errInvalidIdentity = errors.New("usernames must be between 1 and 20 bytes without spaces or anything unprintable...")
+var errInvalidDirect = errors.New("direct message must name its recipient...")
+
+// Reports why a room name cannot be used, if it cannot.
+func ValidRoom(room string) error {
+	if len(room) == 0 || len(room) > MaxRoomSize {
+		return errInvalidRoom
+	}
+	return nil
+}
+
+// Reports why an identity cannot be used, if it cannot, since it is shown
+// to everyone, bound in the registry, and addressed by /msg, which splits
+// on spaces.
+func ValidIdentity(identity string) error {
+	if len(identity) == 0 || len(identity) > MaxIdentitySize || !utf8.ValidString(identity) {
+		return errInvalidIdentity
+	}
+	for _, r := range identity {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return errInvalidIdentity
+		}
+	}
+	return nil
+}
+
+// Prepares the body of a MessageDirect to the named recipient, which is
+// prefixed with the length of the name.
+func DirectBody(to string, message []byte) []byte {
+	return append(append([]byte{byte(len(to))}, to...), message...)
+}
+
+// Separates the recipient of a MessageDirect from the message.
+func DirectSplit(body []byte) (string, []byte, error) {
+	if len(body) < 1 || body[0] == 0 || int(body[0]) > MaxIdentitySize || len(body) < 1+int(body[0]) {
+		return "", nil, errInvalidDirect
+	}
+	return string(body[1 : 1+body[0]]), body[1+body[0]:], nil
+}
@@ -0,0 +1,28 @@
+package chat
+
+import "testing"
+
+func TestDirect(t *testing.T) {
+	to, message, err := DirectSplit(DirectBody("alice", []byte("hello")))
+	if err != nil || to != "alice" || string(message) != "hello" {
+		t.Fatalf("unexpected direct message: %q %q %v", to, message, err)
+	}
+
+	for _, body := range [][]byte{nil, {0}, {5, 'a'}, append([]byte{MaxIdentitySize + 1}, make([]byte, 30)...)} {
+		if _, _, err := DirectSplit(body); err == nil {
+			t.Fatalf("expected %v to fail...", body)
+		}
+	}
+
+	if ValidRoom("") == nil || ValidRoom(string(make([]byte, MaxRoomSize+1))) == nil || ValidRoom(DefaultRoom) != nil {
+		t.Fatal("unexpected room validation...")
+	}
+	for _, identity := range []string{"", "a b", "bob\x00", "\x1b[2Jbob", "\xff", string(make([]byte, MaxIdentitySize+1))} {
+		if ValidIdentity(identity) == nil {
+			t.Fatalf("expected %q to be refused...", identity)
+		}
+	}
+	if ValidIdentity("alice") != nil || ValidIdentity("émilie") != nil {
+		t.Fatal("expected printable identities to be accepted...")
+	}
+}
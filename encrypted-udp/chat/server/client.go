@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+// The client from the perspective of the server.
+//
+// Sessions are found by the connection id at the front of each sealed
+// frame, and the address follows whatever last sent an authenticated one.
+//
+// Each session holds the rotating keys which also number the messages we
+// send, and tracks the numbers received to drop replayed datagrams, as
+// well as when the last one was received so idle sessions can be evicted.
+//
+// Messages sent over the reliable channel are retransmitted until the
+// client acknowledges them, and fragments of large messages are held
+// until the rest arrive.  Those received reliably are dispatched under
+// the delivering lock, so they stay in order across workers.
+//
+// A session is confirmed once the client proves it completed the
+// handshake by sending anything sealed, after which its identity can no
+// longer be claimed by another handshake.  The room is guarded by the
+// servers room lock.
+//
+// The key is the identity key that signed the handshake, if any.
+//
+// Round trips are measured from the pongs the client returns for ours.
+//
+// The version and capabilities are those chosen in the handshake, and
+// nothing outside them is sent to the client.
+type Client struct {
+	a         atomic.Value
+	id        uint32
+	key       ed25519.PublicKey
+	keys      *chat.KeyRing
+	reliable  *chat.Reliable
+	identity  string
+	room      string
+	seen      int64
+	confirmed int32
+	window    chat.ReplayWindow
+	fragments chat.Reassembler
+	latency   chat.Latency
+
+	version      byte
+	capabilities chat.Capability
+
+	delivering sync.Mutex
+}
+
+// Records that an authenticated message was just received.
+func (c *Client) Touch() {
+	atomic.StoreInt64(&c.seen, time.Now().UnixNano())
+}
+
+// When the last authenticated message was received.
+func (c *Client) Seen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.seen))
+}
+
+// The address the client last sent an authenticated message from.
+func (c *Client) Addr() net.Addr {
+	return c.a.Load().(address).Addr
+}
+
+// @note: the address is wrapped since an atomic.Value only holds one
+// concrete type, and packet connections may return different ones.
+func (c *Client) SetAddr(addr net.Addr) {
+	c.a.Store(address{addr})
+}
+
+type address struct {
+	net.Addr
+}
+
+// Records that the client completed the handshake, reporting whether it
+// had not before.
+func (c *Client) Confirm() bool {
+	return atomic.CompareAndSwapInt32(&c.confirmed, 0, 1)
+}
+
+// Whether the client has sent anything since the handshake.
+func (c *Client) Confirmed() bool {
+	return atomic.LoadInt32(&c.confirmed) == 1
+}
+
+// Reports whether the client and the server agreed on the capabilities.
+func (c *Client) Has(capabilities chat.Capability) bool {
+	return c.capabilities.Has(capabilities)
+}
+
+// The round trips to the client and the loss of datagrams from it.
+func (c *Client) Metrics() chat.Metrics {
+	return c.latency.Metrics(c.window.Stats())
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+// Cookies are issued for the current period and accepted until the end of
+// the next, so one is always good for at least this long.
+const CookieInterval = 30 * time.Second
+
+// The cookie for an address during the period containing now, which only
+// the holder of the cookie secret can compute, so the server can check
+// one came back from the address it was sent to without remembering it.
+func (s *Server) cookie(addr net.Addr, now time.Time) []byte {
+	var period [8]byte
+	binary.BigEndian.PutUint64(period[:], uint64(now.Unix()/int64(CookieInterval/time.Second)))
+	mac := hmac.New(sha256.New, s.cookies)
+	mac.Write(period[:])
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:chat.CookieSize]
+}
+
+// Reports whether the cookie was issued to the address this period or the
+// one before it.
+func (s *Server) validCookie(addr net.Addr, cookie []byte) bool {
+	now := time.Now()
+	return len(cookie) == chat.CookieSize &&
+		(hmac.Equal(cookie, s.cookie(addr, now)) || hmac.Equal(cookie, s.cookie(addr, now.Add(-CookieInterval))))
+}
+
+// Challenges the address to prove it can receive from us by repeating
+// the cookie in its handshake, like the HelloVerifyRequest of DTLS.
+//
+// The challenge is smaller than any handshake, so it cannot be used to
+// amplify traffic towards a spoofed address.
+func (s *Server) Retry(addr net.Addr) {
+	s.c.WriteTo(chat.ClearFrame(chat.MessageRetry, s.cookie(addr, time.Now())), addr)
+}
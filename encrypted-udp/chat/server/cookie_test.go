@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A handshake without the cookie for its address is challenged with a
+// retry smaller than itself, and only the cookie sent to that address
+// completes it.
+func TestCookie(t *testing.T) {
+	s := newServer(t)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer c.Close()
+	addr := c.LocalAddr().(*net.UDPAddr)
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	shake := chat.HandshakeBody(pub, chat.Suites, nil, "")
+	s.HandshakeReceive(addr, shake)
+	retry := read(t, c)
+	if !chat.Clear(retry) || retry[len(chat.Signature)] != chat.MessageRetry {
+		t.Fatalf("expected a retry, got %v", retry)
+	} else if len(retry) >= len(chat.ClearFrame(chat.MessageHello, shake)) {
+		t.Fatalf("expected the retry to be smaller than the handshake, got %d bytes", len(retry))
+	}
+	cookie := retry[len(chat.Signature)+1:]
+
+	other := &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1}
+	if s.validCookie(other, cookie) {
+		t.Fatal("expected the cookie to be bound to the address...")
+	} else if !s.validCookie(addr, s.cookie(addr, time.Now().Add(-CookieInterval))) {
+		t.Fatal("expected the cookie from the last period to be accepted...")
+	} else if s.validCookie(addr, s.cookie(addr, time.Now().Add(-2*CookieInterval))) {
+		t.Fatal("expected an expired cookie to be refused...")
+	}
+
+	bad := append([]byte(nil), cookie...)
+	bad[0]++
+	s.HandshakeReceive(addr, chat.HandshakeBody(pub, chat.Suites, bad, "bob"))
+	if reply := read(t, c); reply[len(chat.Signature)] != chat.MessageRetry {
+		t.Fatalf("expected a bad cookie to be challenged again, got %v", reply)
+	}
+
+	s.HandshakeReceive(addr, chat.HandshakeBody(pub, chat.Suites, cookie, "bob"))
+	if _, _, _, err := open(read(t, c), priv); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Challenges != 2 || stats.BadCookies != 1 {
+		t.Fatalf("unexpected counters: %#v", stats)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Each room keeps this many of its most recent messages, and this many
+// rooms are kept, unless the history is loaded with others, and clients
+// are sent this many of them when they arrive unless Server.Replay is set.
+const (
+	DefaultHistorySize  = 100
+	DefaultHistoryRooms = 1000
+	DefaultReplay       = 20
+)
+
+// A message relayed to a room, as it is kept in the history.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room"`
+	Sender  string    `json:"sender"`
+	Message []byte    `json:"message"`
+}
+
+// The most recent messages relayed to each room.
+//
+// With a path every message is also appended to the file as a line of
+// JSON, which is read back and compacted to the messages still kept each
+// time it is loaded, so the file only grows while the server runs.
+// Without one the history only lasts as long as the server.
+//
+// Rooms are kept after their last member leaves, since that is when the
+// history is most useful, but any client can join as many rooms as it
+// likes, so once there are too many the room least recently written to
+// or replayed is forgotten to make way for a new one.
+type History struct {
+	path     string
+	size     int
+	maxRooms int
+	mu       sync.Mutex
+	f        *os.File
+	rooms    map[string][]Entry
+	used     map[string]uint64
+	uses     uint64
+}
+
+// Loads the history file, which may not exist yet, keeping the last size
+// messages of each of the most recently used rooms.
+//
+// Lines that cannot be read, such as one cut short by a crash, are
+// skipped.
+func LoadHistory(path string, size, rooms int) (*History, error) {
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	if rooms <= 0 {
+		rooms = DefaultHistoryRooms
+	}
+	h := &History{path: path, size: size, maxRooms: rooms, rooms: make(map[string][]Entry), used: make(map[string]uint64)}
+	if path == "" {
+		return h, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	} else if err == nil {
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			var e Entry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				log.Printf("skipping history %s:%d: %s\n", path, n, err)
+				continue
+			}
+			h.keep(e)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := h.compact(); err != nil {
+		return nil, err
+	}
+	h.f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Rewrites the file with only the messages kept, replacing it at once so
+// a crash leaves either the old file or the new one.
+//
+// @note: rooms are written least recently used first, so loading the
+// file again leaves them in the same order.
+func (h *History) compact() error {
+	f, err := os.CreateTemp(filepath.Dir(h.path), ".history")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	order := make([]string, 0, len(h.rooms))
+	for room := range h.rooms {
+		order = append(order, room)
+	}
+	sort.Slice(order, func(i, j int) bool { return h.used[order[i]] < h.used[order[j]] })
+	for _, room := range order {
+		for _, e := range h.rooms[room] {
+			if err := encoder.Encode(e); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), h.path)
+}
+
+// Records a message relayed to a room, dropping the oldest in the room
+// once it holds more than the size, and the least recently used room once
+// there are more than the rooms it was loaded with.
+func (h *History) Add(e Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keep(e)
+	if h.f == nil {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = h.f.Write(append(b, '\n'))
+	return err
+}
+
+func (h *History) keep(e Entry) {
+	if _, ok := h.rooms[e.Room]; !ok && len(h.rooms) >= h.maxRooms {
+		h.evict()
+	}
+	entries := append(h.rooms[e.Room], e)
+	if len(entries) > h.size {
+		entries = append([]Entry(nil), entries[len(entries)-h.size:]...)
+	}
+	h.rooms[e.Room] = entries
+	h.touch(e.Room)
+}
+
+// Marks the room as the most recently used.
+func (h *History) touch(room string) {
+	h.uses++
+	h.used[room] = h.uses
+}
+
+// Forgets the least recently used room.
+func (h *History) evict() {
+	var oldest string
+	least := h.uses + 1
+	for room, used := range h.used {
+		if used < least {
+			oldest, least = room, used
+		}
+	}
+	delete(h.rooms, oldest)
+	delete(h.used, oldest)
+}
+
+// Up to the last n messages relayed to the room, oldest first.
+func (h *History) Recent(room string, n int) []Entry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries, ok := h.rooms[room]
+	if n <= 0 || !ok {
+		return nil
+	}
+	h.touch(room)
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+// Closes the history file, after which messages are only kept in memory.
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return nil
+	}
+	err := h.f.Close()
+	h.f = nil
+	return err
+}
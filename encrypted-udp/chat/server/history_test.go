@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+// Reads the next message for the peer, expecting it to replay the message
+// from the sender reliably, and acknowledges it.
+func (p *peer) expectHistory(t *testing.T, s *Server, sender, message string) {
+	t.Helper()
+	_, kind, body, err := chat.OpenFrame(p.aead(), chat.DirectionToClient, read(t, p.c))
+	if err != nil || kind != chat.MessageReliable || len(body) < chat.ReliableOverhead || body[chat.MessageIDSize] != chat.MessageHistory {
+		t.Fatalf("expected reliable history, got %d %q: %v", kind, body, err)
+	}
+	p.send(t, s, chat.MessageAck, body[:chat.MessageIDSize])
+	if _, from, b, err := chat.HistorySplit(body[chat.ReliableOverhead:]); err != nil || from != sender || string(b) != message {
+		t.Fatalf("expected %s: %q, got %s: %q %v", sender, message, from, b, err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h, err := LoadHistory(path, 3, 0)
+	if err != nil {
+		t.Fatalf("failed to load history: %s", err)
+	}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if err := h.Add(Entry{Time: at.Add(time.Duration(i) * time.Minute), Room: "lobby", Sender: "alice", Message: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatalf("failed to add: %s", err)
+		}
+	}
+	h.Add(Entry{Time: at, Room: "dev", Sender: "bob", Message: []byte("x")})
+	if recent := h.Recent("lobby", 2); len(recent) != 2 || string(recent[0].Message) != "3" || string(recent[1].Message) != "4" {
+		t.Fatalf("unexpected recent messages: %+v", recent)
+	} else if recent := h.Recent("lobby", 10); len(recent) != 3 || string(recent[0].Message) != "2" {
+		t.Fatalf("expected only the last 3 kept, got %+v", recent)
+	} else if len(h.Recent("empty", 10)) != 0 || len(h.Recent("lobby", 0)) != 0 {
+		t.Fatal("expected nothing...")
+	}
+	h.Close()
+
+	// a line cut short by a crash is skipped, and reloading compacts the
+	// file down to the messages kept
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"time":"2024-03-01T12:10:00Z","room":"lo`)
+	f.Close()
+	h, err = LoadHistory(path, 3, 0)
+	if err != nil {
+		t.Fatalf("failed to reload history: %s", err)
+	}
+	defer h.Close()
+	if recent := h.Recent("lobby", 10); len(recent) != 3 || !recent[2].Time.Equal(at.Add(4*time.Minute)) || recent[2].Sender != "alice" {
+		t.Fatalf("unexpected reloaded messages: %+v", recent)
+	} else if recent := h.Recent("dev", 10); len(recent) != 1 || string(recent[0].Message) != "x" {
+		t.Fatalf("unexpected reloaded messages: %+v", recent)
+	}
+	if b, _ := os.ReadFile(path); strings.Count(string(b), "\n") != 4 {
+		t.Fatalf("expected the file compacted to 4 lines, got:\n%s", b)
+	}
+}
+
+// Once there are too many rooms the least recently used is forgotten, and
+// reloading the file keeps them in the order they were used.
+func TestHistoryRooms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h, err := LoadHistory(path, 3, 2)
+	if err != nil {
+		t.Fatalf("failed to load history: %s", err)
+	}
+	for _, room := range []string{"a", "b"} {
+		h.Add(Entry{Room: room, Sender: "alice", Message: []byte(room)})
+	}
+	h.Recent("a", 1)
+	h.Add(Entry{Room: "c", Sender: "alice", Message: []byte("c")})
+	if len(h.Recent("b", 1)) != 0 || len(h.Recent("a", 1)) != 1 || len(h.Recent("c", 1)) != 1 {
+		t.Fatal("expected the least recently used room forgotten...")
+	}
+	h.Close()
+
+	h, err = LoadHistory(path, 3, 2)
+	if err != nil {
+		t.Fatalf("failed to reload history: %s", err)
+	}
+	defer h.Close()
+	h.Add(Entry{Room: "d", Sender: "alice", Message: []byte("d")})
+	if len(h.Recent("a", 1)) != 0 || len(h.Recent("c", 1)) != 1 || len(h.Recent("d", 1)) != 1 {
+		t.Fatal("expected the order of use to survive a reload...")
+	}
+}
+
+// Clients are sent the recent messages of the room once they confirm
+// their session, and again when they join another room.
+func TestReplay(t *testing.T) {
+	s := newServer(t)
+	s.Replay = 2
+	alice := connect(t, s, "alice")
+	alice.send(t, s, chat.MessagePing, nil)
+	for _, message := range []string{"one", "two", "three"} {
+		alice.send(t, s, chat.MessageChat, []byte(message))
+		alice.expect(t, chat.MessageChat, "alice: "+message)
+	}
+	alice.send(t, s, chat.MessageJoin, []byte("dev"))
+	alice.expect(t, chat.MessageNotice, "alice joined #dev")
+	alice.send(t, s, chat.MessageChat, []byte("four"))
+	alice.expect(t, chat.MessageChat, "alice: four")
+
+	bob := connect(t, s, "bob")
+	bob.send(t, s, chat.MessagePing, nil)
+	bob.expectHistory(t, s, "alice", "two")
+	bob.expectHistory(t, s, "alice", "three")
+	bob.send(t, s, chat.MessageJoin, []byte("dev"))
+	bob.expect(t, chat.MessageNotice, "bob joined #dev")
+	bob.expectHistory(t, s, "alice", "four")
+	bob.quiet(t)
+
+	if s.History.Recent("dev", 1)[0].Sender != "alice" {
+		t.Fatal("expected the sender to be recorded...")
+	}
+}
+
+// More than the reliable window would fail to send, so replay is capped.
+func TestReplayWindow(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	s := &Server{Replay: chat.ReliableWindow + 1}
+	if err := s.Init("127.0.0.1:0", identity); err != nil {
+		t.Fatalf("failed to init server: %s", err)
+	}
+	defer s.Close()
+	if s.Replay != chat.ReliableWindow {
+		t.Fatalf("expected replay capped at %d, got %d", chat.ReliableWindow, s.Replay)
+	}
+}
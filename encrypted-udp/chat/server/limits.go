@@ -0,0 +1,126 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handshakes and relayed messages from each address are limited to these
+// rates per second, with bursts of up to the given number, unless the
+// Server sets its own.
+const (
+	DefaultHandshakeRate  = 2
+	DefaultHandshakeBurst = 8
+	DefaultMessageRate    = 50
+	DefaultMessageBurst   = 100
+)
+
+// Each address is told at most this often why its handshakes are refused,
+// since clients of the first protocol answer every refusal by trying
+// again.
+const refusalInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A token bucket for each key, refilled at Rate tokens per second up to
+// Burst, where each allowed event takes a token.
+//
+// Keys whose buckets have refilled are forgotten by Prune, since a new
+// bucket starts full anyway.
+type Limiter struct {
+	Rate  float64
+	Burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// Takes a token from the bucket for the key, reporting whether there was
+// one to take.
+func (l *Limiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.Burst, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * l.Rate
+		if b.tokens > l.Burst {
+			b.tokens = l.Burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Forgets the buckets that would be full by now.
+func (l *Limiter) Prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= l.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// The number of keys with a bucket.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// Counters of the datagrams the server dropped and why, along with the
+// cookie challenges it sent.
+type Stats struct {
+	Challenges        uint64
+	BadCookies        uint64
+	HandshakesLimited uint64
+	MessagesLimited   uint64
+	Unrecognized      uint64
+	UnknownSessions   uint64
+	Undecryptable     uint64
+	Replayed          uint64
+	Malformed         uint64
+}
+
+type counters struct {
+	challenges        uint64
+	badCookies        uint64
+	handshakesLimited uint64
+	messagesLimited   uint64
+	unrecognized      uint64
+	unknownSessions   uint64
+	undecryptable     uint64
+	replayed          uint64
+	malformed         uint64
+}
+
+// Counters since the server was started.
+func (s *Server) Stats() Stats {
+	return Stats{
+		Challenges:        atomic.LoadUint64(&s.counters.challenges),
+		BadCookies:        atomic.LoadUint64(&s.counters.badCookies),
+		HandshakesLimited: atomic.LoadUint64(&s.counters.handshakesLimited),
+		MessagesLimited:   atomic.LoadUint64(&s.counters.messagesLimited),
+		Unrecognized:      atomic.LoadUint64(&s.counters.unrecognized),
+		UnknownSessions:   atomic.LoadUint64(&s.counters.unknownSessions),
+		Undecryptable:     atomic.LoadUint64(&s.counters.undecryptable),
+		Replayed:          atomic.LoadUint64(&s.counters.replayed),
+		Malformed:         atomic.LoadUint64(&s.counters.malformed),
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+func TestLimiter(t *testing.T) {
+	l := Limiter{Rate: 2, Burst: 3}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a", now) {
+			t.Fatalf("expected the burst to allow event %d", i)
+		}
+	}
+	if l.Allow("a", now) {
+		t.Fatal("expected the bucket to be empty...")
+	} else if !l.Allow("b", now) {
+		t.Fatal("expected another key to have its own bucket...")
+	} else if !l.Allow("a", now.Add(500*time.Millisecond)) || l.Allow("a", now.Add(500*time.Millisecond)) {
+		t.Fatal("expected one token after half a second...")
+	}
+
+	l.Prune(now.Add(time.Second))
+	if l.Len() != 1 {
+		t.Fatalf("expected only the refilled bucket to be pruned, got %d", l.Len())
+	}
+	l.Prune(now.Add(10 * time.Second))
+	if l.Len() != 0 {
+		t.Fatalf("expected every bucket to be pruned, got %d", l.Len())
+	}
+}
+
+// Handshakes and relayed messages over the limit are dropped and counted,
+// while pings still keep the session alive, and a reliable message over
+// the limit is not acknowledged so the client sends it again.
+func TestRateLimits(t *testing.T) {
+	s := newServer(t)
+	s.handshakes = Limiter{Rate: 1, Burst: 1}
+	s.messages = Limiter{Rate: 1, Burst: 2}
+	bob := connect(t, s, "bob")
+
+	addr := bob.c.LocalAddr().(*net.UDPAddr)
+	s.HandshakeReceive(addr, chat.HandshakeBody(new([chat.KeySize]byte), chat.Suites, s.cookie(addr, time.Now()), "bob"))
+	bob.quiet(t)
+
+	bob.send(t, s, chat.MessageChat, []byte("one"))
+	bob.expect(t, chat.MessageChat, "bob: one")
+	bob.send(t, s, chat.MessageChat, []byte("two"))
+	bob.expect(t, chat.MessageChat, "bob: two")
+	bob.send(t, s, chat.MessageChat, []byte("three"))
+	bob.send(t, s, chat.MessagePing, nil)
+	reliable := append(make([]byte, chat.MessageIDSize-1), 1, chat.MessageChat)
+	bob.send(t, s, chat.MessageReliable, append(reliable, "four"...))
+	bob.quiet(t)
+
+	if stats := s.Stats(); stats.HandshakesLimited != 1 || stats.MessagesLimited != 2 {
+		t.Fatalf("unexpected counters: %#v", stats)
+	}
+}
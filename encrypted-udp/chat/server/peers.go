@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+// Requests to be introduced to another client are forgotten if they are
+// not returned within this long.
+const PeerTimeout = 30 * time.Second
+
+// A request from one client to talk directly to another, holding the box
+// key it will use for them.
+type offer struct {
+	from *Client
+	pub  [chat.KeySize]byte
+	at   time.Time
+}
+
+// Acts as the rendezvous for two clients that want to talk directly.
+//
+// The first to ask is remembered and the other is told, and once the
+// other asks in return each is sent the box key of the other along with
+// the address we see it at, which is the public end of any NAT it is
+// behind, so both can start punching through at the same time.
+//
+// Both must have asked for CapabilityPeers in their handshake.
+func (s *Server) Introduce(c *Client, pub *[chat.KeySize]byte, to string, reliable bool) {
+	if to == c.identity {
+		s.deliver(c, chat.MessageNotice, []byte("cannot peer with yourself..."), reliable)
+		return
+	} else if !c.Has(chat.CapabilityPeers) {
+		s.deliver(c, chat.MessageNotice, []byte("peers were not agreed in the handshake..."), reliable)
+		return
+	}
+	s.namesMu.RLock()
+	peer, ok := s.names[to]
+	s.namesMu.RUnlock()
+	if !ok {
+		s.deliver(c, chat.MessageNotice, []byte(fmt.Sprintf("%s is not connected...", to)), reliable)
+		return
+	} else if !peer.Has(chat.CapabilityPeers) {
+		s.deliver(c, chat.MessageNotice, []byte(fmt.Sprintf("%s cannot talk directly...", to)), reliable)
+		return
+	}
+
+	now := time.Now()
+	s.peersMu.Lock()
+	theirs, ok := s.offers[[2]string{to, c.identity}]
+	if ok && theirs.from == peer && now.Sub(theirs.at) < PeerTimeout {
+		delete(s.offers, [2]string{to, c.identity})
+		s.peersMu.Unlock()
+
+		log.Printf("introducing %s at %s to %s at %s\n", c.identity, c.Addr().String(), to, peer.Addr().String())
+		s.deliver(c, chat.MessagePeer, chat.PeerBody(&theirs.pub, to, peer.Addr().String()), reliable)
+		s.deliver(peer, chat.MessagePeer, chat.PeerBody(pub, c.identity, c.Addr().String()), reliable)
+		return
+	}
+	s.offers[[2]string{c.identity, to}] = offer{from: c, pub: *pub, at: now}
+	s.peersMu.Unlock()
+
+	s.deliver(peer, chat.MessageNotice, []byte(fmt.Sprintf("%s wants to talk directly, /peer %s to accept", c.identity, c.identity)), reliable)
+	s.deliver(c, chat.MessageNotice, []byte(fmt.Sprintf("waiting for %s to accept...", to)), reliable)
+}
+
+// Passes a frame sealed for a peer on to them, for when the two cannot
+// reach each other directly.
+//
+// We cannot read it, and it is sent without retransmission like any
+// datagram between peers.
+func (s *Server) Relay(c *Client, to string, frame []byte) {
+	s.namesMu.RLock()
+	peer, ok := s.names[to]
+	s.namesMu.RUnlock()
+	if ok && c.Has(chat.CapabilityPeers) && peer.Has(chat.CapabilityPeers) {
+		s.MessageSend(peer, chat.MessageRelay, chat.DirectBody(c.identity, frame))
+	}
+}
+
+// Forgets the requests that were never returned.
+func (s *Server) expireOffers(now time.Time) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	for key, o := range s.offers {
+		if now.Sub(o.at) >= PeerTimeout {
+			delete(s.offers, key)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Clients are only introduced once both have asked, and frames between
+// them are relayed as they were sealed.
+func TestIntroduce(t *testing.T) {
+	s := newServer(t)
+	alice, bob := connect(t, s, "alice"), connect(t, s, "bob")
+	alicePub, _, _ := box.GenerateKey(rand.Reader)
+	bobPub, _, _ := box.GenerateKey(rand.Reader)
+
+	alice.send(t, s, chat.MessagePeer, chat.PeerBody(alicePub, "carol", ""))
+	alice.expect(t, chat.MessageNotice, "carol is not connected...")
+	alice.send(t, s, chat.MessagePeer, chat.PeerBody(alicePub, "alice", ""))
+	alice.expect(t, chat.MessageNotice, "cannot peer with yourself...")
+
+	alice.send(t, s, chat.MessagePeer, chat.PeerBody(alicePub, "bob", ""))
+	bob.expect(t, chat.MessageNotice, "alice wants to talk directly, /peer alice to accept")
+	alice.expect(t, chat.MessageNotice, "waiting for bob to accept...")
+
+	bob.send(t, s, chat.MessagePeer, chat.PeerBody(bobPub, "alice", ""))
+	alice.expect(t, chat.MessagePeer, string(chat.PeerBody(bobPub, "bob", bob.c.LocalAddr().String())))
+	bob.expect(t, chat.MessagePeer, string(chat.PeerBody(alicePub, "alice", alice.c.LocalAddr().String())))
+
+	// the introduction is used up, so asking again starts over
+	bob.send(t, s, chat.MessagePeer, chat.PeerBody(bobPub, "alice", ""))
+	alice.expect(t, chat.MessageNotice, "bob wants to talk directly, /peer bob to accept")
+	bob.expect(t, chat.MessageNotice, "waiting for alice to accept...")
+
+	alice.send(t, s, chat.MessageRelay, chat.DirectBody("bob", []byte("sealed")))
+	bob.expect(t, chat.MessageRelay, string(chat.DirectBody("alice", []byte("sealed"))))
+	alice.send(t, s, chat.MessageRelay, chat.DirectBody("carol", []byte("sealed")))
+	alice.quiet(t)
+}
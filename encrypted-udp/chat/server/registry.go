@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+var errIdentityKeyRequired = errors.New("identity is registered to a key, sign the handshake with it...")
+var errIdentityKeyMismatch = errors.New("identity is registered to a different key...")
+
+// The identities bound to client keys, in the same format as the client
+// known hosts, with the identity in place of the address.
+//
+// An identity is bound to the first key that signs a handshake for it,
+// after which only that key may claim it, while identities never claimed
+// with a key remain free for anyone.  Without a path the bindings only
+// last as long as the server.
+type Registry struct {
+	path string
+	mu   sync.Mutex
+	keys map[string]ed25519.PublicKey
+}
+
+// Loads the registry file, which may not exist yet.
+func LoadRegistry(path string) (*Registry, error) {
+	r := &Registry{path: path, keys: make(map[string]ed25519.PublicKey)}
+	if path == "" {
+		return r, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected identity and key", path, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid key", path, n)
+		}
+		r.keys[fields[0]] = ed25519.PublicKey(key)
+	}
+	return r, scanner.Err()
+}
+
+// Checks the key presented for the identity, which is empty when the
+// handshake was not signed, binding the identity to it on first use.
+func (r *Registry) Register(identity string, key ed25519.PublicKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if known, ok := r.keys[identity]; ok {
+		if len(key) == 0 {
+			return errIdentityKeyRequired
+		} else if !bytes.Equal(known, key) {
+			return errIdentityKeyMismatch
+		}
+		return nil
+	} else if len(key) == 0 {
+		return nil
+	}
+
+	// @note: identities are written as a single field, so one that would
+	// not read back as one is bound for this run but not saved
+	if r.path != "" && len(strings.Fields(identity)) == 1 && identity == strings.TrimSpace(identity) && !strings.HasPrefix(identity, "#") {
+		f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := fmt.Fprintf(f, "%s %s\n", identity, base64.StdEncoding.EncodeToString(key)); err != nil {
+			return err
+		}
+	}
+	r.keys[identity] = append(ed25519.PublicKey(nil), key...)
+	return nil
+}
+
+// The fingerprint of the key bound to the identity, if there is one.
+func (r *Registry) Fingerprint(identity string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.keys[identity]
+	if !ok {
+		return "", false
+	}
+	return chat.Fingerprint(key), true
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identities")
+	r, err := LoadRegistry(path)
+	if err != nil {
+		t.Fatalf("failed to load registry: %s", err)
+	}
+	key, _, _ := ed25519.GenerateKey(rand.Reader)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	if err := r.Register("carol", nil); err != nil {
+		t.Fatalf("expected an unbound identity to be free: %s", err)
+	} else if err := r.Register("bob", key); err != nil {
+		t.Fatalf("failed to bind identity: %s", err)
+	} else if err := r.Register("bob", key); err != nil {
+		t.Fatalf("expected the same key to be accepted: %s", err)
+	}
+
+	r, err = LoadRegistry(path)
+	if err != nil {
+		t.Fatalf("failed to reload registry: %s", err)
+	} else if err := r.Register("bob", other); err != errIdentityKeyMismatch {
+		t.Fatalf("expected a different key to be refused, got %v", err)
+	} else if err := r.Register("bob", nil); err != errIdentityKeyRequired {
+		t.Fatalf("expected a missing key to be refused, got %v", err)
+	} else if fingerprint, ok := r.Fingerprint("bob"); !ok || fingerprint != chat.Fingerprint(key) {
+		t.Fatalf("unexpected fingerprint: %s", fingerprint)
+	} else if _, ok := r.Fingerprint("carol"); ok {
+		t.Fatal("expected carol to have no key...")
+	}
+}
+
+// Sends a handshake for the identity signed with the key, returning the
+// reply the server sent.
+func signedHandshake(t *testing.T, s *Server, c *net.UDPConn, identity string, key ed25519.PrivateKey) []byte {
+	pub, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	addr := c.LocalAddr().(*net.UDPAddr)
+	h := &chat.Handshake{Version: chat.ProtocolVersion, Capabilities: chat.Capabilities, Key: *pub, Suites: chat.Suites, Cookie: s.cookie(addr, time.Now()), Identity: identity}
+	if key != nil {
+		h.Sign(key)
+	}
+	s.HandshakeReceive(addr, h.Body())
+	return read(t, c)
+}
+
+// A signed handshake binds the identity to its key, after which a
+// handshake without the key or signed by another is refused, while the
+// fingerprint is available to anyone who asks.
+func TestIdentityKeys(t *testing.T) {
+	s := newServer(t)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer c.Close()
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+
+	if reply := signedHandshake(t, s, c, "bob", key); reply[len(chat.Signature)] != chat.MessageHandshake {
+		t.Fatalf("expected a handshake reply, got %v", reply)
+	}
+	s.remove(s.Clients()[0].id)
+	for _, k := range []ed25519.PrivateKey{nil, other} {
+		if reply := signedHandshake(t, s, c, "bob", k); reply[len(chat.Signature)] != chat.MessageDisconnected {
+			t.Fatalf("expected the handshake to be refused, got %v", reply)
+		}
+	}
+
+	// a signature for another identity does not carry over
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	h := &chat.Handshake{Version: chat.ProtocolVersion, Key: *pub, Suites: chat.Suites, Cookie: s.cookie(c.LocalAddr(), time.Now()), Identity: "bob"}
+	h.Sign(other)
+	h.PublicKey = key.Public().(ed25519.PublicKey)
+	s.HandshakeReceive(c.LocalAddr(), h.Body())
+	if reply := read(t, c); string(reply[len(chat.Signature)+1:]) != "invalid identity signature..." {
+		t.Fatalf("expected an invalid signature to be refused, got %q", reply)
+	}
+
+	alice := connect(t, s, "alice")
+	alice.send(t, s, chat.MessageWhois, []byte("bob"))
+	alice.expect(t, chat.MessageNotice, "bob is "+chat.Fingerprint(key.Public().(ed25519.PublicKey))+" (offline)")
+	alice.send(t, s, chat.MessageWhois, []byte("alice"))
+	alice.expect(t, chat.MessageNotice, "alice has no registered key...")
+	if reply := signedHandshake(t, s, c, "bob", key); reply[len(chat.Signature)] != chat.MessageHandshake {
+		t.Fatalf("expected a handshake reply, got %v", reply)
+	}
+	alice.send(t, s, chat.MessageWhois, []byte("bob"))
+	alice.expect(t, chat.MessageNotice, "bob is "+chat.Fingerprint(key.Public().(ed25519.PublicKey))+" (online)")
+}
+
+// Identities that could not be shown or addressed are refused before
+// anything is registered.
+func TestInvalidIdentity(t *testing.T) {
+	s := newServer(t)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer c.Close()
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, identity := range []string{"", "bob smith", "bob\x00", "\x1b[2Jbob"} {
+		if reply := signedHandshake(t, s, c, identity, key); reply[len(chat.Signature)] != chat.MessageDisconnected {
+			t.Fatalf("expected %q to be refused, got %v", identity, reply)
+		}
+	}
+	if len(s.Clients()) != 0 {
+		t.Fatalf("expected no sessions, got %d", len(s.Clients()))
+	} else if _, ok := s.Registry.Fingerprint(""); ok {
+		t.Fatal("expected nothing registered...")
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+// Moves the client into the room, telling the members of both the room
+// it left and the one it joined.
+func (s *Server) Join(c *Client, room string, reliable bool) {
+	if err := chat.ValidRoom(room); err != nil {
+		s.deliver(c, chat.MessageNotice, []byte(err.Error()), reliable)
+		return
+	}
+
+	s.roomsMu.Lock()
+	previous := c.room
+	if previous == "" {
+		// removed while the message was being processed
+		s.roomsMu.Unlock()
+		return
+	} else if previous == room {
+		s.roomsMu.Unlock()
+		s.deliver(c, chat.MessageNotice, []byte(fmt.Sprintf("already in #%s...", room)), reliable)
+		return
+	}
+	s.part(c)
+	s.enter(c, room)
+	s.roomsMu.Unlock()
+
+	log.Printf("%s moved from #%s to #%s\n", c.identity, previous, room)
+	s.announce(previous, fmt.Sprintf("%s left #%s", c.identity, previous), reliable)
+	s.announce(room, fmt.Sprintf("%s joined #%s", c.identity, room), reliable)
+	s.replay(c, room)
+}
+
+// Returns the client to the default room.
+func (s *Server) Leave(c *Client, reliable bool) {
+	s.Join(c, chat.DefaultRoom, reliable)
+}
+
+// The room the client is in.
+func (s *Server) Room(c *Client) string {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+	return c.room
+}
+
+// A snapshot of the members of a room.
+func (s *Server) Members(room string) []*Client {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+	members := make([]*Client, 0, len(s.rooms[room]))
+	for _, c := range s.rooms[room] {
+		members = append(members, c)
+	}
+	return members
+}
+
+// Sends the message only to the client with the given identity, telling
+// the sender if there is nobody by that name.
+func (s *Server) Direct(sender *Client, to string, message []byte, reliable bool) {
+	if len(message) > chat.MaxMessageSize || (reliable && len(message) > chat.MaxReliableMessageSize) {
+		log.Printf("direct message from %s is too large\n", sender.identity)
+		return
+	}
+
+	s.namesMu.RLock()
+	recipient, ok := s.names[to]
+	s.namesMu.RUnlock()
+	if !ok {
+		s.deliver(sender, chat.MessageNotice, []byte(fmt.Sprintf("%s is not connected...", to)), reliable)
+		return
+	}
+	s.deliver(recipient, chat.MessageDirect, append([]byte(sender.identity+": "), message...), reliable)
+}
+
+// Tells the sender the fingerprint of the key the identity is bound to,
+// so users can compare it with the one its owner sees out of band, and
+// whether that identity is connected with the key right now.
+func (s *Server) Whois(sender *Client, identity string, reliable bool) {
+	fingerprint, ok := s.Registry.Fingerprint(identity)
+	if !ok {
+		s.deliver(sender, chat.MessageNotice, []byte(fmt.Sprintf("%s has no registered key...", identity)), reliable)
+		return
+	}
+	s.namesMu.RLock()
+	c, online := s.names[identity]
+	s.namesMu.RUnlock()
+	status := "offline"
+	if online && chat.Fingerprint(c.key) == fingerprint {
+		status = "online"
+	}
+	s.deliver(sender, chat.MessageNotice, []byte(fmt.Sprintf("%s is %s (%s)", identity, fingerprint, status)), reliable)
+}
+
+// Tells the sender who is connected and the room each of them is in.
+func (s *Server) Who(sender *Client, reliable bool) {
+	s.namesMu.RLock()
+	clients := make([]*Client, 0, len(s.names))
+	for _, c := range s.names {
+		clients = append(clients, c)
+	}
+	s.namesMu.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].identity < clients[j].identity })
+
+	online := make([]string, 0, len(clients))
+	for _, c := range clients {
+		if room := s.Room(c); room != "" {
+			online = append(online, fmt.Sprintf("%s (#%s)", c.identity, room))
+		}
+	}
+	s.deliver(sender, chat.MessageNotice, []byte(fmt.Sprintf("%d online: %s", len(online), strings.Join(online, ", "))), reliable)
+}
+
+// Sends the client the last messages relayed to the room, oldest first,
+// reliably so they arrive in order.
+//
+// @note: a message near the size limit does not fit the reliable channel
+// once the time and sender are added, so it is sent as an ordinary frame
+// and may arrive out of order or not at all.
+func (s *Server) replay(c *Client, room string) {
+	if !c.Has(chat.CapabilityHistory) {
+		return
+	}
+	for _, e := range s.History.Recent(room, s.Replay) {
+		body := chat.HistoryBody(e.Time, e.Sender, e.Message)
+		s.deliver(c, chat.MessageHistory, body, chat.ReliableOverhead+len(body) <= chat.MaxPayloadSize)
+	}
+}
+
+// Tells every member of the room something happened.
+func (s *Server) announce(room, notice string, reliable bool) {
+	for _, c := range s.Members(room) {
+		s.deliver(c, chat.MessageNotice, []byte(notice), reliable)
+	}
+}
+
+// Adds the client to the room, creating the room if needed; the caller
+// must hold roomsMu.
+func (s *Server) enter(c *Client, room string) {
+	if s.rooms[room] == nil {
+		s.rooms[room] = make(map[uint32]*Client)
+	}
+	s.rooms[room][c.id] = c
+	c.room = room
+}
+
+// Removes the client from its room, forgetting the room once it is
+// empty; the caller must hold roomsMu.
+func (s *Server) part(c *Client) {
+	if members, ok := s.rooms[c.room]; ok {
+		delete(members, c.id)
+		if len(members) == 0 {
+			delete(s.rooms, c.room)
+		}
+	}
+	c.room = ""
+}
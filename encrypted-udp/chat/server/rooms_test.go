@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+// Seals the next message from the peer and hands it to the server.
+func (p *peer) send(t testing.TB, s *Server, kind byte, body []byte) {
+	p.seq++
+	s.MessageProcess(p.c.LocalAddr().(*net.UDPAddr), seal(t, p.aead(), p.id, p.seq, kind, string(body)))
+}
+
+// Reads the next message for the peer, expecting the type and body.
+func (p *peer) expect(t *testing.T, kind byte, body string) {
+	t.Helper()
+	_, k, b, err := chat.OpenFrame(p.aead(), chat.DirectionToClient, read(t, p.c))
+	if err != nil {
+		t.Fatalf("failed to open frame: %s", err)
+	} else if k != kind || string(b) != body {
+		t.Fatalf("expected %d %q, got %d %q", kind, body, k, b)
+	}
+}
+
+// Expects nothing to have been sent to the peer, which is reliable since
+// loopback delivers before the server finishes writing.
+func (p *peer) quiet(t *testing.T) {
+	t.Helper()
+	b := make([]byte, chat.BufferSize)
+	p.c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := p.c.Read(b); err == nil {
+		t.Fatalf("expected nothing, got %d bytes", n)
+	}
+}
+
+// The session the server holds for the peer.
+func (p *peer) client(t *testing.T, s *Server) *Client {
+	t.Helper()
+	c, ok := s.lookup(p.id)
+	if !ok {
+		t.Fatalf("expected session %d to be registered", p.id)
+	}
+	return c
+}
+
+func TestRooms(t *testing.T) {
+	s := newServer(t)
+	alice, bob, carol := connect(t, s, "alice"), connect(t, s, "bob"), connect(t, s, "carol")
+
+	bob.send(t, s, chat.MessageJoin, []byte("dev"))
+	alice.expect(t, chat.MessageNotice, "bob left #lobby")
+	carol.expect(t, chat.MessageNotice, "bob left #lobby")
+	bob.expect(t, chat.MessageNotice, "bob joined #dev")
+	if s.Room(bob.client(t, s)) != "dev" || len(s.Members(chat.DefaultRoom)) != 2 {
+		t.Fatal("expected bob alone in #dev...")
+	}
+
+	alice.send(t, s, chat.MessageChat, []byte("hi"))
+	alice.expect(t, chat.MessageChat, "alice: hi")
+	carol.expect(t, chat.MessageChat, "alice: hi")
+	bob.quiet(t)
+
+	alice.send(t, s, chat.MessageDirect, chat.DirectBody("bob", []byte("psst")))
+	bob.expect(t, chat.MessageDirect, "alice: psst")
+	alice.quiet(t)
+	carol.quiet(t)
+
+	alice.send(t, s, chat.MessageDirect, chat.DirectBody("dave", []byte("hello?")))
+	alice.expect(t, chat.MessageNotice, "dave is not connected...")
+
+	bob.send(t, s, chat.MessageLeave, nil)
+	bob.expect(t, chat.MessageNotice, "bob joined #lobby")
+	bob.expectHistory(t, s, "alice", "hi")
+	alice.expect(t, chat.MessageNotice, "bob joined #lobby")
+	carol.expect(t, chat.MessageNotice, "bob joined #lobby")
+	bob.send(t, s, chat.MessageJoin, []byte("dev"))
+	alice.expect(t, chat.MessageNotice, "bob left #lobby")
+	carol.expect(t, chat.MessageNotice, "bob left #lobby")
+	bob.expect(t, chat.MessageNotice, "bob joined #dev")
+	carol.send(t, s, chat.MessageWho, nil)
+	carol.expectHistory(t, s, "alice", "hi")
+	carol.expect(t, chat.MessageNotice, "3 online: alice (#lobby), bob (#dev), carol (#lobby)")
+
+	s.remove(bob.id)
+	if len(s.Members(chat.DefaultRoom)) != 2 || len(s.Members("dev")) != 0 {
+		t.Fatal("expected bob removed from every room...")
+	}
+}
+
+// A handshake may take over an identity whose session never sent
+// anything, but not one that is in use.
+func TestIdentityUnique(t *testing.T) {
+	s := newServer(t)
+	abandoned := connect(t, s, "bob")
+	bob := connect(t, s, "bob")
+	if _, ok := s.lookup(abandoned.id); ok {
+		t.Fatal("expected unconfirmed session to be replaced...")
+	}
+	bob.send(t, s, chat.MessagePing, nil)
+
+	impostor, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer impostor.Close()
+	s.HandshakeReceive(impostor.LocalAddr().(*net.UDPAddr), chat.HandshakeBody(new([chat.KeySize]byte), chat.Suites, s.cookie(impostor.LocalAddr(), time.Now()), "bob"))
+	if reply := read(t, impostor); !chat.Clear(reply) || reply[len(chat.Signature)] != chat.MessageDisconnected {
+		t.Fatalf("expected handshake to be refused, got %v", reply)
+	}
+	bob.client(t, s)
+}
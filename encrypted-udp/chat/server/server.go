@@ -0,0 +1,761 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"golang.org/x/crypto/nacl/box"
+)
+
+var errIdentityInUse = fmt.Errorf("identity already in use...")
+var errInvalidIdentityKey = fmt.Errorf("identity must be an ed25519 private key...")
+
+// Sessions that send nothing, not even a keepalive, for this long are
+// evicted unless Server.Timeout is set.
+const DefaultTimeout = 2 * time.Minute
+
+// The number of received datagrams that may wait for a worker, which
+// also sizes the socket read buffer so bursts are not dropped.
+const QueueSize = 256
+
+// How long Shutdown is expected to wait for reliable messages in flight
+// to be acknowledged, unless the server is given another drain period.
+const DefaultDrain = 2 * time.Second
+
+// Every datagram is read into its own buffer, so it cannot be overwritten
+// while a worker is still processing it.
+var buffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, chat.BufferSize)
+	return &b
+}}
+
+type packet struct {
+	addr net.Addr
+	b    *[]byte
+	n    int
+}
+
+// A server implementation that reads datagrams on a single goroutine
+// and passes them over a shared channel to a fixed pool of workers.
+//
+// Clients are spread across shards by connection id, each with its own
+// lock, so workers rarely contend with each other or the reaper.  Fields
+// left at their zero value are given defaults by Init.
+type Server struct {
+	// idle sessions are evicted by the reaper after this long
+	Timeout time.Duration
+	// goroutines processing the datagrams read
+	Workers int
+	// session keys are rotated after this many messages or this long
+	RekeyMessages uint64
+	RekeyInterval time.Duration
+	// the cipher suites and capabilities we allow, of which only those
+	// the client also offers are used, defaulting to every one the chat
+	// package implements
+	Suites       []chat.Suite
+	Capabilities chat.Capability
+	// called with every chat message before it is relayed
+	OnMessage func(sender, room string, message []byte)
+	// binds identities signed with a client key to it, which only lasts
+	// as long as the server unless one is loaded from a file
+	Registry *Registry
+	// handshakes and relayed messages from each address are limited by
+	// token buckets, with everything dropped counted in Stats
+	HandshakeRate  float64
+	HandshakeBurst float64
+	MessageRate    float64
+	MessageBurst   float64
+	// messages relayed to each room, which only last as long as the
+	// server unless loaded from a file, and how many of them are sent to
+	// clients once they complete the handshake and whenever they join
+	// another room, no more than chat.ReliableWindow
+	History *History
+	Replay  int
+
+	identity ed25519.PrivateKey
+	secret   []byte
+	priv     [32]byte
+	pub      [32]byte
+	c        net.PacketConn
+	quit     chan struct{}
+	closing  sync.Once
+	stopping int32
+	cookies  []byte
+
+	handshakes Limiter
+	messages   Limiter
+	refusals   Limiter
+	counters   counters
+
+	registering sync.Mutex
+	shards      [shardCount]shard
+
+	namesMu sync.RWMutex
+	names   map[string]*Client
+	roomsMu sync.RWMutex
+	rooms   map[string]map[uint32]*Client
+	peersMu sync.Mutex
+	offers  map[[2]string]offer
+}
+
+// Stop the reaper, clear all clients and close the server.
+//
+// Only the first call does anything, so it is safe to close a server
+// that Run already closed.
+func (s *Server) Close() error {
+	err := net.ErrClosed
+	s.closing.Do(func() {
+		close(s.quit)
+		s.clearClients()
+		err = s.c.Close()
+	})
+	return err
+}
+
+// Stops accepting handshakes and waits for every reliable message in
+// flight to be acknowledged, or for the context to end, then tells every
+// client we are leaving with an authenticated disconnect and closes.
+//
+// Returns the context error if the drain did not finish, in which case
+// the messages still in flight are lost.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.stopping, 1)
+
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	var drained error
+	for drained == nil && s.inFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			drained = ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	for _, c := range s.Clients() {
+		s.Disconnect(c, "server shutting down...")
+	}
+	if err := s.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return drained
+}
+
+// The number of reliable messages awaiting acknowledgement.
+func (s *Server) inFlight() int {
+	var n int
+	for _, c := range s.Clients() {
+		n += len(c.reliable.Pending())
+	}
+	return n
+}
+
+// Parse the address and start the server with chosen buffer size.
+//
+// The identity key is required to sign handshake replies, which lets
+// clients detect a man in the middle.
+func (s *Server) Init(address string, identity ed25519.PrivateKey) error {
+	if len(identity) != ed25519.PrivateKeySize {
+		return errInvalidIdentityKey
+	}
+
+	serverAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	c, err := net.ListenUDP("udp", serverAddr)
+	if err != nil {
+		return err
+	}
+	c.SetReadBuffer(chat.BufferSize * QueueSize)
+	c.SetWriteBuffer(chat.BufferSize)
+	return s.InitPacketConn(c, identity)
+}
+
+// Start the server on an existing connection, which it takes ownership of
+// and closes along with the server.
+func (s *Server) InitPacketConn(c net.PacketConn, identity ed25519.PrivateKey) error {
+	if len(identity) != ed25519.PrivateKeySize {
+		c.Close()
+		return errInvalidIdentityKey
+	}
+	s.c = c
+	s.identity = identity
+	reset := sha256.Sum256(append([]byte("encrypted-udp reset"), identity.Seed()...))
+	s.secret = reset[:]
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	copy(s.priv[:], priv[:])
+	copy(s.pub[:], pub[:])
+
+	s.cookies = make([]byte, sha256.Size)
+	if _, err := rand.Read(s.cookies); err != nil {
+		c.Close()
+		return err
+	}
+
+	s.clearClients()
+	s.quit = make(chan struct{})
+	if s.Timeout <= 0 {
+		s.Timeout = DefaultTimeout
+	}
+	if s.Workers <= 0 {
+		s.Workers = runtime.NumCPU()
+	}
+	if s.RekeyMessages == 0 {
+		s.RekeyMessages = chat.DefaultRekeyMessages
+	}
+	if s.RekeyInterval == 0 {
+		s.RekeyInterval = chat.DefaultRekeyInterval
+	}
+	if len(s.Suites) == 0 {
+		s.Suites = chat.Suites
+	}
+	if s.Capabilities == 0 {
+		s.Capabilities = chat.Capabilities
+	}
+	if s.Registry == nil {
+		s.Registry, _ = LoadRegistry("")
+	}
+	if s.History == nil {
+		s.History, _ = LoadHistory("", DefaultHistorySize, DefaultHistoryRooms)
+	}
+	if s.Replay == 0 {
+		s.Replay = DefaultReplay
+	} else if s.Replay > chat.ReliableWindow {
+		s.Replay = chat.ReliableWindow
+	}
+	if s.HandshakeRate <= 0 {
+		s.HandshakeRate = DefaultHandshakeRate
+	}
+	if s.HandshakeBurst <= 0 {
+		s.HandshakeBurst = DefaultHandshakeBurst
+	}
+	if s.MessageRate <= 0 {
+		s.MessageRate = DefaultMessageRate
+	}
+	if s.MessageBurst <= 0 {
+		s.MessageBurst = DefaultMessageBurst
+	}
+	s.handshakes = Limiter{Rate: s.HandshakeRate, Burst: s.HandshakeBurst}
+	s.messages = Limiter{Rate: s.MessageRate, Burst: s.MessageBurst}
+	s.refusals = Limiter{Rate: 1 / refusalInterval.Seconds(), Burst: 1}
+	return nil
+}
+
+// Listen for datagrams and hand them to the workers until the server is
+// closed or the context is cancelled, which closes it, waiting for the
+// workers to finish before returning.
+//
+// Since UDP is "connectionless" we track the last authenticated message
+// from each client, and a reaper clears "idle" clients after the timeout.
+func (s *Server) Run(ctx context.Context) error {
+	go s.reap()
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+
+	packets := make(chan packet, QueueSize)
+	var wg sync.WaitGroup
+	for i := 0; i < s.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range packets {
+				s.MessageProcess(p.addr, (*p.b)[:p.n])
+				buffers.Put(p.b)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(packets)
+
+	for {
+		b := buffers.Get().(*[]byte)
+		n, addr, err := s.c.ReadFrom(*b)
+		if err != nil {
+			buffers.Put(b)
+			if errors.Is(err, net.ErrClosed) {
+				return ctx.Err()
+			}
+			log.Printf("failed to read from connection: %s\n", err)
+			continue
+		}
+		packets <- packet{addr: addr, b: b, n: n}
+	}
+}
+
+// Cleartext frames may only start a handshake, everything else must be
+// sealed under an existing session, and every message is checked against
+// its chat.Spec before it is acted on.
+//
+// Sealed frames for an unknown connection id are answered with a reset,
+// which the client can authenticate with the token from its handshake.
+//
+// A handshake from a client of the first, unversioned, protocol is
+// refused with a reason, which is all it can understand from us.
+func (s *Server) MessageProcess(addr net.Addr, message []byte) {
+	if chat.Clear(message) {
+		kind, body := message[len(chat.Signature)], message[len(chat.Signature)+1:]
+		if err := chat.CheckToServer(kind, body, false); err != nil {
+			atomic.AddUint64(&s.counters.unrecognized, 1)
+			log.Printf("unexpected cleartext %s message from address %s: %s\n", chat.MessageName(kind), addr.String(), err)
+			return
+		}
+		switch kind {
+		case chat.MessageHello:
+			s.HandshakeReceive(addr, body)
+		case chat.MessageHandshake:
+			_, err := chat.ChooseVersion(1)
+			atomic.AddUint64(&s.counters.unrecognized, 1)
+			log.Printf("refusing unversioned handshake from %s\n", addr.String())
+			s.Refuse(addr, err.Error(), len(message))
+		}
+		return
+	}
+
+	id, ok := chat.ConnectionID(message)
+	if !ok {
+		atomic.AddUint64(&s.counters.unrecognized, 1)
+		log.Printf("Frame from address %s is not recognized, discarding...\n", addr.String())
+		return
+	}
+	c, ok := s.lookup(id)
+	if !ok {
+		atomic.AddUint64(&s.counters.unknownSessions, 1)
+		log.Printf("No registered client %d from %s, sending reset\n", id, addr.String())
+		s.Reset(addr, id)
+		return
+	}
+
+	seq, kind, body, err := c.keys.Open(message)
+	if err != nil {
+		atomic.AddUint64(&s.counters.undecryptable, 1)
+		log.Printf("failed to open frame for %d from %s: %s\n", id, addr.String(), err)
+		return
+	} else if !c.window.Check(seq) {
+		// replayed or stale messages still decrypt, so they are quietly
+		// dropped rather than treated as a broken session
+		atomic.AddUint64(&s.counters.replayed, 1)
+		log.Printf("dropped replayed message %d from %s: %#v\n", seq, addr.String(), c.window.Stats())
+		return
+	}
+	c.SetAddr(addr)
+	c.Touch()
+	if c.Confirm() {
+		s.replay(c, s.Room(c))
+	}
+
+	if err := chat.CheckToServer(kind, body, true); err != nil {
+		atomic.AddUint64(&s.counters.malformed, 1)
+		log.Printf("malformed %s message from %s: %s\n", chat.MessageName(kind), c.identity, err)
+		return
+	}
+	if kind == chat.MessageFragment {
+		var ok bool
+		if kind, body, ok, err = c.fragments.Add(body); err != nil {
+			log.Printf("invalid fragment from %s: %s\n", c.identity, err)
+			return
+		} else if !ok {
+			return
+		} else if err := chat.CheckToServer(kind, body, true); err != nil {
+			atomic.AddUint64(&s.counters.malformed, 1)
+			log.Printf("malformed %s message from %s: %s\n", chat.MessageName(kind), c.identity, err)
+			return
+		}
+	}
+	if s.limited(addr, kind, body) {
+		atomic.AddUint64(&s.counters.messagesLimited, 1)
+		log.Printf("dropped message from %s over the rate limit\n", c.identity)
+		return
+	}
+
+	switch kind {
+	case chat.MessageReliable:
+		// @note: two workers may each be handed a batch that is ready from
+		// the same client, so they take turns dispatching them in order
+		c.delivering.Lock()
+		defer c.delivering.Unlock()
+		ready, err := c.reliable.Receive(body)
+		if err != nil {
+			log.Printf("invalid reliable message from %s: %s\n", c.identity, err)
+		}
+		for _, d := range ready {
+			s.dispatch(c, d.Kind, d.Body, true)
+		}
+	case chat.MessageAck:
+		c.reliable.Ack(body)
+	default:
+		s.dispatch(c, kind, body, false)
+	}
+}
+
+// Reports whether the message is relayed to other clients and the address
+// has run out of tokens for those.
+//
+// A reliable message is limited by what it wraps and dropped before it is
+// acknowledged, so the client backs off and retransmits it later.
+func (s *Server) limited(addr net.Addr, kind byte, body []byte) bool {
+	if kind == chat.MessageReliable && len(body) > chat.MessageIDSize {
+		kind = body[chat.MessageIDSize]
+	}
+	switch kind {
+	case chat.MessageChat, chat.MessageDirect, chat.MessageJoin, chat.MessageLeave, chat.MessagePeer, chat.MessageRelay, chat.MessageWho:
+		return !s.messages.Allow(addr.String(), time.Now())
+	}
+	return false
+}
+
+// Acts on a message from the client, which may have been delivered in
+// order by the reliable channel.
+func (s *Server) dispatch(c *Client, kind byte, body []byte, reliable bool) {
+	switch kind {
+	case chat.MessageChat:
+		s.MessageReceive(c, body, reliable)
+	case chat.MessageJoin:
+		s.Join(c, string(body), reliable)
+	case chat.MessageLeave:
+		s.Leave(c, reliable)
+	case chat.MessageDirect:
+		if to, message, err := chat.DirectSplit(body); err != nil {
+			log.Printf("invalid direct message from %s: %s\n", c.identity, err)
+		} else {
+			s.Direct(c, to, message, reliable)
+		}
+	case chat.MessageWhois:
+		s.Whois(c, string(body), reliable)
+	case chat.MessageWho:
+		s.Who(c, reliable)
+	case chat.MessagePeer:
+		if pub, to, _, err := chat.PeerSplit(body); err != nil {
+			log.Printf("invalid peer request from %s: %s\n", c.identity, err)
+		} else {
+			s.Introduce(c, pub, to, reliable)
+		}
+	case chat.MessageRelay:
+		if to, frame, err := chat.DirectSplit(body); err != nil {
+			log.Printf("invalid relay from %s: %s\n", c.identity, err)
+		} else {
+			s.Relay(c, to, frame)
+		}
+	case chat.MessagePing:
+		s.Pong(c, body)
+	case chat.MessagePong:
+		if rtt, err := chat.RoundTrip(body); err != nil {
+			log.Printf("invalid pong from %s: %s\n", c.identity, err)
+		} else {
+			c.latency.Sample(rtt)
+		}
+	case chat.MessageRekey:
+		if err := c.keys.Follow(body); err != nil {
+			log.Printf("invalid rekey from %s: %s\n", c.identity, err)
+		}
+	case chat.MessageDisconnected:
+		log.Printf("%s disconnected: %s (%s)\n", c.identity, string(body), c.Metrics())
+		s.remove(c.id)
+	default:
+		log.Printf("unexpected %s message from %s\n", chat.MessageName(kind), c.identity)
+	}
+}
+
+// Establishes a session under a new connection id, using the first
+// cipher suite offered by the client that we allow, the highest protocol
+// version we both speak and the capabilities we both have.
+//
+// The reply holds our box key, our identity key, the chosen version,
+// capabilities and suite, and a signature over both box keys and what
+// was offered and chosen, followed by the connection id and reset token
+// sealed under the new session key so only the client can read them.
+//
+// A client speaking only versions we do not is refused with a reason.
+//
+// Handshakes are refused with a disconnect once the server is shutting
+// down.
+//
+// A signed handshake must verify, and the identity must be free or bound
+// to the key that signed it in the Registry, which binds it on first use.
+//
+// A handshake without a valid cookie is answered with a retry instead,
+// and one over the rate limit for its address is dropped, both before any
+// key work is done.  Malformed handshakes are dropped without a reply,
+// since it could be larger than they are.
+func (s *Server) HandshakeReceive(addr net.Addr, shake []byte) {
+	if atomic.LoadInt32(&s.stopping) == 1 {
+		s.Disconnected(addr, "server shutting down...")
+		return
+	}
+	requested, _ := chat.HelloVersion(shake)
+	version, err := chat.ChooseVersion(requested)
+	if err != nil {
+		atomic.AddUint64(&s.counters.unrecognized, 1)
+		log.Printf("refusing handshake from %s: %s\n", addr.String(), err)
+		s.Refuse(addr, err.Error(), len(chat.Signature)+1+len(shake))
+		return
+	}
+	h, err := chat.HandshakeSplit(shake)
+	if err != nil {
+		atomic.AddUint64(&s.counters.unrecognized, 1)
+		log.Printf("handshake failed (%d bytes): %s", len(shake), err)
+		return
+	} else if !s.validCookie(addr, h.Cookie) {
+		if len(h.Cookie) > 0 {
+			atomic.AddUint64(&s.counters.badCookies, 1)
+		}
+		atomic.AddUint64(&s.counters.challenges, 1)
+		s.Retry(addr)
+		return
+	} else if !s.handshakes.Allow(addr.String(), time.Now()) {
+		atomic.AddUint64(&s.counters.handshakesLimited, 1)
+		log.Printf("dropped handshake from %s over the rate limit\n", addr.String())
+		return
+	} else if err := chat.ValidIdentity(h.Identity); err != nil {
+		log.Printf("invalid identity %q from %s, sending disconnected...\n", h.Identity, addr.String())
+		s.Disconnected(addr, err.Error())
+		return
+	} else if h.PublicKey != nil && !h.Verify() {
+		log.Printf("invalid identity signature for %s from %s\n", h.Identity, addr.String())
+		s.Disconnected(addr, "invalid identity signature...")
+		return
+	}
+	suite, err := chat.ChooseSuite(h.Suites, s.Suites)
+	if err != nil {
+		log.Printf("handshake failed for %s offering %v: %s\n", h.Identity, h.Suites, err)
+		s.Disconnected(addr, err.Error())
+		return
+	}
+
+	var key [chat.KeySize]byte
+	box.Precompute(&key, &h.Key, &s.priv)
+
+	capabilities := h.Capabilities & s.Capabilities
+	c := &Client{identity: h.Identity, key: append(ed25519.PublicKey(nil), h.PublicKey...), keys: chat.NewKeyRing(suite, key, chat.DirectionToClient, chat.DirectionToServer), version: version, capabilities: capabilities}
+	c.reliable = chat.NewReliable(func(kind byte, body []byte) error {
+		s.MessageSend(c, kind, body)
+		return nil
+	})
+	c.reliable.OnFail = func(d chat.Delivery) {
+		log.Printf("gave up on reliable delivery to %s: %s\n", c.identity, string(d.Body))
+	}
+	c.SetAddr(addr)
+	c.Touch()
+	if err := s.register(c); err == errIdentityInUse || err == errIdentityKeyRequired || err == errIdentityKeyMismatch {
+		log.Printf("rejecting %s from %s: %s\n", c.identity, addr.String(), err)
+		s.Disconnected(addr, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("failed to register %s: %s\n", c.identity, err)
+		return
+	}
+
+	// sign our box key together with the clients key, so a captured reply
+	// cannot be replayed against a different handshake, along with the
+	// suites, versions and capabilities so the offer cannot be downgraded
+	signature := ed25519.Sign(s.identity, chat.HandshakeTranscript(&s.pub, h, version, capabilities, suite))
+
+	var nonce [chat.NaClNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		log.Printf("failed to generate nonce: %s\n", err)
+		return
+	}
+	session := make([]byte, chat.ConnectionIDSize, chat.ConnectionIDSize+chat.ResetTokenSize)
+	binary.BigEndian.PutUint32(session, c.id)
+	session = append(session, s.ResetToken(c.id)...)
+
+	reply := &chat.HandshakeReply{Key: s.pub, Identity: s.identity.Public().(ed25519.PublicKey), Version: version, Capabilities: capabilities, Suite: suite, Signature: signature}
+	reply.Sealed = box.SealAfterPrecomputation(append([]byte(nil), nonce[:]...), session, &nonce, &key)
+	data := chat.ClearFrame(chat.MessageHandshake, reply.Body())
+	if _, err := s.c.WriteTo(data, addr); err != nil {
+		log.Printf("failed to write handshake message to %s: %s", addr.String(), err)
+		s.Disconnected(addr, "failed to send handshake reply...")
+		return
+	}
+
+	log.Printf("Established connection %d with %s at %s using %s, version %d with %s\n", c.id, c.identity, addr.String(), suite, version, capabilities)
+}
+
+// Periodically evicts clients that have been idle longer than the timeout,
+// telling each one why with an authenticated disconnect.
+func (s *Server) reap() {
+	t := time.NewTicker(s.Timeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case now := <-t.C:
+			s.handshakes.Prune(now)
+			s.messages.Prune(now)
+			s.refusals.Prune(now)
+			s.expireOffers(now)
+			for _, c := range s.Clients() {
+				if idle := now.Sub(c.Seen()); idle > s.Timeout {
+					log.Printf("evicting %s after %s idle\n", c.identity, idle)
+					s.Disconnect(c, "idle timeout...")
+				}
+			}
+		}
+	}
+}
+
+// The token proving a reset came from us, which depends only on our
+// identity and the connection id so that it survives a restart.
+func (s *Server) ResetToken(id uint32) []byte {
+	var b [chat.ConnectionIDSize]byte
+	binary.BigEndian.PutUint32(b[:], id)
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(b[:])
+	return mac.Sum(nil)[:chat.ResetTokenSize]
+}
+
+// Tells the sender of a frame for an unknown connection id to start over.
+//
+// The reply is smaller than any sealed frame, so it cannot be used to
+// amplify traffic towards a spoofed address.
+func (s *Server) Reset(addr net.Addr, id uint32) {
+	body := make([]byte, chat.ConnectionIDSize, chat.ConnectionIDSize+chat.ResetTokenSize)
+	binary.BigEndian.PutUint32(body, id)
+	s.c.WriteTo(chat.ClearFrame(chat.MessageReset, append(body, s.ResetToken(id)...)), addr)
+}
+
+// Sends a disconnected message to an address without a session, with a
+// reason that might be useful with an interactive interface or for
+// debugging.
+//
+// Since it cannot be authenticated, clients ignore it once they have
+// established a session.
+func (s *Server) Disconnected(addr net.Addr, reason string) {
+	s.c.WriteTo(chat.ClearFrame(chat.MessageDisconnected, []byte(reason)), addr)
+}
+
+// Refuses a handshake we cannot read, such as one for a protocol version
+// we do not speak, with a reason cut short where needed so the reply is no
+// larger than the datagram it answers, since the address has not proven
+// it can receive from us and may be spoofed.
+//
+// @note: a client of the first protocol answers a cleartext disconnected
+// message with another handshake, so each address is only refused once
+// a minute and its handshakes are dropped in between, or the two would
+// trade datagrams for as long as the client runs.
+func (s *Server) Refuse(addr net.Addr, reason string, size int) {
+	if !s.refusals.Allow(addr.String(), time.Now()) {
+		return
+	}
+	if room := size - len(chat.Signature) - 1; len(reason) > room {
+		if room <= 0 {
+			return
+		}
+		reason = reason[:room]
+	}
+	s.Disconnected(addr, reason)
+}
+
+// Sends an authenticated disconnected message and forgets the session.
+func (s *Server) Disconnect(c *Client, reason string) {
+	s.MessageSend(c, chat.MessageDisconnected, []byte(reason))
+	s.remove(c.id)
+}
+
+// Relays the message to every member of the senders room, reliably if it
+// arrived reliably.
+func (s *Server) MessageReceive(sender *Client, message []byte, reliable bool) {
+	if len(message) > chat.MaxMessageSize || (reliable && len(message) > chat.MaxReliableMessageSize) {
+		log.Printf("message received from %s is too large: %s\n", sender.identity, string(message))
+		return
+	}
+
+	room := s.Room(sender)
+	if s.OnMessage != nil {
+		s.OnMessage(sender.identity, room, message)
+	}
+	if err := s.History.Add(Entry{Time: time.Now(), Room: room, Sender: sender.identity, Message: message}); err != nil {
+		log.Printf("failed to record history for #%s: %s\n", room, err)
+	}
+	message = append([]byte(sender.identity+": "), message...)
+
+	// @note: ideally this would send each message on a goroutine,
+	// but simply prefixing with go allows the client to change in the loop
+	// which breaks.
+	//
+	// @note: even with goroutines there may be a bias as to who receives
+	// first due to the map order.
+	//
+	// @note: we send to a snapshot, so clients connecting in parallel may
+	// miss the message, and ones evicted in parallel may still receive it.
+	clients := s.Members(room)
+	log.Printf("Sending %s to %d clients", message, len(clients))
+	for _, client := range clients {
+		s.deliver(client, chat.MessageChat, message, reliable)
+	}
+}
+
+// Sends the message over the reliable channel or as a single frame.
+func (s *Server) deliver(c *Client, kind byte, message []byte, reliable bool) {
+	if !reliable {
+		s.MessageSend(c, kind, message)
+	} else if err := c.reliable.Send(kind, message); err != nil {
+		log.Printf("failed to send reliably to %s: %s\n", c.identity, err)
+	}
+}
+
+// Seals the message under the next sequence number for the client,
+// fragmenting it if it does not fit a single frame, then rotates the
+// session keys if they are due.
+func (s *Server) MessageSend(c *Client, kind byte, message []byte) {
+	frames, err := c.keys.SealMessage(c.id, kind, message)
+	if err != nil {
+		log.Printf("failed to seal message for %s: %s\n", c.identity, err)
+		return
+	}
+	for _, data := range frames {
+		s.c.WriteTo(data, c.Addr())
+	}
+
+	if data, err := c.keys.RekeyDue(c.id, s.RekeyMessages, s.RekeyInterval); err != nil {
+		log.Printf("failed to rekey %s: %s\n", c.identity, err)
+	} else if data != nil {
+		s.c.WriteTo(data, c.Addr())
+	}
+}
+
+// Answers a ping with its timestamp, so the client can measure the round
+// trip, followed by one of ours for the client to return, so we can too.
+//
+// Pings without a timestamp, or from clients that did not ask for pongs,
+// are only keepalives.
+func (s *Server) Pong(c *Client, ping []byte) {
+	if len(ping) == chat.TimestampSize && c.Has(chat.CapabilityPong) {
+		s.MessageSend(c, chat.MessagePong, append(append([]byte(nil), ping...), chat.PingBody()...))
+	}
+}
+
+// Rotates the session keys of the client immediately.
+func (s *Server) Rekey(c *Client) error {
+	data, err := c.keys.Rekey(c.id)
+	if err != nil {
+		return err
+	}
+	_, err = s.c.WriteTo(data, c.Addr())
+	return err
+}
+
+// A printable fingerprint of the identity public key, in the same
+// format as the client displays when pinning a new server.
+func (s *Server) Fingerprint() string {
+	return chat.Fingerprint(s.identity.Public().(ed25519.PublicKey))
+}
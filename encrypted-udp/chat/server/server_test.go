@@ -0,0 +1,754 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func newServer(t testing.TB) *Server {
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate identity: %s", err)
+	}
+	s := &Server{}
+	if err := s.Init("127.0.0.1:0", identity); err != nil {
+		t.Fatalf("failed to init server: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Opens the handshake reply with our private key, returning the chosen
+// suite, the shared key and the connection id.
+func open(reply []byte, priv *[32]byte) (chat.Suite, [32]byte, uint32, error) {
+	var key, spub [32]byte
+	if !chat.Clear(reply) || reply[len(chat.Signature)] != chat.MessageHandshake {
+		return 0, key, 0, fmt.Errorf("expected handshake reply, got %v", reply)
+	}
+	r, err := chat.ReplySplit(reply[len(chat.Signature)+1:])
+	if err != nil {
+		return 0, key, 0, err
+	}
+
+	spub = r.Key
+	box.Precompute(&key, &spub, priv)
+
+	var nonce [24]byte
+	suite, sealed := r.Suite, r.Sealed
+	copy(nonce[:], sealed)
+	session, ok := box.OpenAfterPrecomputation(nil, sealed[24:], &nonce, &key)
+	if !ok {
+		return 0, key, 0, fmt.Errorf("failed to open handshake session...")
+	}
+	return suite, key, binary.BigEndian.Uint32(session), nil
+}
+
+// Starts a server on loopback and completes a handshake for a peer
+// socket, returning the peer, the session suite keyed for it, and the
+// connection id.
+func handshake(t *testing.T) (*Server, *net.UDPConn, cipher.AEAD, uint32) {
+	s := newServer(t)
+	p := connect(t, s, "bob")
+	return s, p.c, p.aead(), p.id
+}
+
+// Completes a handshake for a new peer socket by handing it straight to
+// the server, without the server reading from its own socket, and with
+// the cookie it would have challenged the peer with.
+//
+// Every suite is offered unless some are given.
+func connect(t testing.TB, s *Server, name string, suites ...chat.Suite) *peer {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	if len(suites) == 0 {
+		suites = chat.Suites
+	}
+	addr := c.LocalAddr().(*net.UDPAddr)
+	s.HandshakeReceive(addr, chat.HandshakeBody(pub, suites, s.cookie(addr, time.Now()), name))
+
+	suite, key, id, err := open(read(t, c), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &peer{c: c, suite: suite, key: key, id: id}
+}
+
+// A simulated client talking to a running server over loopback.
+type peer struct {
+	c     *net.UDPConn
+	suite chat.Suite
+	key   [32]byte
+	id    uint32
+	seq   uint64
+}
+
+// The session suite keyed for the peer.
+func (p *peer) aead() cipher.AEAD {
+	return p.suite.AEAD(&p.key)
+}
+
+// A ring the peer can seal and open with as the session rotates.
+func (p *peer) ring() *chat.KeyRing {
+	return chat.NewKeyRing(p.suite, p.key, chat.DirectionToServer, chat.DirectionToClient)
+}
+
+// Connects to the server, retrying the handshake since datagrams may be
+// dropped when many clients connect at once.
+//
+// Each attempt uses a new socket, so a late reply to an abandoned attempt
+// cannot be mistaken for the session the server kept, and starts without
+// a cookie so the server challenges it first.
+func join(server *net.UDPAddr, name string) (*peer, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, chat.BufferSize)
+	for attempt := 0; attempt < 10; attempt++ {
+		c, err := net.DialUDP("udp", nil, server)
+		if err != nil {
+			return nil, err
+		}
+		// ports are reused, so a stray reply meant for another peer is
+		// possible and simply counts as a failed attempt
+		var cookie []byte
+		var n int
+		for {
+			if _, err = c.Write(chat.ClearFrame(chat.MessageHello, chat.HandshakeBody(pub, chat.Suites, cookie, name))); err != nil {
+				break
+			}
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			if n, err = c.Read(b); err != nil || cookie != nil || !chat.Clear(b[:n]) || b[len(chat.Signature)] != chat.MessageRetry {
+				break
+			}
+			cookie = append([]byte(nil), b[len(chat.Signature)+1:n]...)
+		}
+		if err != nil {
+			c.Close()
+			continue
+		}
+		suite, key, id, err := open(b[:n], priv)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		return &peer{c: c, suite: suite, key: key, id: id}, nil
+	}
+	return nil, fmt.Errorf("%s failed to handshake", name)
+}
+
+func read(t testing.TB, c *net.UDPConn) []byte {
+	b := make([]byte, chat.BufferSize)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	return b[:n]
+}
+
+func seal(t testing.TB, key cipher.AEAD, id uint32, seq uint64, kind byte, message string) []byte {
+	data, err := chat.SealFrame(key, chat.DirectionToServer, id, seq, kind, []byte(message))
+	if err != nil {
+		t.Fatalf("failed to seal frame: %s", err)
+	}
+	return data
+}
+
+// A frame the server sealed, such as a disconnect, sent back to it does
+// not open, so it cannot be used to end the session.
+func TestReflected(t *testing.T) {
+	s, peer, key, id := handshake(t)
+	reflected, err := chat.SealFrame(key, chat.DirectionToClient, id, 1, chat.MessageDisconnected, []byte("bye"))
+	if err != nil {
+		t.Fatalf("failed to seal frame: %s", err)
+	}
+	s.MessageProcess(peer.LocalAddr(), reflected)
+	if _, ok := s.lookup(id); !ok {
+		t.Fatal("expected the session to survive a reflected disconnect...")
+	}
+}
+
+func TestMessageReplay(t *testing.T) {
+	s, peer, key, id := handshake(t)
+	addr := peer.LocalAddr().(*net.UDPAddr)
+
+	captured := [][]byte{
+		seal(t, key, id, 1, chat.MessageChat, "one"),
+		seal(t, key, id, 2, chat.MessageChat, "two"),
+		seal(t, key, id, 3, chat.MessageChat, "three"),
+	}
+
+	// reordered, then every captured packet replayed
+	for _, i := range []int{1, 0, 2, 0, 1, 2} {
+		s.MessageProcess(addr, captured[i])
+	}
+
+	c, _ := s.lookup(id)
+	stats := c.window.Stats()
+	if stats.Accepted != 3 || stats.Duplicate != 3 {
+		t.Fatalf("expected 3 accepted and 3 duplicates, got %#v", stats)
+	}
+
+	// only the accepted messages are relayed, numbered in order
+	for i, expected := range []string{"bob: two", "bob: one", "bob: three"} {
+		seq, kind, message, err := chat.OpenFrame(key, chat.DirectionToClient, read(t, peer))
+		if err != nil {
+			t.Fatalf("failed to open relayed message: %s", err)
+		} else if kind != chat.MessageChat || seq != uint64(i+1) || string(message) != expected {
+			t.Fatalf("expected %d %s, got %d %s", i+1, expected, seq, message)
+		}
+	}
+}
+
+func TestResetAndDisconnect(t *testing.T) {
+	s, peer, key, id := handshake(t)
+	addr := peer.LocalAddr().(*net.UDPAddr)
+
+	// a frame for an unknown session is answered with a verifiable reset
+	s.MessageProcess(addr, seal(t, key, id+1, 1, chat.MessageChat, "lost"))
+	reset := read(t, peer)
+	if !chat.Clear(reset) || reset[len(chat.Signature)] != chat.MessageReset {
+		t.Fatalf("expected reset, got %v", reset)
+	} else if !bytes.Equal(reset[len(chat.Signature)+1+chat.ConnectionIDSize:], s.ResetToken(id+1)) {
+		t.Fatal("reset token does not match...")
+	}
+
+	// an authenticated disconnect removes the session
+	s.MessageProcess(addr, seal(t, key, id, 1, chat.MessageDisconnected, "goodbye"))
+	if _, ok := s.lookup(id); ok {
+		t.Fatal("expected session to be removed...")
+	}
+}
+
+func TestIdleEviction(t *testing.T) {
+	s, peer, key, id := handshake(t)
+	s.Timeout = 20 * time.Millisecond
+	go s.reap()
+
+	seq, kind, reason, err := chat.OpenFrame(key, chat.DirectionToClient, read(t, peer))
+	if err != nil {
+		t.Fatalf("failed to open eviction notice: %s", err)
+	} else if seq != 1 || kind != chat.MessageDisconnected {
+		t.Fatalf("expected disconnect, got %d %d %s", seq, kind, reason)
+	}
+
+	// the notice is sent just before the session is forgotten
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, ok := s.lookup(id); !ok {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("expected idle session to be evicted...")
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	s, peer, key, id := handshake(t)
+	c, _ := s.lookup(id)
+	atomic.StoreInt64(&c.seen, 0)
+
+	s.MessageProcess(peer.LocalAddr().(*net.UDPAddr), seal(t, key, id, 1, chat.MessagePing, ""))
+	if time.Since(c.Seen()) > time.Second {
+		t.Fatal("expected ping to refresh last seen...")
+	}
+}
+
+// A ping with a timestamp is answered with it and one of ours, which the
+// client returns so we measure the round trip as well.
+func TestPing(t *testing.T) {
+	s := newServer(t)
+	alice := connect(t, s, "alice")
+	ping := chat.PingBody()
+	alice.send(t, s, chat.MessagePing, ping)
+
+	_, kind, pong, err := chat.OpenFrame(alice.aead(), chat.DirectionToClient, read(t, alice.c))
+	if err != nil || kind != chat.MessagePong || len(pong) != 2*chat.TimestampSize || !bytes.Equal(pong[:chat.TimestampSize], ping) {
+		t.Fatalf("expected our timestamp back, got %d %v: %v", kind, pong, err)
+	}
+	alice.send(t, s, chat.MessagePong, pong[chat.TimestampSize:])
+	if m := alice.client(t, s).Metrics(); m.Samples != 1 || m.Received != 2 || m.Lost != 0 {
+		t.Fatalf("expected a round trip from two messages, got %#v", m)
+	}
+
+	// a bare keepalive is not answered
+	alice.send(t, s, chat.MessagePing, nil)
+	alice.quiet(t)
+}
+
+// Clients of the unversioned protocol, or of a version we no longer
+// speak, are told why they are refused, in no more bytes than they sent
+// and only once from each address, while newer clients are answered with
+// our version and only the capabilities both sides have are used.
+func TestVersions(t *testing.T) {
+	s := newServer(t)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer c.Close()
+	addr := c.LocalAddr().(*net.UDPAddr)
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+
+	_, refusal := chat.ChooseVersion(1)
+	old := &chat.Handshake{Version: 1, Key: *pub, Suites: chat.Suites, Identity: "bob"}
+	unversioned := chat.ClearFrame(chat.MessageHandshake, old.Body()[chat.HelloHeaderSize:])
+	for _, frame := range [][]byte{
+		unversioned,
+		chat.ClearFrame(chat.MessageHello, old.Body()),
+		chat.ClearFrame(chat.MessageHello, []byte{1, 0, 0, 0, 0}),
+	} {
+		o, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("failed to listen: %s", err)
+		}
+		defer o.Close()
+		s.MessageProcess(o.LocalAddr(), frame)
+		reply := read(t, o)
+		reason := string(reply[len(chat.Signature)+1:])
+		if reply[len(chat.Signature)] != chat.MessageDisconnected || reason == "" || !strings.HasPrefix(refusal.Error(), reason) {
+			t.Fatalf("expected the version to be refused, got %q", reply)
+		} else if len(reply) > len(frame) {
+			t.Fatalf("expected a refusal of at most %d bytes, got %d", len(frame), len(reply))
+		}
+
+		// an old client answers the refusal with another handshake
+		s.MessageProcess(o.LocalAddr(), unversioned)
+		o.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if n, err := o.Read(make([]byte, chat.BufferSize)); err == nil {
+			t.Fatalf("expected the address to be refused only once, got %d bytes", n)
+		}
+	}
+
+	newer := &chat.Handshake{Version: chat.ProtocolVersion + 1, Capabilities: chat.CapabilityHistory | 1<<20, Key: *pub, Suites: chat.Suites, Cookie: s.cookie(addr, time.Now()), Identity: "carol"}
+	s.HandshakeReceive(addr, newer.Body())
+	reply := read(t, c)
+	r, err := chat.ReplySplit(reply[len(chat.Signature)+1:])
+	if err != nil || r.Version != chat.ProtocolVersion || r.Capabilities != chat.CapabilityHistory {
+		t.Fatalf("expected version %d with history, got %+v %v", chat.ProtocolVersion, r, err)
+	} else if !ed25519.Verify(r.Identity, chat.HandshakeTranscript(&r.Key, newer, r.Version, r.Capabilities, r.Suite), r.Signature) {
+		t.Fatal("expected the reply to be signed over the negotiation...")
+	}
+	suite, key, id, err := open(reply, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol := &peer{c: c, suite: suite, key: key, id: id}
+
+	// without pongs a timestamped ping is only a keepalive, and without
+	// peers there are no introductions
+	carol.send(t, s, chat.MessagePing, chat.PingBody())
+	carol.quiet(t)
+	carol.send(t, s, chat.MessagePeer, chat.PeerBody(pub, "dave", ""))
+	carol.expect(t, chat.MessageNotice, "peers were not agreed in the handshake...")
+	if stats := s.Stats(); stats.Unrecognized != 6 {
+		t.Fatalf("expected the refusals and dropped handshakes counted, got %#v", stats)
+	}
+}
+
+// No datagram, whether cleartext, garbage or any message sealed under a
+// session, makes the server panic.
+func FuzzMessageProcess(f *testing.F) {
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() { log.SetOutput(os.Stderr) })
+	pub := new([chat.KeySize]byte)
+	f.Add(chat.MessageChat, []byte("hello"), true)
+	f.Add(chat.MessageReliable, append(make([]byte, chat.MessageIDSize), chat.MessageJoin, 'd'), true)
+	f.Add(chat.MessageFragment, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 2, chat.MessageChat, 'x'}, true)
+	f.Add(chat.MessagePeer, chat.PeerBody(pub, "bob", ""), true)
+	f.Add(chat.MessageRelay, chat.DirectBody("bob", []byte("frame")), true)
+	f.Add(chat.MessageHello, chat.ClearFrame(chat.MessageHello, chat.HandshakeBody(pub, chat.Suites, nil, "bob")), false)
+	f.Add(chat.MessageHandshake, chat.ClearFrame(chat.MessageHandshake, []byte{1, 2, 3}), false)
+
+	// the server and sessions are set up once, so each input costs no
+	// more than processing it, with no limit on how often alice sends
+	s := newServer(f)
+	s.messages = Limiter{Rate: math.MaxFloat64, Burst: math.MaxFloat64}
+	bob := connect(f, s, "bob")
+	bob.send(f, s, chat.MessagePing, nil)
+	alice := connect(f, s, "alice")
+	ring := alice.ring()
+	f.Fuzz(func(t *testing.T, kind byte, body []byte, sealed bool) {
+		addr := alice.c.LocalAddr().(*net.UDPAddr)
+		if !sealed {
+			s.MessageProcess(addr, body)
+		} else if frames, err := ring.SealMessage(alice.id, kind, body); err == nil {
+			for _, frame := range frames {
+				s.MessageProcess(addr, frame)
+			}
+		}
+
+		// an input that ended the session or rotated its keys leaves the
+		// rest unable to reach the server, so alice connects again
+		if c, ok := s.lookup(alice.id); ok && c.keys.Epoch() == ring.Epoch() {
+			return
+		} else if ok {
+			s.remove(alice.id)
+		}
+		alice = connect(t, s, "alice")
+		ring = alice.ring()
+	})
+}
+
+// Hundreds of clients handshake and chat at once against a running
+// server, which is meant to be run with -race.
+func TestConcurrentClients(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const clients = 300
+	s := newServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	peers := make([]*peer, clients)
+	errs := make(chan error, clients)
+	var wg sync.WaitGroup
+	for i := range peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := join(s.c.LocalAddr().(*net.UDPAddr), fmt.Sprintf("peer%d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			peers[i] = p
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for _, p := range peers {
+		if _, ok := s.lookup(p.id); !ok {
+			t.Fatalf("expected session %d to be registered", p.id)
+		}
+	}
+
+	// every peer sends one message and reads until it sees a broadcast,
+	// since loopback may still drop some of the fan out
+	var received int64
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			defer p.c.Close()
+			if data, err := chat.SealFrame(p.aead(), chat.DirectionToServer, p.id, 1, chat.MessageChat, []byte("hello")); err == nil {
+				p.c.Write(data)
+			}
+			b := make([]byte, chat.BufferSize)
+			p.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				n, err := p.c.Read(b)
+				if err != nil {
+					return
+				}
+				if _, kind, _, err := chat.OpenFrame(p.aead(), chat.DirectionToClient, b[:n]); err == nil && kind == chat.MessageChat {
+					atomic.AddInt64(&received, 1)
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	if received != clients {
+		t.Fatalf("expected all %d clients to receive a broadcast, got %d", clients, received)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected Run to return the context error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to return once cancelled...")
+	}
+}
+
+// Rotation is forced every two messages sent by the server, while the
+// peer keeps chatting with whatever key it has reached.
+func TestRekey(t *testing.T) {
+	s := newServer(t)
+	p := connect(t, s, "bob")
+	s.RekeyMessages = 2
+	peer, id := p.c, p.id
+	addr := peer.LocalAddr().(*net.UDPAddr)
+	keys := p.ring()
+
+	for i := 0; i < 5; i++ {
+		data, err := keys.Seal(id, chat.MessageChat, []byte(fmt.Sprintf("%d", i)))
+		if err != nil {
+			t.Fatalf("failed to seal: %s", err)
+		}
+		s.MessageProcess(addr, data)
+
+		for {
+			_, kind, body, err := keys.Open(read(t, peer))
+			if err != nil {
+				t.Fatalf("failed to open message %d: %s", i, err)
+			} else if kind == chat.MessageRekey {
+				keys.Follow(body)
+				continue
+			} else if string(body) != fmt.Sprintf("bob: %d", i) {
+				t.Fatalf("unexpected message: %s", body)
+			}
+			break
+		}
+	}
+
+	c, _ := s.lookup(id)
+	if c.keys.Epoch() < 2 || keys.Epoch() != c.keys.Epoch() {
+		t.Fatalf("expected matching epochs of at least 2, got %d and %d", keys.Epoch(), c.keys.Epoch())
+	}
+}
+
+// Reliable messages arriving out of order are acknowledged individually,
+// then relayed reliably in the order they were sent.
+func TestReliable(t *testing.T) {
+	s, peer, key, id := handshake(t)
+	addr := peer.LocalAddr().(*net.UDPAddr)
+
+	wrap := func(n uint64, message string) string {
+		data := make([]byte, chat.MessageIDSize)
+		binary.BigEndian.PutUint64(data, n)
+		return string(append(append(data, chat.MessageChat), message...))
+	}
+	s.MessageProcess(addr, seal(t, key, id, 1, chat.MessageReliable, wrap(2, "second")))
+	s.MessageProcess(addr, seal(t, key, id, 2, chat.MessageReliable, wrap(1, "first")))
+
+	var acks []uint64
+	var relayed []string
+	for len(acks) < 2 || len(relayed) < 2 {
+		_, kind, body, err := chat.OpenFrame(key, chat.DirectionToClient, read(t, peer))
+		if err != nil {
+			t.Fatalf("failed to open frame: %s", err)
+		}
+		switch kind {
+		case chat.MessageAck:
+			acks = append(acks, binary.BigEndian.Uint64(body))
+		case chat.MessageReliable:
+			relayed = append(relayed, string(body[chat.ReliableOverhead:]))
+			s.MessageProcess(addr, seal(t, key, id, uint64(3+len(relayed)), chat.MessageAck, string(body[:chat.MessageIDSize])))
+		default:
+			t.Fatalf("unexpected message type: %d", kind)
+		}
+	}
+
+	if acks[0] != 2 || acks[1] != 1 {
+		t.Fatalf("expected acknowledgements for 2 then 1, got %v", acks)
+	} else if relayed[0] != "bob: first" || relayed[1] != "bob: second" {
+		t.Fatalf("expected messages in order, got %q", relayed)
+	}
+	c, _ := s.lookup(id)
+	if pending := c.reliable.Pending(); len(pending) != 0 {
+		t.Fatalf("expected relayed messages to be acknowledged, got %d pending", len(pending))
+	}
+}
+
+// Reliable messages from one client handled by several workers at once
+// are still relayed in the order they were sent.
+func TestReliableWorkers(t *testing.T) {
+	s, peer, key, id := handshake(t)
+	addr := peer.LocalAddr().(*net.UDPAddr)
+
+	const count = 32
+	// swapped in pairs, so each pair is ready at once as a batch
+	frames := make(chan []byte, count)
+	for i := 0; i < count; i++ {
+		n := i ^ 1
+		data := make([]byte, chat.MessageIDSize)
+		binary.BigEndian.PutUint64(data, uint64(n+1))
+		frames <- seal(t, key, id, uint64(n+1), chat.MessageReliable, string(append(append(data, chat.MessageChat), fmt.Sprint(n+1)...)))
+	}
+	close(frames)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for frame := range frames {
+				s.MessageProcess(addr, frame)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for next := 1; next <= count; {
+		_, kind, body, err := chat.OpenFrame(key, chat.DirectionToClient, read(t, peer))
+		if err != nil {
+			t.Fatalf("failed to open frame: %s", err)
+		} else if kind != chat.MessageReliable {
+			continue
+		} else if relayed := string(body[chat.ReliableOverhead:]); relayed != fmt.Sprintf("bob: %d", next) {
+			t.Fatalf("expected message %d next, got %q", next, relayed)
+		}
+		next++
+	}
+}
+
+// A message too large for one datagram arrives as reordered fragments,
+// and is relayed back fragmented as well.
+func TestFragmentedMessage(t *testing.T) {
+	s := newServer(t)
+	p := connect(t, s, "bob")
+	peer, id := p.c, p.id
+	addr := peer.LocalAddr().(*net.UDPAddr)
+	keys := p.ring()
+
+	message := bytes.Repeat([]byte("abcdefgh"), chat.MaxBodySize/2)
+	frames, err := keys.SealMessage(id, chat.MessageChat, message)
+	if err != nil {
+		t.Fatalf("failed to seal: %s", err)
+	}
+	for i := len(frames) - 1; i >= 0; i-- {
+		s.MessageProcess(addr, frames[i])
+	}
+
+	var r chat.Reassembler
+	for {
+		_, kind, body, err := keys.Open(read(t, peer))
+		if err != nil || kind != chat.MessageFragment {
+			t.Fatalf("expected a fragment, got %d: %v", kind, err)
+		}
+		if kind, body, ok, err := r.Add(body); err != nil {
+			t.Fatalf("failed to reassemble: %s", err)
+		} else if ok {
+			if kind != chat.MessageChat || !bytes.Equal(body, append([]byte("bob: "), message...)) {
+				t.Fatalf("unexpected message of type %d and %d bytes", kind, len(body))
+			}
+			break
+		}
+	}
+}
+
+// Each suite can be negotiated and carries chat both ways, while a client
+// offering nothing the server allows is refused.
+func TestSuites(t *testing.T) {
+	s := newServer(t)
+	s.Replay = -1
+	for _, suite := range chat.Suites {
+		p := connect(t, s, suite.String(), suite)
+		if p.suite != suite {
+			t.Fatalf("expected %s, got %s", suite, p.suite)
+		}
+		p.send(t, s, chat.MessageChat, []byte("hello"))
+		p.expect(t, chat.MessageChat, suite.String()+": hello")
+	}
+
+	s.Suites = []chat.Suite{chat.SuiteNaCl}
+	if p := connect(t, s, "alice", chat.SuiteAES256GCM, chat.SuiteNaCl); p.suite != chat.SuiteNaCl {
+		t.Fatalf("expected nacl, got %s", p.suite)
+	}
+
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer c.Close()
+	s.HandshakeReceive(c.LocalAddr().(*net.UDPAddr), chat.HandshakeBody(new([chat.KeySize]byte), []chat.Suite{chat.SuiteChaCha20Poly1305}, s.cookie(c.LocalAddr(), time.Now()), "carol"))
+	if reply := read(t, c); !chat.Clear(reply) || reply[len(chat.Signature)] != chat.MessageDisconnected {
+		t.Fatalf("expected handshake to be refused, got %v", reply)
+	}
+}
+
+// Shutting down refuses new handshakes and waits for a reliable message
+// to be acknowledged before disconnecting everyone, while a message that
+// is never acknowledged only holds it up until the drain period ends.
+func TestShutdown(t *testing.T) {
+	s := newServer(t)
+	alice, bob := connect(t, s, "alice"), connect(t, s, "bob")
+	running := make(chan error)
+	go func() { running <- s.Run(context.Background()) }()
+
+	s.deliver(alice.client(t, s), chat.MessageChat, []byte("hello"), true)
+	_, kind, body, err := chat.OpenFrame(alice.aead(), chat.DirectionToClient, read(t, alice.c))
+	if err != nil || kind != chat.MessageReliable {
+		t.Fatalf("expected a reliable message, got %d: %v", kind, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	for atomic.LoadInt32(&s.stopping) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer c.Close()
+	s.HandshakeReceive(c.LocalAddr().(*net.UDPAddr), chat.HandshakeBody(new([chat.KeySize]byte), chat.Suites, s.cookie(c.LocalAddr(), time.Now()), "carol"))
+	if reply := read(t, c); !chat.Clear(reply) || reply[len(chat.Signature)] != chat.MessageDisconnected {
+		t.Fatalf("expected handshake to be refused, got %v", reply)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("expected shutdown to wait for the acknowledgement, got %v", err)
+	default:
+	}
+
+	alice.send(t, s, chat.MessageAck, body[:chat.MessageIDSize])
+	if err := <-done; err != nil {
+		t.Fatalf("expected a clean shutdown, got %s", err)
+	} else if err := <-running; err != nil {
+		t.Fatalf("expected Run to return once shut down, got %s", err)
+	}
+	for _, p := range []*peer{alice, bob} {
+		for {
+			_, kind, body, err := chat.OpenFrame(p.aead(), chat.DirectionToClient, read(t, p.c))
+			if err != nil {
+				t.Fatalf("failed to open frame: %s", err)
+			} else if kind == chat.MessageDisconnected {
+				if string(body) != "server shutting down..." {
+					t.Fatalf("unexpected reason: %s", body)
+				}
+				break
+			}
+		}
+	}
+
+	s = newServer(t)
+	alice = connect(t, s, "alice")
+	s.deliver(alice.client(t, s), chat.MessageChat, []byte("hello"), true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the drain to time out, got %v", err)
+	}
+}
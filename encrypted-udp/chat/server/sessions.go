@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+)
+
+// Connection ids are random, so the low bits spread clients evenly.
+const shardCount = 16
+
+type shard struct {
+	mu      sync.RWMutex
+	clients map[uint32]*Client
+}
+
+func (s *Server) shard(id uint32) *shard {
+	return &s.shards[id%shardCount]
+}
+
+func (s *Server) clearClients() {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+		for _, c := range s.shards[i].clients {
+			c.reliable.Close()
+		}
+		s.shards[i].clients = make(map[uint32]*Client, 0)
+		s.shards[i].mu.Unlock()
+	}
+	s.namesMu.Lock()
+	s.names = make(map[string]*Client)
+	s.namesMu.Unlock()
+	s.roomsMu.Lock()
+	s.rooms = make(map[string]map[uint32]*Client)
+	s.roomsMu.Unlock()
+	s.peersMu.Lock()
+	s.offers = make(map[[2]string]offer)
+	s.peersMu.Unlock()
+}
+
+// Registers the client under an unused random connection id, and places
+// it in the default room.
+//
+// A new handshake from the same address replaces its old session, and
+// registrations are serialized so parallel handshakes from one address
+// cannot both be kept.
+//
+// Identities are unique, so a handshake claiming the identity of a
+// confirmed session from another address is refused, while one that was
+// never confirmed, such as when the reply was lost, is replaced.  Only
+// then is the identity checked against the registry, so it is not bound
+// to a key that could not have it.
+func (s *Server) register(c *Client) error {
+	s.registering.Lock()
+	defer s.registering.Unlock()
+
+	addr := c.Addr().String()
+	for _, old := range s.Clients() {
+		if old.Addr().String() == addr {
+			s.remove(old.id)
+		}
+	}
+	s.namesMu.RLock()
+	old, ok := s.names[c.identity]
+	s.namesMu.RUnlock()
+	if ok && old.Confirmed() {
+		return errIdentityInUse
+	} else if err := s.Registry.Register(c.identity, c.key); err != nil {
+		return err
+	} else if ok {
+		s.remove(old.id)
+	}
+
+	var b [chat.ConnectionIDSize]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		c.id = binary.BigEndian.Uint32(b[:])
+		if !chat.ValidConnectionID(c.id) {
+			continue
+		}
+
+		sh := s.shard(c.id)
+		sh.mu.Lock()
+		if _, ok := sh.clients[c.id]; !ok {
+			sh.clients[c.id] = c
+			sh.mu.Unlock()
+			break
+		}
+		sh.mu.Unlock()
+	}
+
+	s.namesMu.Lock()
+	s.names[c.identity] = c
+	s.namesMu.Unlock()
+	s.roomsMu.Lock()
+	s.enter(c, chat.DefaultRoom)
+	s.roomsMu.Unlock()
+	return nil
+}
+
+func (s *Server) lookup(id uint32) (*Client, bool) {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	c, ok := sh.clients[id]
+	return c, ok
+}
+
+// Forgets the session, its identity and its room membership, and stops
+// retransmitting to it.
+func (s *Server) remove(id uint32) {
+	sh := s.shard(id)
+	sh.mu.Lock()
+	c, ok := sh.clients[id]
+	delete(sh.clients, id)
+	sh.mu.Unlock()
+	if !ok {
+		return
+	}
+	c.reliable.Close()
+
+	s.namesMu.Lock()
+	if s.names[c.identity] == c {
+		delete(s.names, c.identity)
+	}
+	s.namesMu.Unlock()
+	s.roomsMu.Lock()
+	s.part(c)
+	s.roomsMu.Unlock()
+}
+
+// A snapshot of the current clients, safe to range over while new
+// clients connect or old ones are evicted.
+func (s *Server) Clients() []*Client {
+	var clients []*Client
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+		for _, c := range s.shards[i].clients {
+			clients = append(clients, c)
+		}
+		s.shards[i].mu.RUnlock()
+	}
+	return clients
+}
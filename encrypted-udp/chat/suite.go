@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// The cipher suites sealed frames may use, chosen during the handshake.
+//
+// Every suite is keyed with the shared key precomputed from the box keys
+// exchanged in the handshake, which itself is always sealed with NaCl.
+type Suite byte
+
+const (
+	SuiteNaCl Suite = iota
+	SuiteAES256GCM
+	SuiteChaCha20Poly1305
+)
+
+// Nonce and authentication tag sizes for each suite.
+const (
+	NaClNonceSize   = 24
+	NaClOverhead    = secretbox.Overhead
+	GCMNonceSize    = 12
+	GCMOverhead     = 16
+	ChaChaNonceSize = chacha20poly1305.NonceSize
+	ChaChaOverhead  = chacha20poly1305.Overhead
+)
+
+// Every suite is offered, in order of preference, unless configured
+// otherwise.
+var Suites = []Suite{SuiteChaCha20Poly1305, SuiteAES256GCM, SuiteNaCl}
+
+var errUnknownSuite = errors.New("unknown cipher suite...")
+var errNoCommonSuite = errors.New("no cipher suite in common...")
+
+var suiteNames = map[Suite]string{
+	SuiteNaCl:             "nacl",
+	SuiteAES256GCM:        "aes-256-gcm",
+	SuiteChaCha20Poly1305: "chacha20-poly1305",
+}
+
+func (s Suite) String() string {
+	if name, ok := suiteNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Reports whether the suite is one we implement.
+func (s Suite) Valid() bool {
+	_, ok := suiteNames[s]
+	return ok
+}
+
+// The size of the random nonce sent with each frame.
+func (s Suite) NonceSize() int {
+	switch s {
+	case SuiteAES256GCM:
+		return GCMNonceSize
+	case SuiteChaCha20Poly1305:
+		return ChaChaNonceSize
+	}
+	return NaClNonceSize
+}
+
+// The size of the authentication tag added to each frame.
+func (s Suite) Overhead() int {
+	switch s {
+	case SuiteAES256GCM:
+		return GCMOverhead
+	case SuiteChaCha20Poly1305:
+		return ChaChaOverhead
+	}
+	return NaClOverhead
+}
+
+// Everything a sealed frame adds to its body under this suite.
+func (s Suite) FrameOverhead() int {
+	return frameHeaderSize + s.NonceSize() + s.Overhead()
+}
+
+// The largest body that fits a single frame under this suite.
+func (s Suite) MaxBodySize() int {
+	return BufferSize - s.FrameOverhead()
+}
+
+// Prepares the suite with the key.
+//
+// @note: every suite accepts a KeySize key, which is the only way these
+// constructors can fail, so their errors are ignored.
+func (s Suite) AEAD(key *[KeySize]byte) cipher.AEAD {
+	switch s {
+	case SuiteAES256GCM:
+		block, _ := aes.NewCipher(key[:])
+		aead, _ := cipher.NewGCM(block)
+		return aead
+	case SuiteChaCha20Poly1305:
+		aead, _ := chacha20poly1305.New(key[:])
+		return aead
+	}
+	return naclAEAD(*key)
+}
+
+// Finds a suite by name.
+func ParseSuite(name string) (Suite, error) {
+	for s, n := range suiteNames {
+		if n == strings.ToLower(strings.TrimSpace(name)) {
+			return s, nil
+		}
+	}
+	return 0, errUnknownSuite
+}
+
+// Parses a comma separated list of suite names in order of preference.
+func ParseSuites(names string) ([]Suite, error) {
+	var suites []Suite
+	for _, name := range strings.Split(names, ",") {
+		s, err := ParseSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, s)
+	}
+	return suites, nil
+}
+
+// Formats suites as the comma separated list ParseSuites accepts.
+func FormatSuites(suites []Suite) string {
+	names := make([]string, 0, len(suites))
+	for _, s := range suites {
+		names = append(names, s.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// Picks the first suite offered by the client that the server allows,
+// so the client decides the order of preference.
+func ChooseSuite(offered []Suite, allowed []Suite) (Suite, error) {
+	for _, o := range offered {
+		for _, a := range allowed {
+			if o == a && o.Valid() {
+				return o, nil
+			}
+		}
+	}
+	return 0, errNoCommonSuite
+}
+
+// NaCl secretbox, which is what box uses after precomputation, behind
+// the same interface as the other suites.
+//
+// Secretbox has no additional data, so a hash of it is mixed into the
+// nonce, which gives a different key stream and authenticator for any
+// other additional data while the nonce sent stays random.
+type naclAEAD [KeySize]byte
+
+func (k naclAEAD) NonceSize() int { return NaClNonceSize }
+func (k naclAEAD) Overhead() int  { return NaClOverhead }
+
+func (k naclAEAD) nonce(nonce, additionalData []byte) *[NaClNonceSize]byte {
+	var n [NaClNonceSize]byte
+	sum := sha256.Sum256(additionalData)
+	for i := range n {
+		n[i] = nonce[i] ^ sum[i]
+	}
+	return &n
+}
+
+func (k naclAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	key := [KeySize]byte(k)
+	return secretbox.Seal(dst, plaintext, k.nonce(nonce, additionalData), &key)
+}
+
+func (k naclAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	key := [KeySize]byte(k)
+	data, ok := secretbox.Open(dst, ciphertext, k.nonce(nonce, additionalData), &key)
+	if !ok {
+		return nil, errFrameDecrypt
+	}
+	return data, nil
+}
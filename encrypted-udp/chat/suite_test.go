@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+// The sizes each suite reports must match what its AEAD actually adds.
+func TestSuiteOverhead(t *testing.T) {
+	var key [KeySize]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	for i, suite := range Suites {
+		aead := suite.AEAD(&key)
+		if aead.NonceSize() != suite.NonceSize() || aead.Overhead() != suite.Overhead() {
+			t.Fatalf("%s reports %d and %d, but uses %d and %d", suite, suite.NonceSize(), suite.Overhead(), aead.NonceSize(), aead.Overhead())
+		} else if suite.FrameOverhead() < MinFrameOverhead || suite.FrameOverhead() > MaxFrameOverhead {
+			t.Fatalf("%s overhead %d is outside %d to %d", suite, suite.FrameOverhead(), MinFrameOverhead, MaxFrameOverhead)
+		}
+
+		nonce := make([]byte, aead.NonceSize())
+		sealed := aead.Seal(nil, nonce, []byte("hello"), nil)
+		if len(sealed) != len("hello")+suite.Overhead() {
+			t.Fatalf("%s sealed %d bytes, expected %d", suite, len(sealed), len("hello")+suite.Overhead())
+		} else if data, err := aead.Open(nil, nonce, sealed, nil); err != nil || !bytes.Equal(data, []byte("hello")) {
+			t.Fatalf("%s failed to open: %v", suite, err)
+		}
+
+		// a ring of another suite cannot open it
+		other := Suites[(i+1)%len(Suites)]
+		frame, _ := SealFrame(aead, DirectionToServer, 1, 1, MessageChat, []byte("hello"))
+		if _, _, _, err := OpenFrame(other.AEAD(&key), DirectionToServer, frame); err == nil {
+			t.Fatalf("%s frame opened with %s...", suite, other)
+		}
+	}
+}
+
+func TestSuiteNegotiation(t *testing.T) {
+	suites, err := ParseSuites("aes-256-gcm, NaCl")
+	if err != nil || len(suites) != 2 || suites[0] != SuiteAES256GCM || suites[1] != SuiteNaCl {
+		t.Fatalf("unexpected suites: %v %v", suites, err)
+	} else if FormatSuites(suites) != "aes-256-gcm,nacl" {
+		t.Fatalf("unexpected format: %s", FormatSuites(suites))
+	} else if _, err := ParseSuites("rot13"); err == nil {
+		t.Fatal("expected unknown suite to fail...")
+	}
+
+	// the client preference wins among the suites the server allows
+	if s, err := ChooseSuite([]Suite{SuiteNaCl, SuiteAES256GCM}, Suites); err != nil || s != SuiteNaCl {
+		t.Fatalf("expected nacl, got %s: %v", s, err)
+	} else if s, err := ChooseSuite([]Suite{Suite(99), SuiteNaCl}, []Suite{Suite(99), SuiteNaCl}); err != nil || s != SuiteNaCl {
+		t.Fatalf("expected unknown suites to be skipped, got %s: %v", s, err)
+	} else if _, err := ChooseSuite([]Suite{SuiteChaCha20Poly1305}, []Suite{SuiteNaCl}); err == nil {
+		t.Fatal("expected no common suite to fail...")
+	}
+}
+
+func TestHandshakeBody(t *testing.T) {
+	var pub [KeySize]byte
+	if _, err := rand.Read(pub[:]); err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	h, err := HandshakeSplit(HandshakeBody(&pub, Suites, []byte("cookie"), "bob"))
+	if err != nil || h.Version != ProtocolVersion || h.Capabilities != Capabilities || h.Key != pub || len(h.Suites) != len(Suites) || string(h.Cookie) != "cookie" || h.Identity != "bob" {
+		t.Fatalf("unexpected handshake: %#v %v", h, err)
+	} else if h.Verify() {
+		t.Fatal("expected an unsigned handshake not to verify...")
+	}
+	for i := range h.Suites {
+		if h.Suites[i] != Suites[i] {
+			t.Fatalf("expected %v, got %v", Suites, h.Suites)
+		}
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate identity: %s", err)
+	}
+	signed := &Handshake{Key: pub, Suites: Suites, Identity: "bob"}
+	signed.Sign(key)
+	if h, err = HandshakeSplit(signed.Body()); err != nil || !h.Verify() || h.Identity != "bob" || !h.PublicKey.Equal(key.Public()) {
+		t.Fatalf("expected the signed handshake to verify: %#v %v", h, err)
+	}
+	h.Identity = "mallory"
+	if h.Verify() {
+		t.Fatal("expected a changed identity not to verify...")
+	}
+
+	header := []byte{ProtocolVersion, 0, 0, 0, 1}
+	for _, body := range [][]byte{nil, header, pub[:], append(pub[:], 0), append(pub[:], 3, 1), append(pub[:], 1, 1), append(pub[:], 1, 1, 0), append(pub[:], 1, 1, 2, 0, 0), append(pub[:], 1, 1, CookieSize+1), append(pub[:], 1, 1, 0, 5, 0)} {
+		if _, err := HandshakeSplit(append(header[:len(header):len(header)], body...)); err == nil {
+			t.Fatalf("expected %d byte handshake to fail...", len(body))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The versions of the wire protocol we speak, which a client states in
+// its handshake and the server answers with the highest both speak.
+//
+// The first version went without a number, so counting starts at 2.
+const (
+	ProtocolVersion    byte = 2
+	MinProtocolVersion byte = 2
+)
+
+// Optional features a client asks for in its handshake, which the server
+// answers with those it also supports, so either side can leave one out
+// without the other sending it messages it will not understand.
+type Capability uint32
+
+const (
+	// the server replays recent messages as MessageHistory
+	CapabilityHistory Capability = 1 << iota
+	// the server introduces clients to each other and relays between them
+	CapabilityPeers
+	// the server answers timestamped pings with a MessagePong
+	CapabilityPong
+)
+
+// Every capability this package implements.
+const Capabilities = CapabilityHistory | CapabilityPeers | CapabilityPong
+
+var capabilityNames = []struct {
+	c    Capability
+	name string
+}{
+	{CapabilityHistory, "history"},
+	{CapabilityPeers, "peers"},
+	{CapabilityPong, "pong"},
+}
+
+// Reports whether every capability in o is in c.
+func (c Capability) Has(o Capability) bool {
+	return c&o == o
+}
+
+func (c Capability) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c.Has(n.c) {
+			names = append(names, n.name)
+			c &^= n.c
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(c)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Chooses the version to speak with a client stating its own, which is
+// the highest both sides speak, or reports why there is none.
+//
+// Clients speak every version from MinProtocolVersion up to the one they
+// state, and any they do not are refused when the reply comes back.
+func ChooseVersion(version byte) (byte, error) {
+	if version < MinProtocolVersion {
+		return 0, fmt.Errorf("protocol version %d is no longer supported, %d to %d required...", version, MinProtocolVersion, ProtocolVersion)
+	} else if version > ProtocolVersion {
+		return ProtocolVersion, nil
+	}
+	return version, nil
+}
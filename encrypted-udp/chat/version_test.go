@@ -0,0 +1,25 @@
+package chat
+
+import "testing"
+
+func TestChooseVersion(t *testing.T) {
+	if v, err := ChooseVersion(ProtocolVersion); err != nil || v != ProtocolVersion {
+		t.Fatalf("expected our own version, got %d %v", v, err)
+	} else if v, err := ChooseVersion(ProtocolVersion + 1); err != nil || v != ProtocolVersion {
+		t.Fatalf("expected a newer client to be answered with our version, got %d %v", v, err)
+	} else if _, err := ChooseVersion(MinProtocolVersion - 1); err == nil {
+		t.Fatal("expected an older version to be refused...")
+	}
+}
+
+func TestCapability(t *testing.T) {
+	both := CapabilityHistory | CapabilityPong
+	if !both.Has(CapabilityPong) || both.Has(CapabilityPeers) || !both.Has(0) {
+		t.Fatal("unexpected capabilities...")
+	}
+	for c, expected := range map[Capability]string{0: "none", both: "history,pong", Capabilities | 1<<31: "history,peers,pong,0x80000000"} {
+		if c.String() != expected {
+			t.Errorf("expected %s, got %s", expected, c)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/client"
+)
+
+var errQuit = errors.New("exiting...")
+
+// A command typed at the prompt as a slash followed by its name and any
+// arguments, which are required when it has a usage.
+type command struct {
+	args string
+	help string
+	run  func(c *client.Client, args string) error
+}
+
+var commands map[string]command
+
+// @note: set up in init, since /help lists the commands it is one of
+func init() {
+	commands = map[string]command{
+		"help":      {help: "list the commands", run: help},
+		"quit":      {help: "leave the server and exit", run: func(*client.Client, string) error { return errQuit }},
+		"nick":      {args: "name", help: "change our username, handshaking again", run: (*client.Client).Nick},
+		"who":       {help: "list who is connected and their rooms", run: func(c *client.Client, _ string) error { return c.Who() }},
+		"join":      {args: "room", help: "move to another room", run: (*client.Client).Join},
+		"leave":     {help: "return to the lobby", run: func(c *client.Client, _ string) error { return c.Leave() }},
+		"msg":       {args: "name message", help: "send a private message, directly once peered (@name message also works)", run: msg},
+		"whois":     {args: "name", help: "show the fingerprint of the key bound to a username", run: (*client.Client).Whois},
+		"peer":      {args: "name", help: "ask to talk to someone directly", run: (*client.Client).PeerRequest},
+		"stats":     {help: "ping the server and show the round trip and loss", run: stats},
+		"reconnect": {help: "handshake with the server again", run: func(c *client.Client, _ string) error { return c.HandshakeSend() }},
+	}
+}
+
+// Runs the command on the line, returning errQuit when it asks to exit.
+func execute(c *client.Client, line string) error {
+	name, args, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	args = strings.TrimSpace(args)
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command /%s, try /help...", name)
+	} else if cmd.args != "" && args == "" {
+		return fmt.Errorf("usage: /%s %s", name, cmd.args)
+	}
+	return cmd.run(c, args)
+}
+
+func help(*client.Client, string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("* %-24s %s\n", strings.TrimSpace("/"+name+" "+commands[name].args), commands[name].help)
+	}
+	return nil
+}
+
+// Sends a private message to a peer directly, or through the server to
+// anyone else.
+func msg(c *client.Client, args string) error {
+	to, message, ok := strings.Cut(args, " ")
+	if !ok {
+		return fmt.Errorf("usage: /msg %s", commands["msg"].args)
+	} else if c.Peered(to) {
+		return c.PeerSend(to, message)
+	}
+	return c.DirectSend(to, message, *reliable)
+}
+
+// Pings the server and prints the metrics once the pong arrives, or after
+// a second without one.
+func stats(c *client.Client, _ string) error {
+	samples := c.Metrics().Samples
+	if err := c.Ping(); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && c.Metrics().Samples == samples; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Println("* " + c.Metrics().String())
+	return nil
+}
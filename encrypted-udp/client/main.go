@@ -2,37 +2,141 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/client"
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/discovery"
 )
 
 var address = flag.String("address", "127.0.0.1:10001", "Address ofn the server we are connecting to")
 var identity = flag.String("username", "", "Name to show in chat")
+var knownHosts = flag.String("known-hosts", "known_hosts", "Path to the file of pinned server identity keys")
+var tofu = flag.Bool("tofu", true, "Trust and pin unknown servers on first use, otherwise reject them")
+var keepalive = flag.Duration("keepalive", client.DefaultKeepalive, "Interval between pings that keep the session alive")
+var rekeyMessages = flag.Uint64("rekey-messages", chat.DefaultRekeyMessages, "Rotate session keys after sealing this many messages")
+var rekeyInterval = flag.Duration("rekey-interval", chat.DefaultRekeyInterval, "Rotate session keys after this much time")
+var reliable = flag.Bool("reliable", false, "Send chat messages reliably, retransmitting until acknowledged")
+var room = flag.String("room", chat.DefaultRoom, "Room to chat in")
+var key = flag.String("key", "", "Path to an ed25519 identity key binding our username on the server, generated when missing")
+var suites = flag.String("suites", chat.FormatSuites(chat.Suites), "Comma separated cipher suites to offer in order of preference")
+var discover = flag.Bool("discover", false, "List the servers on the local network and pick one instead of using the address")
+var group = flag.String("discovery", discovery.Group, "Multicast group servers answer discovery probes on")
+var wait = flag.Duration("discovery-wait", discovery.DefaultWait, "How long to wait for servers to answer a discovery probe")
+
+// Probes for servers and asks which to connect to, listing each with the
+// fingerprint to compare against the one it logs, since announcements are
+// only signed by whoever sent them.
+func pick(reader *bufio.Reader) (string, error) {
+	addr, err := net.ResolveUDPAddr("udp", *group)
+	if err != nil {
+		return "", err
+	}
+	c, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	found, err := discovery.Discover(c, addr, *wait)
+	if err != nil {
+		return "", err
+	} else if len(found) == 0 {
+		return "", fmt.Errorf("no servers answered within %s...", *wait)
+	}
+
+	for i, a := range found {
+		fmt.Printf("%d) %s at %s (%s)\n", i+1, a.Name, a.Address, a.Fingerprint())
+	}
+	for {
+		fmt.Printf("server [1-%d]: ", len(found))
+		line, err := reader.ReadString('\n')
+		if n, convErr := strconv.Atoi(strings.TrimSpace(line)); convErr == nil && n >= 1 && n <= len(found) {
+			return found[n-1].Address, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
 
 func main() {
 	flag.Parse()
 
-	c := &Client{}
-	if err := c.Init(*identity, *address); err != nil {
+	hosts, err := client.LoadKnownHosts(*knownHosts, *tofu)
+	if err != nil {
+		log.Printf("error loading known hosts: %s\n", err)
+		os.Exit(1)
+	}
+
+	offered, err := chat.ParseSuites(*suites)
+	if err != nil {
+		log.Printf("error parsing suites: %s\n", err)
+		os.Exit(1)
+	}
+
+	c := &client.Client{RekeyMessages: *rekeyMessages, RekeyInterval: *rekeyInterval, Suites: offered, Keepalive: *keepalive}
+	if *key != "" {
+		if c.Key, err = chat.LoadIdentity(*key); err != nil {
+			log.Printf("error loading key: %s\n", err)
+			os.Exit(1)
+		}
+		log.Printf("identity fingerprint: %s\n", c.Fingerprint())
+	}
+	reader := bufio.NewReader(os.Stdin)
+	if *discover {
+		if *address, err = pick(reader); err != nil {
+			log.Printf("error discovering servers: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := c.Init(*identity, *address, hosts); err != nil {
 		log.Printf("error initializing: %s\n", err)
 		os.Exit(1)
 	}
 	defer c.Close()
 	log.Printf("%#v\n", c)
+	if *room != chat.DefaultRoom {
+		c.Join(*room)
+	}
 
-	go c.Receive()
+	go c.Run(context.Background())
 
-	reader := bufio.NewReader(os.Stdin)
 	for {
-		message, _ := reader.ReadString('\n')
+		message, readErr := reader.ReadString('\n')
 		message = strings.TrimSpace(message)
-		if message == "quit" || message == "exit" {
+		if message == "quit" || message == "exit" || (readErr != nil && message == "") {
 			log.Printf("exiting...\n")
 			break
 		}
-		if err := c.MessageSend(message); err != nil {
+
+		// @note: lines starting with a slash are commands, see /help, and
+		// lines addressed to @someone are a shorthand for /msg
+		var err error
+		if message == "" {
+			continue
+		} else if message[0] == '/' {
+			if err = execute(c, message); errors.Is(err, errQuit) {
+				log.Printf("exiting...\n")
+				break
+			} else if err != nil {
+				log.Printf("%s\n", err)
+			}
+			continue
+		} else if message[0] == '@' && len(message) > 1 {
+			err = msg(c, message[1:])
+		} else if *reliable {
+			err = c.MessageSendReliable(message)
+		} else {
+			err = c.MessageSend(message)
+		}
+		if err != nil {
 			log.Printf("error sending: %s\n", err)
 		}
 	}
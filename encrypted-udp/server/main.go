@@ -1,20 +1,135 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat"
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/discovery"
+	"github.com/cdelorme/go-experiments/encrypted-udp/chat/server"
 )
 
 var address = flag.String("address", ":10001", "Address of the server we are connecting to (defaults to localhost:10001)")
+var identity = flag.String("identity", "server.key", "Path to the ed25519 identity key, generated when missing")
+var registry = flag.String("registry", "identities", "Path to the file binding usernames to the client keys that first claimed them")
+var history = flag.String("history", "", "Path to append relayed messages to, so recent ones survive a restart (kept in memory only when empty)")
+var historySize = flag.Int("history-size", server.DefaultHistorySize, "Messages kept for each room")
+var historyRooms = flag.Int("history-rooms", server.DefaultHistoryRooms, "Rooms kept in the history, forgetting the least recently used")
+var replay = flag.Int("replay", server.DefaultReplay, "Recent messages sent to clients arriving in a room, or -1 for none")
+var timeout = flag.Duration("timeout", server.DefaultTimeout, "Evict clients that send nothing for this long")
+var rekeyMessages = flag.Uint64("rekey-messages", chat.DefaultRekeyMessages, "Rotate session keys after sealing this many messages")
+var rekeyInterval = flag.Duration("rekey-interval", chat.DefaultRekeyInterval, "Rotate session keys after this much time")
+var drain = flag.Duration("drain", server.DefaultDrain, "How long to wait for reliable messages to be acknowledged when shutting down")
+var handshakeRate = flag.Float64("handshake-rate", server.DefaultHandshakeRate, "Handshakes per second allowed from each address")
+var handshakeBurst = flag.Float64("handshake-burst", server.DefaultHandshakeBurst, "Handshakes allowed from each address in a burst")
+var messageRate = flag.Float64("message-rate", server.DefaultMessageRate, "Relayed messages per second allowed from each address")
+var messageBurst = flag.Float64("message-burst", server.DefaultMessageBurst, "Relayed messages allowed from each address in a burst")
+var suites = flag.String("suites", chat.FormatSuites(chat.Suites), "Comma separated cipher suites clients may choose from")
+var name = flag.String("name", hostname(), "Name announced to clients discovering servers on the local network")
+var group = flag.String("discovery", discovery.Group, "Multicast group to answer discovery probes on, or empty to stay hidden")
+var advertise = flag.String("advertise", "", "Address announced to clients discovering servers (defaults to the listening address)")
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
 
 func main() {
-	s := &Server{}
-	if err := s.Init(*address); err != nil {
+	flag.Parse()
+
+	key, err := chat.LoadIdentity(*identity)
+	if err != nil {
+		log.Printf("error loading identity: %s\n", err)
+		os.Exit(1)
+	}
+
+	identities, err := server.LoadRegistry(*registry)
+	if err != nil {
+		log.Printf("error loading registry: %s\n", err)
+		os.Exit(1)
+	}
+
+	messages, err := server.LoadHistory(*history, *historySize, *historyRooms)
+	if err != nil {
+		log.Printf("error loading history: %s\n", err)
+		os.Exit(1)
+	}
+	defer messages.Close()
+
+	allowed, err := chat.ParseSuites(*suites)
+	if err != nil {
+		log.Printf("error parsing suites: %s\n", err)
+		os.Exit(1)
+	}
+
+	s := &server.Server{
+		Timeout:        *timeout,
+		RekeyMessages:  *rekeyMessages,
+		RekeyInterval:  *rekeyInterval,
+		Suites:         allowed,
+		Registry:       identities,
+		History:        messages,
+		Replay:         *replay,
+		HandshakeRate:  *handshakeRate,
+		HandshakeBurst: *handshakeBurst,
+		MessageRate:    *messageRate,
+		MessageBurst:   *messageBurst,
+	}
+	if err := s.Init(*address, key); err != nil {
 		log.Printf("error initializing: %s\n", err)
 		os.Exit(1)
 	}
-	defer s.Close()
-	log.Printf("%#v\n", s)
-	s.Run()
+	log.Printf("identity fingerprint: %s\n", s.Fingerprint())
+
+	// @note: discovery is a convenience, so failing to join the group only
+	// means clients have to be told the address
+	var responder *discovery.Responder
+	if *group != "" {
+		if *advertise == "" {
+			*advertise = *address
+		}
+		responder = &discovery.Responder{Name: *name, Address: *advertise}
+		if err := responder.Init(*group, key); err != nil {
+			log.Printf("error joining discovery group: %s\n", err)
+			responder = nil
+		} else {
+			go responder.Run(context.Background())
+		}
+	}
+
+	// @note: the first SIGINT or SIGTERM starts a graceful shutdown, and
+	// since stop restores the default handling a second one exits at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() { done <- s.Run(context.Background()) }()
+
+	select {
+	case err := <-done:
+		stop()
+		log.Printf("server stopped unexpectedly: %v\n", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+
+	if responder != nil {
+		responder.Close()
+	}
+	log.Printf("shutting down, draining for up to %s...\n", *drain)
+	drainCtx, cancel := context.WithTimeout(context.Background(), *drain)
+	err = s.Shutdown(drainCtx)
+	cancel()
+	if runErr := <-done; err == nil {
+		err = runErr
+	}
+	log.Printf("dropped traffic: %#v\n", s.Stats())
+	if err != nil {
+		log.Printf("error shutting down: %s\n", err)
+		os.Exit(1)
+	}
+	log.Printf("shutdown complete\n")
 }
@@ -3,30 +3,105 @@ package main
 // A rudimentary client implementation
 //
 // Note that read and write on a connection without a
-// timeout (deadline) will block indefinetally.
+// timeout (deadline) will block indefinetally, so every
+// read and write is given one.
 
 import (
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cdelorme/go-experiments/go-udp/frame"
+	"github.com/cdelorme/go-experiments/uuid"
 )
 
-const bufferSize = 1024
+const bufferSize = frame.MaxFrameSize
+
+var errTooBig = fmt.Errorf("messages must be under %d bytes...", frame.MaxMessageSize)
+
+// Reads and writes give up after the timeout, while the server is pinged
+// every heartbeat, so a timeout means several heartbeats went unanswered.
+//
+// Reconnecting waits for the backoff, which doubles with every attempt
+// that fails up to the maximum.
+const (
+	defaultTimeout    = 5 * time.Second
+	defaultHeartbeat  = time.Second
+	defaultBackoff    = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
 
-var errTooBig = errors.New("messages must be under 1024 characters...")
+// Where the connection to the server stands, as reported to OnStatus.
+type state int
 
+const (
+	// waiting for the first reply since connecting
+	connecting state = iota
+	// the server has replied since we connected
+	connected
+	// the server stopped replying or refused our datagrams
+	unreachable
+)
+
+func (s state) String() string {
+	switch s {
+	case connected:
+		return "connected"
+	case unreachable:
+		return "unreachable"
+	}
+	return "connecting"
+}
+
+// The connection and session fields are guarded by the mutex, since
+// Reconnect replaces them while another goroutine is receiving.
+//
+// Messages and bytes are counted in both directions for /stats, along
+// with the latency smoothed from every /ping the server answers.
+//
+// Command output, such as /help, is written to w, or standard output
+// when it is not set.
+//
+// While running, the server is pinged every Heartbeat, and one that does
+// not reply within the Timeout, or refuses our datagrams because nothing
+// is listening, is reconnected to with exponential backoff.  Every change
+// in state is passed to OnStatus, along with the error that made the
+// server unreachable and how long until we try again.
 type client struct {
-	identity string
+	Timeout    time.Duration
+	Heartbeat  time.Duration
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	OnStatus   func(s state, err error, retry time.Duration)
+
+	w       io.Writer
+	r       io.Reader
+	quit    chan struct{}
+	closing sync.Once
+
+	mu       sync.Mutex
 	c        *net.UDPConn
-	w        io.Writer
-	r        io.Reader
+	identity string
+	address  string
+	room     string
+	state    state
+
+	sent, received           uint64
+	sentBytes, receivedBytes uint64
+	latency                  int64
 }
 
 // Translates the supplied address to a UDP format, and
 // acquires a free local UDP address.
 //
-// Sets the identity if empty to a GUID.
+// Sets the identity if empty to a random UUID, which is taken to be ours
+// until the server replies otherwise.
 //
 // Establishes a connection to the server, and restricts
 // buffer size for predictable behavior.
@@ -41,52 +116,301 @@ func (c *client) Init(identity, address string) error {
 		return err
 	}
 
-	c.identity = identity
-	if c.identity == "" {
-		c.identity = GUID()
+	if identity == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		identity = id.String()
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.Heartbeat <= 0 {
+		c.Heartbeat = defaultHeartbeat
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = defaultBackoff
+	}
+	if c.MaxBackoff < c.Backoff {
+		c.MaxBackoff = defaultMaxBackoff
 	}
 
-	c.c, err = net.DialUDP("udp", localAddr, serverAddr)
+	conn, err := net.DialUDP("udp", localAddr, serverAddr)
 	if err != nil {
 		return err
 	}
 
-	c.c.SetReadBuffer(bufferSize)
-	c.c.SetWriteBuffer(bufferSize)
+	conn.SetReadBuffer(bufferSize)
+	conn.SetWriteBuffer(bufferSize)
+	c.mu.Lock()
+	c.c, c.identity, c.address, c.state = conn, identity, address, connecting
+	if c.quit == nil {
+		c.quit = make(chan struct{})
+	}
+	c.mu.Unlock()
+
+	// the server only learns our identity when we tell it
+	return c.Command("/nick " + identity)
+}
+
+// Tells the server we are leaving, so our identity is free again, then
+// closes the established connection, which stops Run.
+func (c *client) Close() {
+	c.closing.Do(func() { close(c.quit) })
+	c.Command("/quit")
+	c.conn().Close()
+}
+
+func (c *client) conn() *net.UDPConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.c
+}
+
+// The identity prefixed to our messages.
+func (c *client) Identity() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.identity
+}
+
+// Where the connection to the server stands.
+func (c *client) State() state {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
 
-	// @todo: establish deadlines to timeout read and write
-	// only necessary if we want to terminate when the server
-	// is unavailable or becomes unavailable
-	// c.c.SetReadDeadline(time.Now().Add(timeoutDuration))
-	// c.c.SetWriteDeadline(time.Now().Add(timeoutDuration))
+// Records the state and passes it to OnStatus when it changed, or every
+// time the server is unreachable, since each attempt to reconnect waits
+// longer.
+func (c *client) status(s state, err error, retry time.Duration) {
+	c.mu.Lock()
+	changed := c.state != s
+	c.state = s
+	c.mu.Unlock()
+	if (changed || s == unreachable) && c.OnStatus != nil {
+		c.OnStatus(s, err, retry)
+	}
+}
 
+// Replaces the connection with a new one from a new local port, which
+// the server sees as a new client, closing the old one so a receive in
+// progress returns, and returns to the room we were in.
+//
+// @note: Init may fail after it replaced the connection, when telling the
+// server our name, in which case the old one is closed all the same, but
+// one it failed to replace is kept so Run has something to receive on.
+func (c *client) Reconnect() error {
+	old := c.conn()
+	if quit, err := frame.Encode(frame.Frame{Type: frame.MessageCommand, Payload: []byte("/quit")}); err == nil {
+		old.Write(quit)
+	}
+	c.mu.Lock()
+	identity, address, room := c.identity, c.address, c.room
+	c.mu.Unlock()
+	if err := c.Init(identity, address); err != nil {
+		if c.conn() != old {
+			old.Close()
+		}
+		return err
+	}
+	old.Close()
+	if room != "" {
+		return c.Join(room)
+	}
 	return nil
 }
 
-// Abstraction to close the established connection.
-func (c *client) Close() {
-	c.c.Close()
+// Moves to the room, which is remembered for reconnecting.
+func (c *client) Join(room string) error {
+	if err := c.Command("/join " + room); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.room = room
+	c.mu.Unlock()
+	return nil
+}
+
+// Asks the server for another identity, which only becomes ours once the
+// server replies that it is, since it may be taken or not a valid name.
+func (c *client) Nick(identity string) error {
+	return c.Command("/nick " + identity)
+}
+
+// Sends a command for the server as is, which replies only to us.
+func (c *client) Command(command string) error {
+	return c.write(frame.Frame{Type: frame.MessageCommand, Payload: []byte(command)})
+}
+
+// A summary of what was sent and received.
+func (c *client) Stats() string {
+	stats := fmt.Sprintf("sent %d messages (%d bytes), received %d messages (%d bytes) on %s",
+		atomic.LoadUint64(&c.sent), atomic.LoadUint64(&c.sentBytes),
+		atomic.LoadUint64(&c.received), atomic.LoadUint64(&c.receivedBytes), c.conn().LocalAddr())
+	if latency := c.Latency(); latency > 0 {
+		stats += fmt.Sprintf(", latency %s", latency)
+	}
+	return stats
+}
+
+func (c *client) out() io.Writer {
+	if c.w == nil {
+		return os.Stdout
+	}
+	return c.w
+}
+
+// The local address of the connection, which changes with /reconnect.
+func (c *client) LocalAddr() net.Addr {
+	return c.conn().LocalAddr()
+}
+
+// Asks the server to echo the time, which Receive measures the round
+// trip with when the reply arrives, so only our own clock is involved.
+func (c *client) Ping() error {
+	return c.write(frame.Frame{Type: frame.MessagePing, Time: time.Now()})
+}
+
+// The round trip to the server, smoothed the way TCP does so a single
+// slow reply does not swing it, or zero until the first reply.
+func (c *client) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.latency))
 }
 
-// Accepts a message in string format, appends the identity, and
-// sends it over the UDP connection, verifying no errors and the
-// correct number of bytes were written.
+// Records the round trip from a reply to a ping.
+func (c *client) pong(sent time.Time) {
+	rtt := time.Since(sent)
+	if previous := c.Latency(); previous > 0 {
+		rtt = previous - previous/8 + rtt/8
+	}
+	atomic.StoreInt64(&c.latency, int64(rtt))
+}
+
+// Sends the message over the UDP connection as chat, which the server
+// relays with our identity, verifying no errors and the correct number of
+// bytes were written.
 func (c *client) Send(message string) error {
-	send := c.identity + ": " + message
-	if len(send) > bufferSize {
+	if len(message) > frame.MaxMessageSize {
 		return errTooBig
 	}
-	n, err := c.c.Write([]byte(send))
+	return c.write(frame.Frame{Type: frame.MessageChat, Time: time.Now(), Payload: []byte(message)})
+}
+
+func (c *client) write(f frame.Frame) error {
+	send, err := frame.Encode(f)
+	if err != nil {
+		return err
+	}
+	conn := c.conn()
+	conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	n, err := conn.Write(send)
 	if n != len(send) {
 		return fmt.Errorf("Expected to send %d bytes, but send %d instead", len(send), n)
 	}
+	atomic.AddUint64(&c.sent, 1)
+	atomic.AddUint64(&c.sentBytes, uint64(n))
 	return err
 }
 
 // Reads from the connection, passing back both the results and any
-// errors encountered.
+// errors encountered, which include the timeout passing without the
+// server sending anything.
+//
+// Frames are shown as text, the way they always were, while replies to a
+// ping only update the latency and anything else is dropped, so neither
+// is returned.  A reply accepting a new name makes it our identity.
 func (c *client) Receive() (string, error) {
 	b := make([]byte, bufferSize)
-	l, err := c.c.Read(b)
-	return string(b[:l]), err
+	for {
+		conn := c.conn()
+		conn.SetReadDeadline(time.Now().Add(c.Timeout))
+		l, err := conn.Read(b)
+		if err != nil {
+			return string(b[:l]), err
+		}
+		c.status(connected, nil, 0)
+		atomic.AddUint64(&c.received, 1)
+		atomic.AddUint64(&c.receivedBytes, uint64(l))
+		f, err := frame.Decode(b[:l])
+		if err != nil {
+			continue
+		}
+		switch f.Type {
+		case frame.MessageChat:
+			return f.Sender + ": " + string(f.Payload), nil
+		case frame.MessagePrivate:
+			return "(private) " + f.Sender + ": " + string(f.Payload), nil
+		case frame.MessageReply:
+			if identity, ok := strings.CutPrefix(string(f.Payload), "you are now "); ok {
+				c.mu.Lock()
+				c.identity = identity
+				c.mu.Unlock()
+			}
+			return "* " + string(f.Payload), nil
+		case frame.MessagePong:
+			c.pong(f.Time)
+		}
+	}
+}
+
+// Passes everything received to the function until the client is
+// closed, while pinging the server every heartbeat.
+//
+// Any error receiving means the server is unreachable, whether it timed
+// out or refused our datagrams, so we reconnect from a new port after
+// the backoff, which doubles every time until the server replies again.
+//
+// A closed connection while the client is still open was replaced by
+// /reconnect, so we carry on with the new one.
+func (c *client) Run(receive func(message string)) {
+	go c.heartbeat()
+	backoff := c.Backoff
+	for {
+		d, err := c.Receive()
+		if errors.Is(err, net.ErrClosed) {
+			select {
+			case <-c.quit:
+				return
+			default:
+				continue
+			}
+		} else if err == nil {
+			receive(d)
+			continue
+		}
+
+		if c.State() == connected {
+			backoff = c.Backoff
+		}
+		for err != nil {
+			c.status(unreachable, err, backoff)
+			select {
+			case <-c.quit:
+				return
+			case <-time.After(backoff):
+			}
+			err = c.Reconnect()
+			backoff = min(2*backoff, c.MaxBackoff)
+		}
+	}
+}
+
+// Pings the server at once and then every heartbeat until closed, which
+// keeps the latency current and proves the server is still there.
+//
+// Errors sending are left to show up when receiving.
+func (c *client) heartbeat() {
+	t := time.NewTicker(c.Heartbeat)
+	defer t.Stop()
+	for {
+		c.Ping()
+		select {
+		case <-c.quit:
+			return
+		case <-t.C:
+		}
+	}
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/go-udp/frame"
+)
+
+type change struct {
+	s     state
+	err   error
+	retry time.Duration
+}
+
+// A running client with short timeouts, reporting every change in state.
+func running(t *testing.T, address string) (*client, chan change) {
+	changes := make(chan change, 100)
+	c := &client{
+		Timeout:    100 * time.Millisecond,
+		Heartbeat:  20 * time.Millisecond,
+		Backoff:    10 * time.Millisecond,
+		MaxBackoff: 40 * time.Millisecond,
+		OnStatus:   func(s state, err error, retry time.Duration) { changes <- change{s, err, retry} },
+		w:          discard{},
+	}
+	if err := c.Init("alice", address); err != nil {
+		t.Fatalf("failed to init client: %s", err)
+	}
+	t.Cleanup(c.Close)
+	go c.Run(func(string) {})
+	return c, changes
+}
+
+type discard struct{}
+
+func (discard) Write(b []byte) (int, error) { return len(b), nil }
+
+func expectChange(t *testing.T, changes chan change, s state) change {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case c := <-changes:
+			if c.s == s {
+				return c
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting to be %s", s)
+		}
+	}
+}
+
+// A server that goes away refuses our datagrams, so we reconnect with a
+// backoff that doubles up to the maximum, and return to our room once it
+// is back.
+func TestReconnect(t *testing.T) {
+	udp, received := udpServer(t)
+	addr := udp.LocalAddr().(*net.UDPAddr)
+	c, changes := running(t, addr.String())
+	expectChange(t, changes, connected)
+	receive(t, received, "/nick alice")
+	if err := c.Join("room"); err != nil {
+		t.Fatalf("failed to join: %s", err)
+	}
+	receive(t, received, "/join room")
+
+	udp.Close()
+	var retries []time.Duration
+	for len(retries) < 4 {
+		change := expectChange(t, changes, unreachable)
+		if change.err == nil {
+			t.Fatal("expected a reason the server is unreachable...")
+		}
+		retries = append(retries, change.retry)
+	}
+	if retries[0] != 10*time.Millisecond || retries[1] != 20*time.Millisecond || retries[2] != 40*time.Millisecond || retries[3] != 40*time.Millisecond {
+		t.Fatalf("expected the backoff to double up to the maximum, got %v", retries)
+	}
+
+	// the old connection says it is leaving as we reconnect
+	_, received = udpServer(t, addr)
+	expectChange(t, changes, connected)
+	for d := range received {
+		if d != "/quit" {
+			if d != "/nick alice" {
+				t.Fatalf("expected %q, got %q", "/nick alice", d)
+			}
+			break
+		}
+	}
+	receive(t, received, "/join room")
+}
+
+// A server that is there but never replies is unreachable once the
+// heartbeats go unanswered for the timeout.
+func TestMissedHeartbeats(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer silent.Close()
+
+	c, changes := running(t, silent.LocalAddr().String())
+	start := time.Now()
+	change := expectChange(t, changes, unreachable)
+	if !errors.Is(change.err, os.ErrDeadlineExceeded) || time.Since(start) < c.Timeout {
+		t.Fatalf("expected to time out after %s, got %v after %s", c.Timeout, change.err, time.Since(start))
+	}
+}
+
+// Our identity only changes once the server accepts it, so a refused name
+// is neither shown on our messages nor asked for again on reconnecting.
+func TestNick(t *testing.T) {
+	udp, received := udpServer(t)
+	c, changes := running(t, udp.LocalAddr().String())
+	expectChange(t, changes, connected)
+	receive(t, received, "/nick alice")
+	local := c.LocalAddr().(*net.UDPAddr)
+
+	for _, r := range []struct{ nick, reply, identity string }{
+		{"bob", "bob is already in use...", "alice"},
+		{"b b", "usage: /nick name, up to 64 bytes without spaces", "alice"},
+		{"carol", "you are now carol", "carol"},
+	} {
+		if err := c.Nick(r.nick); err != nil {
+			t.Fatalf("failed to ask for %s: %s", r.nick, err)
+		}
+		receive(t, received, "/nick "+r.nick)
+		reply, _ := frame.Encode(frame.Frame{Type: frame.MessageReply, Payload: []byte(r.reply)})
+		udp.WriteToUDP(reply, local)
+		deadline := time.Now().Add(time.Second)
+		for c.Identity() != r.identity && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if c.Identity() != r.identity {
+			t.Fatalf("expected to be %s after %q, got %s", r.identity, r.reply, c.Identity())
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var errQuit = errors.New("exiting...")
+
+// A command typed at the prompt as a slash followed by its name and any
+// arguments, which are required when it has a usage.
+//
+// Commands that need the state of the server, such as /who, are simply
+// sent to it, and it replies with a line starting with an asterisk.
+type command struct {
+	args string
+	help string
+	run  func(c *client, line, args string) error
+}
+
+var commands map[string]command
+
+// @note: set up in init, since /help lists the commands it is one of
+func init() {
+	server := func(c *client, line, _ string) error { return c.Command(line) }
+	commands = map[string]command{
+		"help":      {help: "list the commands", run: help},
+		"quit":      {help: "exit", run: func(*client, string, string) error { return errQuit }},
+		"nick":      {args: "name", help: "change our username", run: func(c *client, _, args string) error { return c.Nick(args) }},
+		"who":       {help: "list who is connected and their rooms", run: server},
+		"join":      {args: "room", help: "move to another room", run: func(c *client, _, args string) error { return c.Join(args) }},
+		"msg":       {args: "name message", help: "send a private message", run: server},
+		"stats":     {help: "show what was sent and received", run: func(c *client, _, _ string) error { fmt.Fprintln(c.out(), "* "+c.Stats()); return nil }},
+		"ping":      {help: "measure the latency to the server, shown by /stats", run: func(c *client, _, _ string) error { return c.Ping() }},
+		"reconnect": {help: "connect again from a new port", run: func(c *client, _, _ string) error { return c.Reconnect() }},
+	}
+}
+
+// Runs the command on the line, returning errQuit when it asks to exit.
+func execute(c *client, line string) error {
+	name, args, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	args = strings.TrimSpace(args)
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command /%s, try /help...", name)
+	} else if cmd.args != "" && args == "" {
+		return fmt.Errorf("usage: /%s %s", name, cmd.args)
+	}
+	return cmd.run(c, line, args)
+}
+
+func help(c *client, _, _ string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(c.out(), "* %-20s %s\n", strings.TrimSpace("/"+name+" "+commands[name].args), commands[name].help)
+	}
+	return nil
+}
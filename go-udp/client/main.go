@@ -2,18 +2,50 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 var address = flag.String("address", "127.0.0.1:10001", "Address ofn the server we are connecting to")
 var identity = flag.String("username", "", "Name to show in chat")
+var webAddress = flag.String("web", "", "Serve a web interface on this address, such as 127.0.0.1:0, instead of reading from the terminal")
+var browser = flag.Bool("browser", true, "Open the web interface in the default browser")
+var timeout = flag.Duration("timeout", defaultTimeout, "Consider the server unreachable after hearing nothing for this long")
+var heartbeat = flag.Duration("heartbeat", defaultHeartbeat, "Interval between pings that prove the server is still there")
+var maxBackoff = flag.Duration("max-backoff", defaultMaxBackoff, "Longest wait between attempts to reconnect, which double from half a second")
+
+// Applies the flags to a client before it connects.
+func configure(c *client) {
+	c.Timeout, c.Heartbeat, c.MaxBackoff = *timeout, *heartbeat, *maxBackoff
+}
 
 func main() {
+	flag.Parse()
+
+	if *webAddress != "" {
+		w := newWeb(*identity, *address, defaultWebInterval)
+		w.configure = configure
+		if err := w.ListenAndServe(*webAddress, *browser); err != nil {
+			log.Printf("error serving the web interface: %s\n", err)
+		}
+		return
+	}
+
 	c := &client{}
+	configure(c)
+	c.OnStatus = func(s state, err error, retry time.Duration) {
+		switch s {
+		case connected:
+			fmt.Printf("* connected to %s from %s\n", *address, c.LocalAddr())
+		case unreachable:
+			fmt.Printf("* server unreachable (%s), reconnecting in %s...\n", err, retry)
+		}
+	}
 	if err := c.Init(*identity, *address); err != nil {
 		log.Printf("error initializing: %s\n", err)
 		return
@@ -21,24 +53,28 @@ func main() {
 	defer c.Close()
 	log.Printf("%#v\n", c)
 
-	go func(c *client) {
-		for {
-			d, err := c.Receive()
-			if err != nil {
-				log.Printf("error receiving: %s\n", err)
-				continue
-			}
-			fmt.Println(d)
-		}
-	}(c)
+	go c.Run(func(message string) { fmt.Println(message) })
 
 	reader := bufio.NewReader(os.Stdin)
 	for {
-		message, _ := reader.ReadString('\n')
+		message, readErr := reader.ReadString('\n')
 		message = strings.TrimSpace(message)
-		if message == "quit" || message == "exit" {
+		if message == "quit" || message == "exit" || (readErr != nil && message == "") {
 			log.Printf("exiting...\n")
 			break
+		} else if message == "" {
+			continue
+		}
+
+		// @note: lines starting with a slash are commands, see /help
+		if message[0] == '/' {
+			if err := execute(c, message); errors.Is(err, errQuit) {
+				log.Printf("exiting...\n")
+				break
+			} else if err != nil {
+				log.Printf("%s\n", err)
+			}
+			continue
 		}
 		if err := c.Send(message); err != nil {
 			log.Printf("error sending: %s\n", err)
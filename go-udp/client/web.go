@@ -1,14 +1,368 @@
 package main
 
-type web struct{}
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
 
-// @todo: auto-launching web server /w handlers for initializing a client
-// then sending and receiving
+//go:embed web.html
+var page []byte
 
-// also provides configurable server address (including port)
+// How often the web interface refreshes the status it shows, unless
+// another interval is given.
+const defaultWebInterval = time.Second
 
-// displays connection errors
+// A local web interface to the client, which configures the server
+// address and identity, sends messages and commands, and streams what
+// is received to the browser as server-sent events.
+//
+// Every message is sent as a "message" event, while a "status" event
+// with the connection, local port, latency and any connection error is
+// sent whenever they change and at each interval.  Clients are set up
+// with configure, if any, before connecting.
+//
+// @note: events are dropped for a browser that falls behind, much like
+// the datagrams themselves, rather than holding up everyone else.
+type web struct {
+	interval  time.Duration
+	configure func(*client)
+	quit      chan struct{}
+	closing   sync.Once
 
-// displays local port (once establsihed)
+	mu          sync.Mutex
+	c           *client
+	identity    string
+	address     string
+	err         string
+	subscribers map[chan event]struct{}
+}
 
-// displays live update of computed latency
+type event struct {
+	name string
+	data string
+}
+
+// What the browser shows about the connection.
+type status struct {
+	Connected bool    `json:"connected"`
+	Identity  string  `json:"identity"`
+	Address   string  `json:"address"`
+	State     string  `json:"state,omitempty"`
+	Local     string  `json:"local,omitempty"`
+	Latency   float64 `json:"latency"`
+	Stats     string  `json:"stats,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Prepares a web interface suggesting the identity and server address,
+// without connecting until asked to.
+func newWeb(identity, address string, interval time.Duration) *web {
+	if interval <= 0 {
+		interval = defaultWebInterval
+	}
+	return &web{
+		interval:    interval,
+		quit:        make(chan struct{}),
+		identity:    identity,
+		address:     address,
+		subscribers: make(map[chan event]struct{}),
+	}
+}
+
+// Serves the web interface on the address until it fails, opening it in
+// the default browser when asked.
+//
+// The address may have port 0, since the actual one is logged.
+func (w *web) ListenAndServe(address string, browser bool) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	go w.keepalive()
+
+	url := "http://" + l.Addr().String() + "/"
+	log.Printf("web interface listening on %s\n", url)
+	if browser {
+		if err := launch(url); err != nil {
+			log.Printf("failed to open a browser, visit %s instead: %s\n", url, err)
+		}
+	}
+	return http.Serve(l, w.handler())
+}
+
+// Opens the url with whatever the platform uses to open things.
+func launch(url string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
+
+func (w *web) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", w.index)
+	mux.HandleFunc("/connect", w.connect)
+	mux.HandleFunc("/send", w.send)
+	mux.HandleFunc("/events", w.events)
+	return local(mux)
+}
+
+// Only answers requests for the listener by its address or as localhost,
+// and from pages it served, since any other page the browser has open
+// could post to it, or rebind its own name to our address to read the
+// events as well.
+func local(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if host != "localhost" && net.ParseIP(host) == nil {
+			http.Error(rw, "only requests for an address or localhost are answered...", http.StatusForbidden)
+			return
+		} else if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+			http.Error(rw, "requests from other pages are not answered...", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// Stops pinging and disconnects.
+func (w *web) Close() {
+	w.closing.Do(func() { close(w.quit) })
+	w.Disconnect()
+}
+
+func (w *web) current() *client {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.c
+}
+
+// Replaces any connection with a new one to the address, under the
+// identity, or a generated one when empty.
+//
+// @note: another connect may finish while this one is under way, so the
+// client it made is closed when ours replaces it, rather than left running.
+func (w *web) Connect(identity, address string) error {
+	w.Disconnect()
+	c := &client{w: publisher{w}, OnStatus: w.onStatus}
+	if w.configure != nil {
+		w.configure(c)
+	}
+	err := c.Init(identity, address)
+
+	var replaced *client
+	w.mu.Lock()
+	w.identity, w.address = identity, address
+	if err != nil {
+		w.err = err.Error()
+	} else {
+		replaced, w.c, w.err = w.c, c, ""
+	}
+	w.mu.Unlock()
+
+	if replaced != nil {
+		replaced.Close()
+	}
+	if err == nil {
+		go c.Run(func(message string) { w.publish("message", message) })
+	}
+	w.publishStatus()
+	return err
+}
+
+// Tells the server we are leaving and closes the connection, if any.
+func (w *web) Disconnect() {
+	w.mu.Lock()
+	c := w.c
+	w.c = nil
+	w.mu.Unlock()
+	if c != nil {
+		c.Close()
+		w.publishStatus()
+	}
+}
+
+// Shows why the server is unreachable until it replies again.
+func (w *web) onStatus(s state, err error, retry time.Duration) {
+	w.mu.Lock()
+	if s == unreachable {
+		w.err = fmt.Sprintf("server unreachable (%s), reconnecting in %s...", err, retry)
+	} else if s == connected {
+		w.err = ""
+	}
+	w.mu.Unlock()
+	w.publishStatus()
+}
+
+// Publishes the status each interval, which keeps the latency current
+// while the client pings the server.
+func (w *web) keepalive() {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-t.C:
+		}
+		w.publishStatus()
+	}
+}
+
+func (w *web) status() status {
+	w.mu.Lock()
+	c := w.c
+	s := status{Connected: c != nil, Identity: w.identity, Address: w.address, Error: w.err}
+	w.mu.Unlock()
+	if c != nil {
+		s.Identity = c.Identity()
+		s.State = c.State().String()
+		s.Local = c.LocalAddr().String()
+		s.Latency = float64(c.Latency()) / float64(time.Millisecond)
+		s.Stats = c.Stats()
+	}
+	return s
+}
+
+func (w *web) publishStatus() {
+	b, _ := json.Marshal(w.status())
+	w.publish("status", string(b))
+}
+
+func (w *web) publish(name, data string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for s := range w.subscribers {
+		select {
+		case s <- event{name: name, data: data}:
+		default:
+		}
+	}
+}
+
+// Sends output from commands, such as /help, to the browser.
+type publisher struct{ w *web }
+
+func (p publisher) Write(b []byte) (int, error) {
+	p.w.publish("message", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+func (w *web) index(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(rw, r)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Write(page)
+}
+
+// Connects to the address and username posted, answering with the error
+// when that fails.
+func (w *web) connect(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "connect with a POST...", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := w.Connect(strings.TrimSpace(r.FormValue("username")), strings.TrimSpace(r.FormValue("address"))); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Sends the message posted, or runs it as a command when it starts with
+// a slash, just as the terminal does.
+//
+// Our own messages are published back, since the server does not relay
+// them to us.
+func (w *web) send(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "send with a POST...", http.StatusMethodNotAllowed)
+		return
+	}
+	message := strings.TrimSpace(r.FormValue("message"))
+	c := w.current()
+	if c == nil {
+		http.Error(rw, "not connected...", http.StatusConflict)
+		return
+	} else if message == "" {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var err error
+	if message[0] == '/' {
+		if err = execute(c, message); errors.Is(err, errQuit) {
+			w.Disconnect()
+			err = nil
+		}
+		w.publishStatus()
+	} else if err = c.Send(message); err == nil {
+		w.publish("message", c.Identity()+": "+message)
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Streams events to the browser, starting with the status, until it goes
+// away.
+func (w *web) events(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming is not supported...", http.StatusInternalServerError)
+		return
+	}
+	s := make(chan event, 64)
+	w.mu.Lock()
+	w.subscribers[s] = struct{}{}
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.subscribers, s)
+		w.mu.Unlock()
+	}()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	b, _ := json.Marshal(w.status())
+	e := event{name: "status", data: string(b)}
+	for {
+		// @note: each line of the data needs its own field
+		fmt.Fprintf(rw, "event: %s\n", e.name)
+		for _, line := range strings.Split(e.data, "\n") {
+			fmt.Fprintf(rw, "data: %s\n", line)
+		}
+		fmt.Fprint(rw, "\n")
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-w.quit:
+			return
+		case e = <-s:
+		}
+	}
+}
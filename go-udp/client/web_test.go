@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/go-udp/frame"
+)
+
+// A stand in for the server on loopback, which answers pings and hands
+// the payload of everything else it receives to the test.
+//
+// The address may be given to restart one that was closed.
+func udpServer(t *testing.T, address ...*net.UDPAddr) (*net.UDPConn, chan string) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if len(address) > 0 {
+		addr = address[0]
+	}
+	c, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	received := make(chan string, 100)
+	go func() {
+		b := make([]byte, bufferSize)
+		for {
+			n, addr, err := c.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			f, err := frame.Decode(b[:n])
+			if err != nil {
+				t.Errorf("failed to decode %x: %s", b[:n], err)
+				continue
+			} else if f.Type == frame.MessagePing {
+				pong, _ := frame.Encode(frame.Frame{Type: frame.MessagePong, Time: f.Time})
+				c.WriteToUDP(pong, addr)
+				continue
+			}
+			received <- string(f.Payload)
+		}
+	}()
+	return c, received
+}
+
+// Serves the web interface and subscribes to its events.
+func webServer(t *testing.T, w *web) (*httptest.Server, chan event) {
+	ts := httptest.NewServer(w.handler())
+	t.Cleanup(func() {
+		w.Close()
+		ts.Close()
+	})
+	res, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	} else if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", res.Header.Get("Content-Type"))
+	}
+	events := make(chan event, 100)
+	go func() {
+		defer res.Body.Close()
+		var e event
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				e.name = name
+			} else if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				e.data = data
+			} else if scanner.Text() == "" {
+				events <- e
+				e = event{}
+			}
+		}
+	}()
+	return ts, events
+}
+
+func post(t *testing.T, ts *httptest.Server, path string, form url.Values) int {
+	res, err := http.PostForm(ts.URL+path, form)
+	if err != nil {
+		t.Fatalf("failed to post %s: %s", path, err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+// Waits for an event with the name that matches.
+func expect(t *testing.T, events chan event, name string, match func(string) bool) string {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.name == name && match(e.data) {
+				return e.data
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s event", name)
+		}
+	}
+}
+
+func expectStatus(t *testing.T, events chan event, match func(status) bool) status {
+	var s status
+	expect(t, events, "status", func(data string) bool {
+		return json.Unmarshal([]byte(data), &s) == nil && match(s)
+	})
+	return s
+}
+
+func receive(t *testing.T, received chan string, expected string) {
+	select {
+	case d := <-received:
+		if d != expected {
+			t.Fatalf("expected %q, got %q", expected, d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %q", expected)
+	}
+}
+
+func TestWeb(t *testing.T) {
+	udp, received := udpServer(t)
+	w := newWeb("", udp.LocalAddr().String(), 10*time.Millisecond)
+	ts, events := webServer(t, w)
+	go w.keepalive()
+
+	res, err := http.Get(ts.URL)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to load the page: %v", err)
+	}
+	res.Body.Close()
+	expectStatus(t, events, func(s status) bool { return !s.Connected && s.Address == udp.LocalAddr().String() })
+
+	if code := post(t, ts, "/connect", url.Values{"address": {udp.LocalAddr().String()}, "username": {"alice"}}); code != http.StatusNoContent {
+		t.Fatalf("failed to connect: %d", code)
+	}
+	receive(t, received, "/nick alice")
+	s := expectStatus(t, events, func(s status) bool { return s.Connected && s.Latency > 0 })
+	if s.Identity != "alice" || s.Local == "" {
+		t.Fatalf("expected alice with a local address, got %#v", s)
+	}
+
+	if code := post(t, ts, "/send", url.Values{"message": {"hello"}}); code != http.StatusNoContent {
+		t.Fatalf("failed to send: %d", code)
+	}
+	receive(t, received, "hello")
+	expect(t, events, "message", func(d string) bool { return d == "alice: hello" })
+
+	local, _ := net.ResolveUDPAddr("udp", s.Local)
+	chat, _ := frame.Encode(frame.Frame{Type: frame.MessageChat, Sender: "bob", Payload: []byte("hi alice")})
+	udp.WriteToUDP(chat, local)
+	expect(t, events, "message", func(d string) bool { return d == "bob: hi alice" })
+
+	post(t, ts, "/send", url.Values{"message": {"/stats"}})
+	expect(t, events, "message", func(d string) bool { return strings.HasPrefix(d, "* sent ") && strings.Contains(d, "latency") })
+
+	post(t, ts, "/send", url.Values{"message": {"/quit"}})
+	receive(t, received, "/quit")
+	expectStatus(t, events, func(s status) bool { return !s.Connected })
+	if code := post(t, ts, "/send", url.Values{"message": {"hello"}}); code != http.StatusConflict {
+		t.Fatalf("expected sending without a connection to conflict, got %d", code)
+	}
+}
+
+// Connecting several times at once leaves one client running, and every
+// other is closed, so each tells the server it is leaving.
+func TestWebConnectRace(t *testing.T) {
+	udp, received := udpServer(t)
+	w := newWeb("", udp.LocalAddr().String(), time.Second)
+	defer w.Close()
+
+	// every connect is under way before any of them finishes
+	const count = 8
+	var arrived sync.WaitGroup
+	arrived.Add(count)
+	w.configure = func(*client) {
+		arrived.Done()
+		arrived.Wait()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.Connect("alice", udp.LocalAddr().String()); err != nil {
+				t.Errorf("failed to connect: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	w.Disconnect()
+
+	var nicks, quits int
+	timeout := time.After(2 * time.Second)
+	for quits < count {
+		select {
+		case d := <-received:
+			if d == "/nick alice" {
+				nicks++
+			} else if d == "/quit" {
+				quits++
+			}
+		case <-timeout:
+			t.Fatalf("expected all %d clients to quit, got %d of %d", count, quits, nicks)
+		}
+	}
+}
+
+// Requests for another name, which may have been rebound to us, or from
+// another page, are refused.
+func TestWebOrigin(t *testing.T) {
+	w := newWeb("alice", "", 10*time.Millisecond)
+	ts, _ := webServer(t, w)
+	port := ts.URL[strings.LastIndex(ts.URL, ":"):]
+
+	for _, r := range []struct {
+		method, path, host, origin string
+		code                       int
+	}{
+		{http.MethodGet, "/events", "attacker.example" + port, "", http.StatusForbidden},
+		{http.MethodGet, "/", "attacker.example", "", http.StatusForbidden},
+		{http.MethodPost, "/send", "", "http://attacker.example", http.StatusForbidden},
+		{http.MethodPost, "/connect", "", "null", http.StatusForbidden},
+		{http.MethodPost, "/send", "", ts.URL, http.StatusConflict},
+		{http.MethodGet, "/", "localhost" + port, "", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(r.method, ts.URL+r.path, strings.NewReader("message=hi"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if r.host != "" {
+			req.Host = r.host
+		}
+		if r.origin != "" {
+			req.Header.Set("Origin", r.origin)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to %s %s: %s", r.method, r.path, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != r.code {
+			t.Fatalf("expected %d for %s %s from %q for %q, got %d", r.code, r.method, r.path, r.origin, r.host, res.StatusCode)
+		}
+	}
+}
+
+// Connection errors are answered and shown, including a server that is
+// not running, which only shows once a ping is refused.
+func TestWebErrors(t *testing.T) {
+	w := newWeb("alice", "", 10*time.Millisecond)
+	ts, events := webServer(t, w)
+	go w.keepalive()
+
+	if code := post(t, ts, "/connect", url.Values{"address": {"127.0.0.1:port"}, "username": {"alice"}}); code != http.StatusBadGateway {
+		t.Fatalf("expected a bad address to fail, got %d", code)
+	}
+	expectStatus(t, events, func(s status) bool { return !s.Connected && s.Error != "" })
+
+	udp, _ := udpServer(t)
+	closed := udp.LocalAddr().String()
+	udp.Close()
+	if code := post(t, ts, "/connect", url.Values{"address": {closed}, "username": {"alice"}}); code != http.StatusNoContent {
+		t.Fatalf("expected to connect without a reply, got %d", code)
+	}
+	expectStatus(t, events, func(s status) bool { return s.Connected && strings.Contains(s.Error, "refused") })
+}
@@ -0,0 +1,115 @@
+package frame
+
+// The datagrams exchanged by the go-udp client and server, which say what
+// kind of message they carry and who sent it, rather than leaving both to
+// guess from text that anyone could have typed.
+//
+// Every frame is laid out as:
+//
+//	type    1 byte
+//	sender  1 byte of length, then up to MaxSenderSize bytes
+//	time    8 bytes of unix nanoseconds, big endian, or 0 for none
+//	payload whatever remains
+//
+// @note: the sender is set by the server from the client it registered,
+// so whatever a client puts there is ignored.
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The message types, and what their payloads hold:
+//
+//	MessageChat     client  the message, relayed to the room with the sender
+//	MessageCommand  client  a command as typed, such as "/join room"
+//	MessageReply    server  the reply to a command, only to the client
+//	MessagePrivate  server  a /msg, with the sender
+//	MessagePing     client  nothing, with the time to echo
+//	MessagePong     server  nothing, with the time pinged
+const (
+	MessageChat byte = iota
+	MessageCommand
+	MessageReply
+	MessagePrivate
+	MessagePing
+	MessagePong
+
+	messageTypes
+)
+
+// Messages are limited so the server can always frame them again with
+// any sender.
+const (
+	MaxFrameSize   = 1024
+	MaxSenderSize  = 64
+	HeaderSize     = 1 + 1 + 8
+	MaxMessageSize = MaxFrameSize - HeaderSize - MaxSenderSize
+)
+
+var errFrameTooBig = errors.New("frames must be under 1024 bytes...")
+var errFrameTooSmall = errors.New("frame is too small...")
+var errSenderTooBig = errors.New("sender must be under 64 bytes...")
+var errUnknownMessage = errors.New("unknown message type...")
+
+// A message of one of the types, from the sender at the time.
+type Frame struct {
+	Type    byte
+	Sender  string
+	Time    time.Time
+	Payload []byte
+}
+
+// The most payload a frame from the sender can carry.
+func MaxPayloadSize(sender string) int {
+	return MaxFrameSize - HeaderSize - len(sender)
+}
+
+// Lays out the frame in a new slice, which is never more than
+// MaxFrameSize bytes.
+func Encode(f Frame) ([]byte, error) {
+	if f.Type >= messageTypes {
+		return nil, errUnknownMessage
+	} else if len(f.Sender) > MaxSenderSize {
+		return nil, errSenderTooBig
+	} else if len(f.Payload) > MaxPayloadSize(f.Sender) {
+		return nil, errFrameTooBig
+	}
+
+	var ts int64
+	if !f.Time.IsZero() {
+		ts = f.Time.UnixNano()
+	}
+	b := make([]byte, 0, HeaderSize+len(f.Sender)+len(f.Payload))
+	b = append(b, f.Type, byte(len(f.Sender)))
+	b = append(b, f.Sender...)
+	b = binary.BigEndian.AppendUint64(b, uint64(ts))
+	return append(b, f.Payload...), nil
+}
+
+// Reads a frame laid out by Encode, whose payload is part of the slice,
+// so it must be copied before the slice is reused.
+func Decode(b []byte) (Frame, error) {
+	var f Frame
+	if len(b) > MaxFrameSize {
+		return f, errFrameTooBig
+	} else if len(b) < HeaderSize {
+		return f, errFrameTooSmall
+	} else if b[0] >= messageTypes {
+		return f, errUnknownMessage
+	}
+
+	n := int(b[1])
+	if n > MaxSenderSize {
+		return f, errSenderTooBig
+	} else if len(b) < HeaderSize+n {
+		return f, errFrameTooSmall
+	}
+	f.Type, f.Sender = b[0], string(b[2:2+n])
+	if ts := int64(binary.BigEndian.Uint64(b[2+n:])); ts != 0 {
+		f.Time = time.Unix(0, ts)
+	}
+	f.Payload = b[HeaderSize+n:]
+	return f, nil
+}
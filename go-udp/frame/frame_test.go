@@ -0,0 +1,98 @@
+package frame
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrame(t *testing.T) {
+	now := time.Now()
+	for kind := byte(0); kind < messageTypes; kind++ {
+		for _, f := range []Frame{
+			{Type: kind, Sender: "alice", Time: now, Payload: []byte("hello")},
+			{Type: kind},
+			{Type: kind, Sender: strings.Repeat("a", MaxSenderSize), Payload: make([]byte, MaxPayloadSize(strings.Repeat("a", MaxSenderSize)))},
+		} {
+			b, err := Encode(f)
+			if err != nil {
+				t.Fatalf("failed to encode %d: %s", kind, err)
+			} else if len(b) != HeaderSize+len(f.Sender)+len(f.Payload) || len(b) > MaxFrameSize {
+				t.Fatalf("frame is %d bytes, expected %d", len(b), HeaderSize+len(f.Sender)+len(f.Payload))
+			}
+
+			d, err := Decode(b)
+			if err != nil {
+				t.Fatalf("failed to decode %d: %s", kind, err)
+			} else if d.Type != f.Type || d.Sender != f.Sender || !d.Time.Equal(f.Time) || !bytes.Equal(d.Payload, f.Payload) {
+				t.Fatalf("expected %#v, got %#v", f, d)
+			}
+		}
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	long := strings.Repeat("a", MaxSenderSize+1)
+	for _, f := range []Frame{
+		{Type: messageTypes},
+		{Sender: long},
+		{Sender: "alice", Payload: make([]byte, MaxPayloadSize("alice")+1)},
+	} {
+		if _, err := Encode(f); err == nil {
+			t.Fatalf("expected %d byte sender, %d byte payload and type %d to fail...", len(f.Sender), len(f.Payload), f.Type)
+		}
+	}
+
+	valid, _ := Encode(Frame{Type: MessageChat, Sender: "alice", Payload: []byte("hello")})
+	for _, b := range [][]byte{
+		nil,
+		valid[:HeaderSize-1],
+		valid[:HeaderSize+len("alice")-1],
+		append([]byte{messageTypes}, valid[1:]...),
+		append([]byte{MessageChat, MaxSenderSize + 1}, append([]byte(long), valid[7:]...)...),
+		append(valid, make([]byte, MaxFrameSize)...),
+	} {
+		if _, err := Decode(b); err == nil {
+			t.Fatalf("expected %x to fail...", b)
+		}
+	}
+}
+
+// Whatever decodes encodes back to the same bytes, so nothing in a frame
+// is lost or reinterpreted along the way.
+func FuzzDecode(f *testing.F) {
+	valid, _ := Encode(Frame{Type: MessageChat, Sender: "alice", Time: time.Now(), Payload: []byte("hello")})
+	f.Add(valid)
+	f.Add([]byte{MessagePing, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		d, err := Decode(b)
+		if err != nil {
+			return
+		}
+		e, err := Encode(d)
+		if err != nil {
+			t.Fatalf("failed to encode what decoded: %s", err)
+		} else if !bytes.Equal(e, b) {
+			t.Fatalf("expected %x, got %x", b, e)
+		}
+	})
+}
+
+func BenchmarkEncode(b *testing.B) {
+	f := Frame{Type: MessageChat, Sender: "alice", Time: time.Now(), Payload: []byte("hello, how is everyone?")}
+	for i := 0; i < b.N; i++ {
+		if _, err := Encode(f); err != nil {
+			b.Fatalf("failed to encode: %s", err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	e, _ := Encode(Frame{Type: MessageChat, Sender: "alice", Time: time.Now(), Payload: []byte("hello, how is everyone?")})
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(e); err != nil {
+			b.Fatalf("failed to decode: %s", err)
+		}
+	}
+}
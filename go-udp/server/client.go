@@ -1,10 +1,24 @@
 package main
 
 import (
-	"net"
+	"net/netip"
 )
 
-// This is the server-side representation of a client
+// This is the server-side representation of a client, which is known by
+// its address until it tells us its identity with /nick.
+//
+// Only the server goroutine changes the identity and room, while the
+// workers sending to it only read the address, which never changes.
 type client struct {
-	a *net.UDPAddr
+	a        netip.AddrPort
+	identity string
+	room     string
+}
+
+// The identity of the client, or its address if it has not set one.
+func (c *client) Name() string {
+	if c.identity == "" {
+		return c.a.String()
+	}
+	return c.identity
 }
@@ -6,14 +6,18 @@ import (
 )
 
 var address = flag.String("address", ":10001", "Address ofn the server we are connecting to")
+var workers = flag.Int("workers", defaultWorkers, "Goroutines sending broadcasts to clients")
+var queue = flag.Int("queue", defaultQueue, "Broadcasts waiting for a worker before more are dropped")
 
 func main() {
-	s := &server{}
+	flag.Parse()
+
+	s := &server{Workers: *workers, Queue: *queue}
 	if err := s.Init(*address); err != nil {
 		log.Printf("error initializing: %s\n", err)
 		return
 	}
 	defer s.Close()
-	log.Printf("%#v\n", s)
+	log.Printf("listening on %s\n", s.c.LocalAddr())
 	s.Run()
 }
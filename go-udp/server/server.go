@@ -1,19 +1,94 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cdelorme/go-experiments/go-udp/frame"
 )
 
-const bufferSize = 1024
+const bufferSize = frame.MaxFrameSize
+
+var tooLong = fmt.Sprintf("messages must be under %d bytes...", frame.MaxMessageSize)
+
+// Names and rooms are shown to everyone and sent as the sender of every
+// frame, so they are limited to what fits there, and may not hold spaces,
+// which /msg splits on, or anything unprintable, or be an address, which
+// is the name of every client that has not picked one.
+func validName(name string) bool {
+	if name == "" || len(name) > frame.MaxSenderSize || !utf8.ValidString(name) {
+		return false
+	} else if _, err := netip.ParseAddrPort(name); err == nil {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+var nameRules = fmt.Sprintf("up to %d bytes without spaces, and not an address", frame.MaxSenderSize)
+
+// Clients start in this room, and messages are only distributed to the
+// clients in the same room as the sender.
+const defaultRoom = "lobby"
+
+// Broadcasts wait in a queue of this size for one of the workers, of
+// which there is one per CPU, unless the server is given other sizes.
+const defaultQueue = 1024
+
+var defaultWorkers = runtime.NumCPU()
 
 // A server implementation with the ability to track multiple clients.
 //
-// In the future it may make sense to benchmark slice search vs maps
-// with up to 10,000 elements.
+// Clients are found by address in a map, while each room keeps a slice
+// of its members to send to, which the benchmarks compare with searching
+// a slice of every client.
+//
+// Received chat is framed again with the sender and time set here, so a
+// client cannot pass itself off as another, and queued as a broadcast to
+// the members of the room, which a fixed pool of workers sends, so reading
+// never waits on sending and the buffer read into can be reused at once.
+// When the queue is full the broadcast is dropped and counted, much as a
+// busy network would drop the datagrams, rather than growing without
+// bound during a burst.
+//
+// @note: the workers send in parallel, so two messages from one client
+// may arrive reordered, which UDP never promised not to do anyway.
 type server struct {
+	Workers int
+	Queue   int
+
 	c       *net.UDPConn
-	clients map[string]client
+	clients map[netip.AddrPort]*client
+	rooms   map[string][]*client
+	queue   chan broadcast
+	workers sync.WaitGroup
+
+	sent, dropped uint64
+}
+
+// A message and the clients it is for, except one, usually the sender.
+//
+// Neither are modified once queued, so the workers can read them while
+// the server carries on.
+type broadcast struct {
+	message []byte
+	to      []*client
+	except  *client
 }
 
 // Establish a connection on the supplied address, and set
@@ -22,7 +97,7 @@ type server struct {
 // Equal size buffers avoids DoS concerns.
 //
 // Finally initializes the map of clients which will be
-// used to distribute messages.
+// used to distribute messages, and starts the workers.
 func (s *server) Init(address string) error {
 	serverAddr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
@@ -34,57 +109,251 @@ func (s *server) Init(address string) error {
 	}
 	s.c.SetReadBuffer(bufferSize)
 	s.c.SetWriteBuffer(bufferSize)
-	s.clients = make(map[string]client, 0)
+	s.clients = make(map[netip.AddrPort]*client)
+	s.rooms = make(map[string][]*client)
+
+	if s.Workers <= 0 {
+		s.Workers = defaultWorkers
+	}
+	if s.Queue <= 0 {
+		s.Queue = defaultQueue
+	}
+	s.queue = make(chan broadcast, s.Queue)
+	for i := 0; i < s.Workers; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
 	return nil
 }
 
-// Abstraction to close the established connection.
+// Abstraction to close the established connection, which stops Run.
 func (s *server) Close() {
 	s.c.Close()
 }
 
-// Prepares a reusable buffer to reduce allocations, and infinitely loops
-// reading from the connection.
-//
-// It collects client representations by address in string format, so
-// it can distribute received messages all all clients.
-//
-// The distribution method leverages goroutines so each send is not
-// waiting on the other receive.
+// Prepares a reusable buffer to reduce allocations, and loops reading
+// from the connection until it is closed, when the workers are stopped
+// once they finish what was queued.
 //
 // Keep in mind this has no protection from garbage input.
-//
-// The distribution method, while concurrent, will be biased by the
-// earliest element in the map when iterated.
 func (s *server) Run() {
+	defer s.drain()
 	b := make([]byte, bufferSize)
 	for {
-		n, addr, err := s.c.ReadFromUDP(b)
-		if err != nil {
+		n, addr, err := s.c.ReadFromUDPAddrPort(b)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			log.Printf("error receiving: %s\n", err)
 			continue
 		} else if n == 0 {
 			continue
 		}
-		if _, ok := s.clients[addr.String()]; !ok {
-			s.clients[addr.String()] = client{a: addr}
+		// @note: a socket listening on every address sees IPv4 senders as
+		// mapped IPv6 addresses, which are unmapped so they show as usual
+		s.Receive(netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()), b[:n])
+	}
+}
+
+// Stops the workers after they send everything queued, after which
+// nothing else may be.
+func (s *server) drain() {
+	close(s.queue)
+	s.workers.Wait()
+}
+
+// Handles a datagram from the address, which is not kept after this
+// returns, dropping any that is not a frame a client may send.
+//
+// It collects client representations by address, so it can distribute
+// received messages to all clients in the same room.
+//
+// Commands for the server rather than chat are handled by Command, and
+// pings are answered with the time they carried.
+func (s *server) Receive(addr netip.AddrPort, datagram []byte) {
+	f, err := frame.Decode(datagram)
+	if err != nil {
+		log.Printf("dropped a datagram from %s: %s\n", addr, err)
+		return
+	} else if f.Type != frame.MessageChat && f.Type != frame.MessageCommand && f.Type != frame.MessagePing {
+		log.Printf("dropped a frame of type %d from %s, which only the server sends\n", f.Type, addr)
+		return
+	}
+	c, ok := s.clients[addr]
+	if !ok {
+		c = &client{a: addr, room: defaultRoom}
+		s.clients[addr] = c
+		s.enter(c)
+	}
+
+	switch f.Type {
+	case frame.MessageChat:
+		if len(f.Payload) > frame.MaxMessageSize {
+			s.Send(s.frame(frame.MessageReply, "", []byte(tooLong)), c)
+			break
 		}
-		for i := range s.clients {
-			if s.clients[i].a.String() == addr.String() {
-				continue
-			}
-			go s.Send(b[:n], s.clients[i])
+		s.Broadcast(s.frame(frame.MessageChat, c.Name(), f.Payload), s.rooms[c.room], c)
+	case frame.MessageCommand:
+		s.Command(c, string(f.Payload))
+	case frame.MessagePing:
+		if pong, err := frame.Encode(frame.Frame{Type: frame.MessagePong, Time: f.Time}); err == nil {
+			s.Send(pong, c)
 		}
 	}
 }
 
-// Accepts the message in byte array format and a client to
-// send the message to.
-func (s *server) Send(message []byte, c client) {
-	n, err := s.c.WriteToUDP(message, c.a)
+// Frames the payload from the sender at the current time, in a new slice
+// that is never modified, so it can be queued.
+//
+// @note: messages are limited to what fits with any sender, so this only
+// fails if that is forgotten
+func (s *server) frame(kind byte, sender string, payload []byte) []byte {
+	b, err := frame.Encode(frame.Frame{Type: kind, Sender: sender, Time: time.Now(), Payload: payload})
 	if err != nil {
+		log.Printf("failed to frame a message from %s: %s\n", sender, err)
+	}
+	return b
+}
+
+// Adds the client to the members of its room, replacing the slice rather
+// than appending to it in place, since queued broadcasts may be reading
+// it.
+func (s *server) enter(c *client) {
+	members := s.rooms[c.room]
+	s.rooms[c.room] = append(members[:len(members):len(members)], c)
+}
+
+// Removes the client from the members of its room, replacing the slice
+// for the same reason.
+func (s *server) leave(c *client) {
+	members := s.rooms[c.room]
+	kept := make([]*client, 0, len(members))
+	for _, m := range members {
+		if m != c {
+			kept = append(kept, m)
+		}
+	}
+	if len(kept) == 0 {
+		delete(s.rooms, c.room)
+	} else {
+		s.rooms[c.room] = kept
+	}
+}
+
+// Handles a command from the client, replying only to it.
+//
+// Commands hold the state of the client, including the identity the
+// server sends its chat with.
+func (s *server) Command(c *client, command string) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(command, "/"), " ")
+	args = strings.TrimSpace(args)
+
+	var reply string
+	switch name {
+	case "nick":
+		if !validName(args) {
+			reply = "usage: /nick name, " + nameRules
+			break
+		}
+		for _, other := range s.clients {
+			if other.Name() == args && other != c {
+				reply = fmt.Sprintf("%s is already in use...", args)
+			}
+		}
+		if reply == "" {
+			c.identity = args
+			reply = fmt.Sprintf("you are now %s", args)
+		}
+	case "who":
+		online := make([]string, 0, len(s.clients))
+		for _, other := range s.clients {
+			online = append(online, fmt.Sprintf("%s (#%s)", other.Name(), other.room))
+		}
+		sort.Strings(online)
+		reply = fmt.Sprintf("%d online: %s", len(online), strings.Join(online, ", "))
+	case "join":
+		if !validName(args) {
+			reply = "usage: /join room, " + nameRules
+			break
+		}
+		s.leave(c)
+		c.room = args
+		s.enter(c)
+		reply = fmt.Sprintf("joined #%s", args)
+	case "msg":
+		to, message, ok := strings.Cut(args, " ")
+		if !ok {
+			reply = "usage: /msg name message"
+			break
+		} else if len(message) > frame.MaxMessageSize {
+			reply = tooLong
+			break
+		}
+		reply = fmt.Sprintf("%s is not connected...", to)
+		for _, other := range s.clients {
+			if other.identity == to {
+				s.Send(s.frame(frame.MessagePrivate, c.Name(), []byte(message)), other)
+				reply = ""
+			}
+		}
+	case "quit":
+		s.leave(c)
+		delete(s.clients, c.a)
+		return
+	default:
+		reply = fmt.Sprintf("unknown command /%s...", name)
+	}
+
+	if reply != "" {
+		s.Send(s.frame(frame.MessageReply, "", []byte(reply)), c)
+	}
+}
+
+// Queues the message for a single client.
+func (s *server) Send(message []byte, c *client) {
+	s.Broadcast(message, []*client{c}, nil)
+}
+
+// Queues the message for the clients, except one, dropping it when the
+// queue is full.
+//
+// Neither the message nor the slice may be modified afterwards.
+func (s *server) Broadcast(message []byte, to []*client, except *client) {
+	select {
+	case s.queue <- broadcast{message: message, to: to, except: except}:
+	default:
+		if dropped := atomic.AddUint64(&s.dropped, 1); dropped%1000 == 1 {
+			log.Printf("send queue is full, %d broadcasts dropped so far...\n", dropped)
+		}
+	}
+}
+
+func (s *server) work() {
+	defer s.workers.Done()
+	for b := range s.queue {
+		for _, c := range b.to {
+			if c != b.except {
+				s.write(b.message, c)
+			}
+		}
+	}
+}
+
+func (s *server) write(message []byte, c *client) {
+	n, err := s.c.WriteToUDPAddrPort(message, c.a)
+	if errors.Is(err, net.ErrClosed) {
+		return
+	} else if err != nil {
 		log.Printf("failed to send: %s\n", err)
 	} else if n != len(message) {
 		log.Printf("expected to write %d bytes, but wrote %d instead...", len(message), n)
+	} else {
+		atomic.AddUint64(&s.sent, 1)
 	}
 }
+
+// Counts of the datagrams sent, and of the broadcasts dropped because the
+// queue was full.
+func (s *server) Stats() (sent, dropped uint64) {
+	return atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.dropped)
+}
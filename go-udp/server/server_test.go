@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cdelorme/go-experiments/go-udp/frame"
+)
+
+func newServer(tb testing.TB, s *server) *server {
+	if err := s.Init("127.0.0.1:0"); err != nil {
+		tb.Fatalf("failed to init server: %s", err)
+	}
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// A client socket on loopback, along with the address the server knows
+// it by.
+func socket(t *testing.T) (*net.UDPConn, netip.AddrPort) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	addr := c.LocalAddr().(*net.UDPAddr).AddrPort()
+	return c, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+func read(t *testing.T, c *net.UDPConn) frame.Frame {
+	b := make([]byte, bufferSize)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	f, err := frame.Decode(b[:n])
+	if err != nil {
+		t.Fatalf("failed to decode %x: %s", b[:n], err)
+	}
+	return f
+}
+
+func encode(tb testing.TB, kind byte, sender, payload string) []byte {
+	b, err := frame.Encode(frame.Frame{Type: kind, Sender: sender, Time: time.Now(), Payload: []byte(payload)})
+	if err != nil {
+		tb.Fatalf("failed to encode: %s", err)
+	}
+	return b
+}
+
+func command(tb testing.TB, command string) []byte {
+	return encode(tb, frame.MessageCommand, "", command)
+}
+
+func reply(t *testing.T, c *net.UDPConn, expected string) {
+	if f := read(t, c); f.Type != frame.MessageReply || string(f.Payload) != expected {
+		t.Fatalf("expected the reply %q, got %d %q", expected, f.Type, f.Payload)
+	}
+}
+
+// The buffer a message is read into is reused for the next one before
+// the first is sent, and neither the sender nor another room receive it.
+func TestBroadcast(t *testing.T) {
+	s := newServer(t, &server{})
+	alice, a := socket(t)
+	bob, b := socket(t)
+	carol, c := socket(t)
+	s.Receive(b, command(t, "/nick bob"))
+	s.Receive(c, command(t, "/join other"))
+	reply(t, bob, "you are now bob")
+	reply(t, carol, "joined #other")
+
+	buffer := encode(t, frame.MessageChat, "", "one")
+	s.Receive(a, buffer)
+	copy(buffer, encode(t, frame.MessageChat, "", "two"))
+	s.Receive(a, buffer)
+
+	first, second := read(t, bob), read(t, bob)
+	received := []string{string(first.Payload), string(second.Payload)}
+	sort.Strings(received)
+	if received[0] != "one" || received[1] != "two" {
+		t.Fatalf("expected both messages intact, got %q", received)
+	} else if first.Type != frame.MessageChat || first.Sender != a.String() || time.Since(first.Time) > time.Second {
+		t.Fatalf("expected chat from %s just now, got %#v", a, first)
+	}
+	for _, other := range []*net.UDPConn{alice, carol} {
+		other.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if n, err := other.Read(make([]byte, bufferSize)); err == nil {
+			t.Fatalf("expected nothing, got %d bytes", n)
+		}
+	}
+
+	s.Receive(a, command(t, "/nick alice"))
+	reply(t, alice, "you are now alice")
+	s.Receive(b, command(t, "/msg alice hi"))
+	if f := read(t, alice); f.Type != frame.MessagePrivate || f.Sender != "bob" || string(f.Payload) != "hi" {
+		t.Fatalf("expected a private message, got %#v", f)
+	}
+	s.Receive(c, command(t, "/quit"))
+	s.Receive(b, command(t, "/who"))
+	reply(t, bob, "2 online: alice (#lobby), bob (#lobby)")
+	if len(s.rooms["other"]) != 0 || len(s.rooms[defaultRoom]) != 2 {
+		t.Fatalf("expected two in the lobby and no other room, got %v", s.rooms)
+	}
+}
+
+// The sender is whoever the server knows the client as, whatever the
+// frame claims, and anything a client should not send is dropped without
+// registering it.
+func TestSender(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	s := newServer(t, &server{})
+	_, a := socket(t)
+	bob, b := socket(t)
+	s.Receive(a, command(t, "/nick alice"))
+	s.Receive(b, command(t, "/nick bob"))
+	reply(t, bob, "you are now bob")
+
+	s.Receive(a, encode(t, frame.MessageChat, "bob", "it was me"))
+	if f := read(t, bob); f.Sender != "alice" || string(f.Payload) != "it was me" {
+		t.Fatalf("expected alice as the sender, got %#v", f)
+	}
+
+	pinged := time.Now().Add(-time.Minute)
+	ping, _ := frame.Encode(frame.Frame{Type: frame.MessagePing, Time: pinged})
+	s.Receive(b, ping)
+	if f := read(t, bob); f.Type != frame.MessagePong || !f.Time.Equal(pinged) {
+		t.Fatalf("expected a pong with the time pinged, got %#v", f)
+	}
+
+	s.Receive(b, encode(t, frame.MessageChat, "", string(make([]byte, frame.MaxMessageSize+1))))
+	reply(t, bob, tooLong)
+	for _, refused := range []string{
+		"/nick " + strings.Repeat("a", frame.MaxSenderSize+1),
+		"/nick bob\x00",
+		"/nick " + a.String(),
+		"/join " + strings.Repeat("a", frame.MaxSenderSize+1),
+		"/join bob's room",
+		"/join \x1b[2Jroom",
+		"/join \xff",
+	} {
+		s.Receive(b, command(t, refused))
+		if f := read(t, bob); f.Type != frame.MessageReply || !strings.HasPrefix(string(f.Payload), "usage: ") {
+			t.Fatalf("expected %q to be refused, got %#v", refused, f)
+		}
+	}
+	if c := s.clients[b]; c.identity != "bob" || c.room != defaultRoom {
+		t.Fatalf("expected bob to stay bob in #%s, got %s in #%s", defaultRoom, c.identity, c.room)
+	}
+
+	_, garbage := socket(t)
+	s.Receive(garbage, []byte("alice: hello"))
+	s.Receive(garbage, encode(t, frame.MessageReply, "", "you are now root"))
+	s.Receive(garbage, encode(t, frame.MessagePong, "", ""))
+	if len(s.clients) != 2 {
+		t.Fatalf("expected only alice and bob, got %d clients", len(s.clients))
+	}
+}
+
+// With the workers busy a full queue drops broadcasts rather than
+// holding up the server.
+func TestBroadcastDrops(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	s := newServer(t, &server{Workers: 1, Queue: 1})
+	_, a := socket(t)
+	bob, b := socket(t)
+	s.Receive(b, command(t, "/nick bob"))
+	reply(t, bob, "you are now bob")
+
+	message := encode(t, frame.MessageChat, "", "hello")
+	for i := 0; i < 1000; i++ {
+		s.Receive(a, message)
+	}
+	s.drain()
+	// the reply to /nick was also sent
+	if sent, dropped := s.Stats(); dropped == 0 || sent+dropped != 1001 {
+		t.Fatalf("expected some of 1000 broadcasts dropped, got %d sent and %d dropped", sent, dropped)
+	}
+}
+
+var sizes = []int{10, 1000, 10000}
+
+// Every client gets its own address on the loopback network, which all
+// reach one socket that never reads, so the kernel discards what the
+// server sends without anything else in the benchmark doing work.
+func clients(b *testing.B, s *server, n int) []netip.AddrPort {
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		b.Fatalf("failed to listen: %s", err)
+	}
+	b.Cleanup(func() { sink.Close() })
+	port := uint16(sink.LocalAddr().(*net.UDPAddr).Port)
+
+	addrs := make([]netip.AddrPort, n)
+	for i := range addrs {
+		addrs[i] = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 1, byte(i >> 8), byte(i)}), port)
+		c := &client{a: addrs[i], identity: fmt.Sprintf("client%d", i), room: defaultRoom}
+		s.clients[addrs[i]] = c
+		s.enter(c)
+	}
+	return addrs
+}
+
+// Finding the sender of each datagram in the map of clients, against
+// searching a slice of them.
+func BenchmarkLookup(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, n := range sizes {
+		s := newServer(b, &server{})
+		addrs := clients(b, s, n)
+		list := make([]*client, 0, n)
+		for _, c := range s.clients {
+			list = append(list, c)
+		}
+
+		b.Run(fmt.Sprintf("map/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if s.clients[addrs[i%n]] == nil {
+					b.Fatal("missing client")
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("slice/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var found *client
+				for _, c := range list {
+					if c.a == addrs[i%n] {
+						found = c
+						break
+					}
+				}
+				if found == nil {
+					b.Fatal("missing client")
+				}
+			}
+		})
+	}
+}
+
+// A message to a room of every client, timed until the workers have sent
+// it to all of them, reporting how many broadcasts were dropped.
+func BenchmarkBroadcast(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	message := encode(b, frame.MessageChat, "", "hello")
+	for _, n := range sizes {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			s := newServer(b, &server{})
+			from := clients(b, s, n)[0]
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				s.Receive(from, message)
+			}
+			s.drain()
+
+			sent, dropped := s.Stats()
+			b.ReportMetric(float64(sent)/float64(b.N), "sends/op")
+			b.ReportMetric(float64(dropped)/float64(b.N), "drops/op")
+		})
+	}
+}
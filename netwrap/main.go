@@ -41,7 +41,7 @@ import (
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/google/uuid"
+	"github.com/cdelorme/go-experiments/uuid"
 )
 
 var publicKey ed25519.PublicKey
@@ -0,0 +1,185 @@
+package uuid
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Both versions carry theirs in the thirteenth digit and the RFC variant
+// in the top bits of the seventeenth, and none repeat.
+func TestNew(t *testing.T) {
+	for version, create := range map[int]func() (UUID, error){4: NewV4, 7: NewV7} {
+		seen := make(map[UUID]bool)
+		for i := 0; i < 1000; i++ {
+			u, err := create()
+			if err != nil {
+				t.Fatalf("failed to create version %d: %s", version, err)
+			} else if u.Version() != version {
+				t.Fatalf("expected version %d, got %d in %s", version, u.Version(), u)
+			} else if s := u.String(); s[14] != byte('0'+version) || !strings.ContainsRune("89ab", rune(s[19])) {
+				t.Fatalf("expected version %d and the RFC variant, got %s", version, s)
+			} else if seen[u] {
+				t.Fatalf("created %s twice...", u)
+			}
+			seen[u] = true
+		}
+	}
+}
+
+// Version 7 sorts in the order created, as bytes and as text, even when
+// many are created within a millisecond, and records when that was.
+func TestV7(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	created := make([]string, 10000)
+	for i := range created {
+		created[i] = Must(NewV7()).String()
+	}
+	if !sort.StringsAreSorted(created) {
+		t.Fatal("expected version 7 to sort in the order created...")
+	}
+	for i := 1; i < len(created); i++ {
+		if created[i] == created[i-1] {
+			t.Fatalf("created %s twice...", created[i])
+		}
+	}
+
+	u := Must(Parse(created[0]))
+	if u.Time().Before(before) || u.Time().After(time.Now()) {
+		t.Fatalf("expected a time after %s, got %s", before, u.Time())
+	} else if !New().Time().IsZero() {
+		t.Fatal("expected no time from version 4...")
+	}
+}
+
+type failing struct{}
+
+func (failing) Read([]byte) (int, error) { return 0, errors.New("no randomness") }
+
+// Without randomness nothing is created, rather than a predictable value.
+func TestNoRandomness(t *testing.T) {
+	original := reader
+	reader = failing{}
+	defer func() { reader = original }()
+	if _, err := NewV4(); err == nil {
+		t.Fatal("expected version 4 to fail...")
+	} else if _, err := NewV7(); err == nil {
+		t.Fatal("expected version 7 to fail...")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected New to panic...")
+		}
+	}()
+	New()
+}
+
+func TestParse(t *testing.T) {
+	canonical := "0192d5f6-3c1e-7a2b-8c3d-4e5f6a7b8c9d"
+	for _, s := range []string{
+		canonical,
+		strings.ToUpper(canonical),
+		"{" + canonical + "}",
+		"urn:uuid:" + canonical,
+		"URN:UUID:" + canonical,
+		strings.ReplaceAll(canonical, "-", ""),
+	} {
+		u, err := Parse(s)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", s, err)
+		} else if u.String() != canonical {
+			t.Fatalf("expected %s from %s, got %s", canonical, s, u)
+		}
+	}
+	if u := Must(Parse("00000000-0000-0000-0000-000000000000")); u != Nil || u.Version() != 0 {
+		t.Fatalf("expected Nil, got %s", u)
+	}
+
+	for _, s := range []string{
+		"",
+		canonical[:35],
+		canonical + "0",
+		strings.Replace(canonical, "-", "_", 1),
+		strings.Replace(canonical, "-", "", 1) + "0",
+		strings.Replace(canonical, "d", "g", 1),
+		"{" + canonical,
+		"urn:uid:" + canonical + "0",
+	} {
+		if Valid(s) {
+			t.Fatalf("expected %q to be invalid...", s)
+		}
+	}
+}
+
+// Text in JSON, including as a map key, and in either direction.
+func TestJSON(t *testing.T) {
+	type record struct {
+		ID    UUID          `json:"id"`
+		Peers map[UUID]bool `json:"peers"`
+	}
+	in := record{ID: Must(NewV7()), Peers: map[UUID]bool{New(): true}}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	} else if !strings.Contains(string(b), `"id":"`+in.ID.String()+`"`) {
+		t.Fatalf("expected the id as text, got %s", b)
+	}
+
+	var out record
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatalf("failed to unmarshal: %s", err)
+	} else if out.ID != in.ID || len(out.Peers) != 1 {
+		t.Fatalf("expected %v, got %v", in, out)
+	}
+	if err := json.Unmarshal([]byte(`{"id":"not a uuid"}`), &out); err == nil {
+		t.Fatal("expected an invalid id to fail...")
+	}
+}
+
+// Stored as text, and read back from text, binary or NULL.
+func TestSQL(t *testing.T) {
+	u := New()
+	if v, err := u.Value(); err != nil || v != u.String() {
+		t.Fatalf("expected %s, got %v (%v)", u, v, err)
+	}
+
+	for _, src := range []any{u.String(), []byte(u.String()), u[:]} {
+		var scanned UUID
+		if err := scanned.Scan(src); err != nil {
+			t.Fatalf("failed to scan %T: %s", src, err)
+		} else if scanned != u {
+			t.Fatalf("expected %s from %T, got %s", u, src, scanned)
+		}
+	}
+
+	scanned := u
+	if err := scanned.Scan(nil); err != nil || scanned != Nil {
+		t.Fatalf("expected NULL to scan as Nil, got %s (%v)", scanned, err)
+	} else if err := scanned.Scan(42); err == nil {
+		t.Fatal("expected an integer to fail...")
+	} else if err := scanned.Scan([]byte("short")); err == nil {
+		t.Fatal("expected a few bytes to fail...")
+	}
+}
+
+func BenchmarkNewV4(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Must(NewV4())
+	}
+}
+
+func BenchmarkNewV7(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Must(NewV7())
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	s := New().String()
+	for i := 0; i < b.N; i++ {
+		Must(Parse(s))
+	}
+}